@@ -39,7 +39,9 @@ type Sample struct {
 }
 
 // Equal compares first the metrics, then the timestamp, then the value. The
-// semantics of value equality is defined by SampleValue.Equal.
+// semantics of value equality is defined by SampleValue.Equal. If either
+// sample carries a histogram, both must carry one and the histograms are
+// compared with SampleHistogram.Equal instead.
 func (s *Sample) Equal(o *Sample) bool {
 	if s == o {
 		return true
@@ -51,7 +53,10 @@ func (s *Sample) Equal(o *Sample) bool {
 	if !s.Timestamp.Equal(o.Timestamp) {
 		return false
 	}
-	if s.Histogram != nil {
+	if s.Histogram != nil || o.Histogram != nil {
+		if s.Histogram == nil || o.Histogram == nil {
+			return false
+		}
 		return s.Histogram.Equal(o.Histogram)
 	}
 	return s.Value.Equal(o.Value)
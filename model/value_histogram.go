@@ -14,12 +14,38 @@
 package model
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// ComputeSumFromMidpointsWhenMissing determines whether a SampleHistogram
+// decoded from JSON without a "sum" field gets its Sum estimated from the
+// bucket midpoints weighted by their counts. An explicit "sum" is always
+// used as is. This value should be set once, before any decoding happens.
+var ComputeSumFromMidpointsWhenMissing = false
+
+// AcceptLEObjectBuckets determines whether SampleHistogram's UnmarshalJSON
+// also accepts buckets given as a JSON object mapping upper bounds to
+// cumulative counts, as in {"0.1":"5","0.5":"12","+Inf":"20"}. The counts are
+// de-cumulated into upper-inclusive buckets. Following the convention for
+// classic histograms, the lowest bucket starts at 0 if its upper bound is
+// positive and at -Inf otherwise. This value should be set once, before any
+// decoding happens.
+var AcceptLEObjectBuckets = false
+
+// ClampNegativeCountsOnDecode determines whether SampleHistogram's
+// UnmarshalJSON replaces negative counts and sums, as produced by some
+// buggy exporters, with 0. If a bucket count had to be clamped, the total
+// count is recomputed from the bucket counts. This value should be set once,
+// before any decoding happens.
+var ClampNegativeCountsOnDecode = false
+
 type FloatString float64
 
 func (v FloatString) String() string {
@@ -47,6 +73,12 @@ type HistogramBucket struct {
 	Lower      FloatString
 	Upper      FloatString
 	Count      FloatString
+	// CountExact optionally holds the count as an exact integer, for counts
+	// beyond 2^53 that Count cannot represent exactly. If set, it must round
+	// to Count. It is set when decoding such counts from JSON. Methods
+	// deriving new histograms keep it exact when adding up counts and drop
+	// it when rewriting Count in any other way.
+	CountExact *big.Int
 }
 
 func (s HistogramBucket) MarshalJSON() ([]byte, error) {
@@ -66,11 +98,17 @@ func (s HistogramBucket) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.CountExact != nil {
+		if i, ok := s.ExactCount(); ok {
+			c = strconv.AppendQuote(nil, i.String())
+		}
+	}
 	return []byte(fmt.Sprintf("[%s,%s,%s,%s]", b, l, u, c)), nil
 }
 
 func (s *HistogramBucket) UnmarshalJSON(buf []byte) error {
-	tmp := []interface{}{&s.Boundaries, &s.Lower, &s.Upper, &s.Count}
+	var count json.RawMessage
+	tmp := []interface{}{&s.Boundaries, &s.Lower, &s.Upper, &count}
 	wantLen := len(tmp)
 	if err := json.Unmarshal(buf, &tmp); err != nil {
 		return err
@@ -78,6 +116,36 @@ func (s *HistogramBucket) UnmarshalJSON(buf []byte) error {
 	if gotLen := len(tmp); gotLen != wantLen {
 		return fmt.Errorf("wrong number of fields: %d != %d", gotLen, wantLen)
 	}
+	if err := json.Unmarshal(count, &s.Count); err != nil {
+		return err
+	}
+	s.CountExact = nil
+	if math.Abs(float64(s.Count)) > maxExactCount {
+		if i, ok := new(big.Int).SetString(string(count[1:len(count)-1]), 10); ok {
+			s.CountExact = i
+		}
+	}
+	return nil
+}
+
+// Validate checks whether the bucket has a known boundary rule, ordered
+// bounds and a non-negative count.
+func (s *HistogramBucket) Validate() error {
+	if s.Boundaries < 0 || s.Boundaries > 3 {
+		return fmt.Errorf("invalid boundaries %d", s.Boundaries)
+	}
+	if math.IsNaN(float64(s.Lower)) || math.IsNaN(float64(s.Upper)) {
+		return fmt.Errorf("bounds must not be NaN")
+	}
+	if s.Lower > s.Upper {
+		return fmt.Errorf("lower bound %v is greater than upper bound %v", s.Lower, s.Upper)
+	}
+	if s.Lower == s.Upper && s.Boundaries != 3 {
+		return fmt.Errorf("empty interval with equal bounds %v", s.Lower)
+	}
+	if math.IsNaN(float64(s.Count)) || s.Count < 0 {
+		return fmt.Errorf("invalid count %v", s.Count)
+	}
 	return nil
 }
 
@@ -86,9 +154,17 @@ func (s *HistogramBucket) Equal(o *HistogramBucket) bool {
 }
 
 func (b HistogramBucket) String() string {
+	return b.interval() + ":" + b.Count.String()
+}
+
+// interval formats the bounds of the bucket in interval notation, leaving
+// out its count.
+func (b HistogramBucket) interval() string {
 	var sb strings.Builder
-	lowerInclusive := b.Boundaries == 1 || b.Boundaries == 3
-	upperInclusive := b.Boundaries == 0 || b.Boundaries == 3
+	// Infinite bounds are never part of the interval, whatever the
+	// boundary rule says.
+	lowerInclusive := (b.Boundaries == 1 || b.Boundaries == 3) && !math.IsInf(float64(b.Lower), 0)
+	upperInclusive := (b.Boundaries == 0 || b.Boundaries == 3) && !math.IsInf(float64(b.Upper), 0)
 	if lowerInclusive {
 		sb.WriteRune('[')
 	} else {
@@ -100,10 +176,42 @@ func (b HistogramBucket) String() string {
 	} else {
 		sb.WriteRune(')')
 	}
-	fmt.Fprintf(&sb, ":%v", b.Count)
 	return sb.String()
 }
 
+// CompactHistogramBucket is a HistogramBucket holding its bounds and count
+// as float32 values, halving their memory footprint. Values keep only about
+// 7 significant decimal digits, so bounds that differ by less get merged and
+// counts above 2^24 are no longer exact.
+type CompactHistogramBucket struct {
+	Boundaries int32
+	Lower      float32
+	Upper      float32
+	Count      float32
+}
+
+// Compact converts the bucket into a CompactHistogramBucket, rounding its
+// bounds and count to the nearest float32 value.
+func (b HistogramBucket) Compact() CompactHistogramBucket {
+	return CompactHistogramBucket{
+		Boundaries: b.Boundaries,
+		Lower:      float32(b.Lower),
+		Upper:      float32(b.Upper),
+		Count:      float32(b.Count),
+	}
+}
+
+// Expand converts the bucket back into a HistogramBucket. Precision lost
+// by Compact is not restored.
+func (b CompactHistogramBucket) Expand() HistogramBucket {
+	return HistogramBucket{
+		Boundaries: b.Boundaries,
+		Lower:      FloatString(b.Lower),
+		Upper:      FloatString(b.Upper),
+		Count:      FloatString(b.Count),
+	}
+}
+
 type HistogramBuckets []*HistogramBucket
 
 func (s HistogramBuckets) Equal(o HistogramBuckets) bool {
@@ -119,6 +227,20 @@ func (s HistogramBuckets) Equal(o HistogramBuckets) bool {
 	return true
 }
 
+// Validate checks every bucket and returns the first error encountered,
+// annotated with the index of the offending bucket.
+func (s HistogramBuckets) Validate() error {
+	for i, b := range s {
+		if b == nil {
+			return fmt.Errorf("bucket %d is nil", i)
+		}
+		if err := b.Validate(); err != nil {
+			return fmt.Errorf("invalid bucket %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
 type SampleHistogram struct {
 	Count   FloatString      `json:"count"`
 	Sum     FloatString      `json:"sum"`
@@ -129,10 +251,356 @@ func (s SampleHistogram) String() string {
 	return fmt.Sprintf("Count: %f, Sum: %f, Buckets: %v", s.Count, s.Sum, s.Buckets)
 }
 
+// MarshalJSON encodes the histogram as an object with the fields count, sum
+// and buckets, always in this order and with the buckets in the order they
+// are stored in, so that equal histograms encode to identical bytes.
+func (s SampleHistogram) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := s.writeJSON(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJSON appends the JSON object representation of the histogram to buf.
+func (s *SampleHistogram) writeJSON(buf *bytes.Buffer) error {
+	c, err := json.Marshal(s.Count)
+	if err != nil {
+		return err
+	}
+	sum, err := json.Marshal(s.Sum)
+	if err != nil {
+		return err
+	}
+	buckets := s.Buckets
+	if buckets == nil {
+		// An empty histogram has an empty bucket list, not a null one.
+		buckets = HistogramBuckets{}
+	}
+	b, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(`{"count":`)
+	buf.Write(c)
+	buf.WriteString(`,"sum":`)
+	buf.Write(sum)
+	buf.WriteString(`,"buckets":`)
+	buf.Write(b)
+	buf.WriteByte('}')
+	return nil
+}
+
+func (s *SampleHistogram) UnmarshalJSON(b []byte) error {
+	v := struct {
+		Count   FloatString     `json:"count"`
+		Sum     *FloatString    `json:"sum"`
+		Buckets json.RawMessage `json:"buckets"`
+	}{
+		Count: s.Count,
+	}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	s.Count = v.Count
+	if v.Buckets != nil {
+		buckets, err := unmarshalBuckets(v.Buckets)
+		if err != nil {
+			return err
+		}
+		s.Buckets = buckets
+	}
+	if ClampNegativeCountsOnDecode {
+		s.clampNegativeCounts()
+	}
+	switch {
+	case v.Sum != nil:
+		s.Sum = *v.Sum
+		if ClampNegativeCountsOnDecode && s.Sum < 0 {
+			s.Sum = 0
+		}
+	case ComputeSumFromMidpointsWhenMissing:
+		s.Sum = FloatString(s.midpointSum())
+	}
+	return nil
+}
+
+// clampNegativeCounts sets negative bucket counts and a negative total
+// count to 0. If a bucket count was clamped, the total count is recomputed
+// from the bucket counts.
+func (s *SampleHistogram) clampNegativeCounts() {
+	clamped := false
+	for _, b := range s.Buckets {
+		if b != nil && b.Count < 0 {
+			b.Count, b.CountExact = 0, nil
+			clamped = true
+		}
+	}
+	if clamped {
+		s.Count = FloatString(s.bucketTotal())
+	}
+	if s.Count < 0 {
+		s.Count = 0
+	}
+}
+
+// unmarshalBuckets decodes a JSON array of buckets. The elements are counted
+// upfront so that the slice and the buckets themselves are allocated at
+// once, which matters for native histograms with hundreds of buckets.
+// Buckets in their canonical form are parsed without going through
+// encoding/json at all.
+func unmarshalBuckets(raw []byte) (HistogramBuckets, error) {
+	raw = bytes.TrimSpace(raw)
+	if string(raw) == "null" {
+		return nil, nil
+	}
+	if AcceptLEObjectBuckets && len(raw) > 0 && raw[0] == '{' {
+		return unmarshalLEObjectBuckets(raw)
+	}
+	n := 0
+	if err := scanJSONArray(raw, func([]byte) error { n++; return nil }); err != nil {
+		return nil, fmt.Errorf("invalid buckets: %w", err)
+	}
+	backing := make([]HistogramBucket, n)
+	buckets := make(HistogramBuckets, n)
+	i := 0
+	err := scanJSONArray(raw, func(elem []byte) error {
+		if string(elem) != "null" {
+			if !parseBucket(elem, &backing[i]) {
+				if err := backing[i].UnmarshalJSON(elem); err != nil {
+					return err
+				}
+			}
+			buckets[i] = &backing[i]
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// unmarshalLEObjectBuckets decodes buckets given as a JSON object of
+// cumulative counts keyed by upper bound. See AcceptLEObjectBuckets.
+func unmarshalLEObjectBuckets(raw []byte) (HistogramBuckets, error) {
+	var cumulative map[string]FloatString
+	if err := json.Unmarshal(raw, &cumulative); err != nil {
+		return nil, err
+	}
+	type bound struct {
+		le    float64
+		count FloatString
+	}
+	bounds := make([]bound, 0, len(cumulative))
+	for k, c := range cumulative {
+		le, err := strconv.ParseFloat(k, 64)
+		if err != nil || math.IsNaN(le) {
+			return nil, fmt.Errorf("invalid bucket bound %q", k)
+		}
+		bounds = append(bounds, bound{le: le, count: c})
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].le < bounds[j].le })
+
+	buckets := make(HistogramBuckets, 0, len(bounds))
+	lower, prev := math.Inf(-1), FloatString(0)
+	if len(bounds) > 0 && bounds[0].le > 0 {
+		lower = 0
+	}
+	for _, b := range bounds {
+		if b.count < prev {
+			return nil, fmt.Errorf("cumulative count %v of bucket %v is decreasing", b.count, b.le)
+		}
+		buckets = append(buckets, &HistogramBucket{
+			Lower: FloatString(lower),
+			Upper: FloatString(b.le),
+			Count: b.count - prev,
+		})
+		lower, prev = b.le, b.count
+	}
+	return buckets, nil
+}
+
+// parseBucket is a fast path for decoding a bucket in its canonical form,
+// e.g. [0,"1","2","3"]. It returns false if the input is in any other form,
+// leaving it to HistogramBucket.UnmarshalJSON to decode or reject it. Counts
+// beyond 2^53 are left to it as well, as they need CountExact.
+func parseBucket(elem []byte, b *HistogramBucket) bool {
+	fields := [4][]byte{}
+	rest := bytes.TrimSpace(elem)
+	if len(rest) < 2 || rest[0] != '[' || rest[len(rest)-1] != ']' {
+		return false
+	}
+	rest = rest[1 : len(rest)-1]
+	for i := range fields {
+		var field []byte
+		if j := bytes.IndexByte(rest, ','); j >= 0 && i < len(fields)-1 {
+			field, rest = rest[:j], rest[j+1:]
+		} else {
+			field, rest = rest, nil
+		}
+		fields[i] = bytes.TrimSpace(field)
+	}
+	if rest != nil {
+		return false
+	}
+
+	boundaries, err := strconv.ParseInt(string(fields[0]), 10, 32)
+	if err != nil {
+		return false
+	}
+	var values [3]float64
+	for i, f := range fields[1:] {
+		if len(f) < 2 || f[0] != '"' || f[len(f)-1] != '"' || bytes.IndexByte(f[1:len(f)-1], '\\') >= 0 {
+			return false
+		}
+		if values[i], err = strconv.ParseFloat(string(f[1:len(f)-1]), 64); err != nil {
+			return false
+		}
+	}
+	if math.Abs(values[2]) > maxExactCount {
+		return false
+	}
+	b.Boundaries = int32(boundaries)
+	b.Lower = FloatString(values[0])
+	b.Upper = FloatString(values[1])
+	b.Count = FloatString(values[2])
+	return true
+}
+
+// scanJSONArray calls fn with each raw element of a well-formed JSON array,
+// without decoding them.
+func scanJSONArray(raw []byte, fn func(elem []byte) error) error {
+	if len(raw) < 2 || raw[0] != '[' || raw[len(raw)-1] != ']' {
+		return fmt.Errorf("not a JSON array")
+	}
+	var (
+		depth    int
+		inString bool
+		start    = 1
+	)
+	inner := raw[:len(raw)-1]
+	for i := 1; i < len(inner); i++ {
+		c := inner[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				if err := fn(bytes.TrimSpace(inner[start:i])); err != nil {
+					return err
+				}
+				start = i + 1
+			}
+		}
+	}
+	if last := bytes.TrimSpace(inner[start:]); len(last) > 0 {
+		return fn(last)
+	}
+	return nil
+}
+
+// UnmarshalHistogramStrict decodes a histogram like SampleHistogram's
+// UnmarshalJSON does, but additionally returns the names of all top-level
+// fields it does not know, sorted alphabetically. Unknown fields do not cause
+// an error.
+func UnmarshalHistogramStrict(data []byte) (*SampleHistogram, []string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, err
+	}
+	var s SampleHistogram
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, nil, err
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !strings.EqualFold(name, "count") && !strings.EqualFold(name, "sum") && !strings.EqualFold(name, "buckets") {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return &s, unknown, nil
+}
+
+// IsEmpty reports whether the histogram has no buckets at all, i.e. carries
+// no information about the distribution of observations. Compare IsZero.
+func (s *SampleHistogram) IsEmpty() bool {
+	for _, b := range s.Buckets {
+		if b != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// IsZero reports whether the histogram has buckets but all of them are
+// empty, i.e. the bucket layout is known but nothing has been observed yet.
+// An empty histogram as reported by IsEmpty is not zero.
+func (s *SampleHistogram) IsZero() bool {
+	if s.IsEmpty() {
+		return false
+	}
+	for _, b := range s.Buckets {
+		if b != nil && b.Count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// PrettyString returns a multi-line rendering of the histogram intended for
+// debugging. Every bucket is printed on its own line in interval notation
+// followed by its count.
+func (s *SampleHistogram) PrettyString() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Count: %v\nSum: %v\nBuckets:\n", s.Count, s.Sum)
+	for _, b := range s.Buckets {
+		fmt.Fprintf(&sb, "  %v\n", b)
+	}
+	return sb.String()
+}
+
 func (s *SampleHistogram) Equal(o *SampleHistogram) bool {
 	return s == o || (s.Count == o.Count && s.Sum == o.Sum && s.Buckets.Equal(o.Buckets))
 }
 
+// Validate checks whether the histogram data is inconsistent. The buckets
+// must be valid and may not hold more observations than the total count.
+func (s *SampleHistogram) Validate() error {
+	if math.IsNaN(float64(s.Count)) || s.Count < 0 {
+		return fmt.Errorf("invalid count %v", s.Count)
+	}
+	if err := s.Buckets.Validate(); err != nil {
+		return err
+	}
+	var total float64
+	for _, b := range s.Buckets {
+		total += float64(b.Count)
+	}
+	if total > float64(s.Count)*(1+1e-9) {
+		return fmt.Errorf("bucket counts sum to %v which exceeds count %v", total, s.Count)
+	}
+	return nil
+}
+
 type SampleHistogramPair struct {
 	Timestamp Time
 	// Histogram should never be nil, it's only stored as pointer for efficiency.
@@ -147,11 +615,15 @@ func (s SampleHistogramPair) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	v, err := json.Marshal(s.Histogram)
-	if err != nil {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	buf.Write(t)
+	buf.WriteByte(',')
+	if err := s.Histogram.writeJSON(&buf); err != nil {
 		return nil, err
 	}
-	return []byte(fmt.Sprintf("[%s,%s]", t, v)), nil
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
 }
 
 func (s *SampleHistogramPair) UnmarshalJSON(buf []byte) error {
@@ -169,6 +641,21 @@ func (s *SampleHistogramPair) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
+// Validate checks whether the pair is complete and its histogram is
+// consistent.
+func (s *SampleHistogramPair) Validate() error {
+	if s.Histogram == nil {
+		return fmt.Errorf("histogram is nil")
+	}
+	if s.Timestamp < 0 {
+		return fmt.Errorf("negative timestamp %v", s.Timestamp)
+	}
+	if err := s.Histogram.Validate(); err != nil {
+		return fmt.Errorf("invalid histogram: %w", err)
+	}
+	return nil
+}
+
 func (s SampleHistogramPair) String() string {
 	return fmt.Sprintf("%s @[%s]", s.Histogram, s.Timestamp)
 }
@@ -0,0 +1,476 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Chunk encodings of native histograms as used by the Prometheus TSDB and
+// its remote-read protocol.
+const (
+	chunkEncodingHistogram      = 2
+	chunkEncodingFloatHistogram = 3
+)
+
+// Range of the exponential schemas of native histograms.
+const (
+	minNativeSchema = -4
+	maxNativeSchema = 8
+)
+
+// HistogramFromChunk decodes a native histogram chunk as found in
+// remote-read responses and returns the most recent histogram it holds. The
+// encoding is the chunk encoding byte, 2 for integer and 3 for float
+// histograms; other encodings are rejected. The delta-encoded bucket counts
+// of integer histograms are resolved into absolute counts, and the
+// exponential buckets are converted into buckets with explicit bounds.
+// Buckets without observations are omitted. Histograms with custom bucket
+// bounds are not supported.
+func HistogramFromChunk(data []byte, encoding byte) (*SampleHistogram, error) {
+	if encoding != chunkEncodingHistogram && encoding != chunkEncodingFloatHistogram {
+		return nil, fmt.Errorf("unsupported chunk encoding %d", encoding)
+	}
+	if len(data) < 3 {
+		return nil, fmt.Errorf("chunk too short: %d bytes", len(data))
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if n == 0 {
+		return nil, fmt.Errorf("chunk holds no samples")
+	}
+	// The third byte holds the counter reset hint, which is of no interest
+	// when decoding a single histogram.
+	r := &chunkReader{data: data[3:]}
+
+	l, err := r.readLayout()
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk layout: %w", err)
+	}
+	var h *nativeHistogram
+	if encoding == chunkEncodingHistogram {
+		h, err = r.readIntSamples(n, l)
+	} else {
+		h, err = r.readFloatSamples(n, l)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk samples: %w", err)
+	}
+	return l.histogram(h), nil
+}
+
+// nativeSpan is a run of consecutive buckets of a native histogram. Offset
+// is the gap to the end of the previous span or, for the first span, the
+// index of its first bucket.
+type nativeSpan struct {
+	offset int32
+	length uint32
+}
+
+// nativeLayout is the bucket layout shared by all histograms of a chunk.
+type nativeLayout struct {
+	schema        int32
+	zeroThreshold float64
+	positive      []nativeSpan
+	negative      []nativeSpan
+}
+
+// nativeHistogram holds the absolute counts of a decoded histogram in the
+// order of its layout, positive buckets first.
+type nativeHistogram struct {
+	count, zeroCount, sum float64
+	buckets               []float64
+}
+
+func (l *nativeLayout) buckets() int {
+	var n int
+	for _, s := range l.positive {
+		n += int(s.length)
+	}
+	for _, s := range l.negative {
+		n += int(s.length)
+	}
+	return n
+}
+
+// histogram converts the decoded counts into a SampleHistogram with buckets
+// in ascending order of their bounds.
+func (l *nativeLayout) histogram(h *nativeHistogram) *SampleHistogram {
+	positive := spanIndices(l.positive)
+	negative := spanIndices(l.negative)
+	res := &SampleHistogram{Count: FloatString(h.count), Sum: FloatString(h.sum)}
+
+	for i := len(negative) - 1; i >= 0; i-- {
+		c := h.buckets[len(positive)+i]
+		if c == 0 {
+			continue
+		}
+		res.Buckets = append(res.Buckets, &HistogramBucket{
+			Boundaries: 1,
+			Lower:      FloatString(-nativeBucketBound(negative[i], l.schema)),
+			Upper:      FloatString(-nativeBucketBound(negative[i]-1, l.schema)),
+			Count:      FloatString(c),
+		})
+	}
+	if h.zeroCount != 0 {
+		res.Buckets = append(res.Buckets, &HistogramBucket{
+			Boundaries: 3,
+			Lower:      FloatString(-l.zeroThreshold),
+			Upper:      FloatString(l.zeroThreshold),
+			Count:      FloatString(h.zeroCount),
+		})
+	}
+	for i, idx := range positive {
+		c := h.buckets[i]
+		if c == 0 {
+			continue
+		}
+		res.Buckets = append(res.Buckets, &HistogramBucket{
+			Boundaries: 0,
+			Lower:      FloatString(nativeBucketBound(idx-1, l.schema)),
+			Upper:      FloatString(nativeBucketBound(idx, l.schema)),
+			Count:      FloatString(c),
+		})
+	}
+	return res
+}
+
+// spanIndices returns the bucket index of every bucket covered by spans.
+func spanIndices(spans []nativeSpan) []int32 {
+	var res []int32
+	var idx int32
+	for _, s := range spans {
+		idx += s.offset
+		for j := uint32(0); j < s.length; j++ {
+			res = append(res, idx)
+			idx++
+		}
+	}
+	return res
+}
+
+// nativeBucketBound returns the upper bound of the bucket with the given
+// index in an exponential schema, that is 2^(idx * 2^-schema).
+func nativeBucketBound(idx, schema int32) float64 {
+	if schema < 0 {
+		return math.Ldexp(1, int(idx)<<-schema)
+	}
+	frac := idx & (1<<schema - 1)
+	exp := int(idx>>schema) + 1
+	return math.Ldexp(0.5*math.Exp2(float64(frac)/float64(int32(1)<<schema)), exp)
+}
+
+// chunkReader reads the bit stream of a chunk, most significant bit first.
+type chunkReader struct {
+	data []byte
+	pos  int // In bits.
+}
+
+func (r *chunkReader) readBit() (bool, error) {
+	if r.pos >= len(r.data)*8 {
+		return false, fmt.Errorf("unexpected end of chunk")
+	}
+	bit := r.data[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+func (r *chunkReader) readBits(n int) (uint64, error) {
+	if r.pos+n > len(r.data)*8 {
+		return 0, fmt.Errorf("unexpected end of chunk")
+	}
+	var v uint64
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if r.data[r.pos/8]&(0x80>>(r.pos%8)) != 0 {
+			v |= 1
+		}
+		r.pos++
+	}
+	return v, nil
+}
+
+// readVarbitPrefix reads the prefix of a variable bit-width integer and
+// returns the width of the value following it. A width of 0 denotes the
+// value 0 without further bits.
+func (r *chunkReader) readVarbitPrefix() (int, error) {
+	var ones int
+	for ones < 8 {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		ones++
+	}
+	return [...]int{0, 3, 6, 9, 12, 18, 25, 56, 64}[ones], nil
+}
+
+func (r *chunkReader) readVarbitInt() (int64, error) {
+	width, err := r.readVarbitPrefix()
+	if err != nil || width == 0 {
+		return 0, err
+	}
+	v, err := r.readBits(width)
+	if err != nil {
+		return 0, err
+	}
+	if width < 64 && v > 1<<(width-1) {
+		// Values are stored in two's complement, with the range covering
+		// 1<<(width-1) instead of its negative counterpart.
+		return int64(v) - 1<<width, nil
+	}
+	return int64(v), nil
+}
+
+func (r *chunkReader) readVarbitUint() (uint64, error) {
+	width, err := r.readVarbitPrefix()
+	if err != nil || width == 0 {
+		return 0, err
+	}
+	return r.readBits(width)
+}
+
+func (r *chunkReader) readFloat() (float64, error) {
+	v, err := r.readBits(64)
+	return math.Float64frombits(v), err
+}
+
+// xorState holds the number of leading and trailing zero bits of the last
+// XOR-encoded change of a float value.
+type xorState struct {
+	leading, trailing int
+}
+
+// readXOR applies the next XOR-encoded change to v.
+func (r *chunkReader) readXOR(v *float64, s *xorState) error {
+	changed, err := r.readBit()
+	if err != nil || !changed {
+		return err
+	}
+	newWindow, err := r.readBit()
+	if err != nil {
+		return err
+	}
+	if newWindow {
+		leading, err := r.readBits(5)
+		if err != nil {
+			return err
+		}
+		sig, err := r.readBits(6)
+		if err != nil {
+			return err
+		}
+		if sig == 0 {
+			sig = 64
+		}
+		s.leading, s.trailing = int(leading), 64-int(leading)-int(sig)
+		if s.trailing < 0 {
+			return fmt.Errorf("invalid XOR window")
+		}
+	}
+	delta, err := r.readBits(64 - s.leading - s.trailing)
+	if err != nil {
+		return err
+	}
+	*v = math.Float64frombits(math.Float64bits(*v) ^ delta<<s.trailing)
+	return nil
+}
+
+func (r *chunkReader) readSpans() ([]nativeSpan, error) {
+	n, err := r.readVarbitUint()
+	if err != nil {
+		return nil, err
+	}
+	// Every span takes at least two bits.
+	if n > uint64(len(r.data)*8-r.pos)/2 {
+		return nil, fmt.Errorf("too many spans: %d", n)
+	}
+	spans := make([]nativeSpan, n)
+	for i := range spans {
+		length, err := r.readVarbitUint()
+		if err != nil {
+			return nil, err
+		}
+		offset, err := r.readVarbitInt()
+		if err != nil {
+			return nil, err
+		}
+		if length > math.MaxUint32 || offset < math.MinInt32 || offset > math.MaxInt32 {
+			return nil, fmt.Errorf("span %d out of range", i)
+		}
+		spans[i] = nativeSpan{offset: int32(offset), length: uint32(length)}
+	}
+	return spans, nil
+}
+
+func (r *chunkReader) readLayout() (*nativeLayout, error) {
+	l := &nativeLayout{}
+	threshold, err := r.readBits(8)
+	if err != nil {
+		return nil, err
+	}
+	switch threshold {
+	case 0:
+	case 255:
+		if l.zeroThreshold, err = r.readFloat(); err != nil {
+			return nil, err
+		}
+	default:
+		// Powers of two are stored as their biased exponent.
+		l.zeroThreshold = math.Ldexp(0.5, int(threshold)-243)
+	}
+	schema, err := r.readVarbitInt()
+	if err != nil {
+		return nil, err
+	}
+	if schema < minNativeSchema || schema > maxNativeSchema {
+		return nil, fmt.Errorf("unsupported histogram schema %d", schema)
+	}
+	l.schema = int32(schema)
+	if l.positive, err = r.readSpans(); err != nil {
+		return nil, err
+	}
+	if l.negative, err = r.readSpans(); err != nil {
+		return nil, err
+	}
+	// Every bucket takes at least one bit per sample.
+	if l.buckets() > len(r.data)*8-r.pos {
+		return nil, fmt.Errorf("too many buckets: %d", l.buckets())
+	}
+	return l, nil
+}
+
+// readIntSamples reads n integer histograms, whose counts are stored as
+// deltas to the previous sample from the second sample on, and as deltas of
+// those deltas from the third. Within each histogram, the counts of the
+// positive and of the negative buckets are in turn stored as deltas to the
+// previous bucket.
+func (r *chunkReader) readIntSamples(n int, l *nativeLayout) (*nativeHistogram, error) {
+	var (
+		count, zeroCount, countDelta, zeroCountDelta int64
+		sum                                          float64
+		sumState                                     xorState
+		deltas                                       = make([]int64, l.buckets())
+		deltaDeltas                                  = make([]int64, len(deltas))
+	)
+	for i := 0; i < n; i++ {
+		// Timestamps are of no interest here but must be skipped.
+		if _, err := r.readVarbitInt(); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			c, err := r.readVarbitUint()
+			if err != nil {
+				return nil, err
+			}
+			zc, err := r.readVarbitUint()
+			if err != nil {
+				return nil, err
+			}
+			count, zeroCount = int64(c), int64(zc)
+			if sum, err = r.readFloat(); err != nil {
+				return nil, err
+			}
+			for j := range deltas {
+				if deltas[j], err = r.readVarbitInt(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		dc, err := r.readVarbitInt()
+		if err != nil {
+			return nil, err
+		}
+		dzc, err := r.readVarbitInt()
+		if err != nil {
+			return nil, err
+		}
+		if i == 1 {
+			countDelta, zeroCountDelta = dc, dzc
+		} else {
+			countDelta += dc
+			zeroCountDelta += dzc
+		}
+		count += countDelta
+		zeroCount += zeroCountDelta
+		if err := r.readXOR(&sum, &sumState); err != nil {
+			return nil, err
+		}
+		for j := range deltas {
+			v, err := r.readVarbitInt()
+			if err != nil {
+				return nil, err
+			}
+			if i == 1 {
+				deltaDeltas[j] = v
+			} else {
+				deltaDeltas[j] += v
+			}
+			deltas[j] += deltaDeltas[j]
+		}
+	}
+
+	h := &nativeHistogram{
+		count:     float64(count),
+		zeroCount: float64(zeroCount),
+		sum:       sum,
+		buckets:   make([]float64, len(deltas)),
+	}
+	positive := len(spanIndices(l.positive))
+	var cur int64
+	for j, d := range deltas {
+		if j == positive {
+			cur = 0
+		}
+		cur += d
+		h.buckets[j] = float64(cur)
+	}
+	return h, nil
+}
+
+// readFloatSamples reads n float histograms. The first sample stores all
+// counts verbatim, later ones store them XOR-encoded against the previous
+// sample.
+func (r *chunkReader) readFloatSamples(n int, l *nativeLayout) (*nativeHistogram, error) {
+	h := &nativeHistogram{buckets: make([]float64, l.buckets())}
+	values := make([]*float64, 0, 3+len(h.buckets))
+	values = append(values, &h.count, &h.zeroCount, &h.sum)
+	for j := range h.buckets {
+		values = append(values, &h.buckets[j])
+	}
+	states := make([]xorState, len(values))
+	for i := 0; i < n; i++ {
+		if _, err := r.readVarbitInt(); err != nil {
+			return nil, err
+		}
+		for j, v := range values {
+			var err error
+			if i == 0 {
+				*v, err = r.readFloat()
+			} else {
+				err = r.readXOR(v, &states[j])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return h, nil
+}
@@ -0,0 +1,358 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"math"
+	"math/bits"
+	"reflect"
+	"testing"
+)
+
+// chunkWriter encodes chunks the way the Prometheus TSDB does.
+type chunkWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *chunkWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v&(1<<i) != 0 {
+			w.data[len(w.data)-1] |= 0x80 >> (w.pos % 8)
+		}
+		w.pos++
+	}
+}
+
+func (w *chunkWriter) writeVarbitInt(v int64) {
+	fits := func(n int) bool { return -(int64(1)<<(n-1))+1 <= v && v <= int64(1)<<(n-1) }
+	prefixes := []uint64{0b10, 0b110, 0b1110, 0b11110, 0b111110, 0b1111110, 0b11111110}
+	if v == 0 {
+		w.writeBits(0, 1)
+		return
+	}
+	for i, n := range []int{3, 6, 9, 12, 18, 25, 56} {
+		if fits(n) {
+			w.writeBits(prefixes[i], i+2)
+			w.writeBits(uint64(v), n)
+			return
+		}
+	}
+	w.writeBits(0xff, 8)
+	w.writeBits(uint64(v), 64)
+}
+
+func (w *chunkWriter) writeVarbitUint(v uint64) {
+	prefixes := []uint64{0b10, 0b110, 0b1110, 0b11110, 0b111110, 0b1111110, 0b11111110}
+	if v == 0 {
+		w.writeBits(0, 1)
+		return
+	}
+	for i, n := range []int{3, 6, 9, 12, 18, 25, 56} {
+		if bits.LeadingZeros64(v) >= 64-n {
+			w.writeBits(prefixes[i], i+2)
+			w.writeBits(v, n)
+			return
+		}
+	}
+	w.writeBits(0xff, 8)
+	w.writeBits(v, 64)
+}
+
+func (w *chunkWriter) writeXOR(v, prev float64, s *xorState) {
+	delta := math.Float64bits(v) ^ math.Float64bits(prev)
+	if delta == 0 {
+		w.writeBits(0, 1)
+		return
+	}
+	w.writeBits(1, 1)
+	leading, trailing := bits.LeadingZeros64(delta), bits.TrailingZeros64(delta)
+	if leading >= 32 {
+		leading = 31
+	}
+	if s.leading != 0xff && leading >= s.leading && trailing >= s.trailing {
+		w.writeBits(0, 1)
+		w.writeBits(delta>>s.trailing, 64-s.leading-s.trailing)
+		return
+	}
+	s.leading, s.trailing = leading, trailing
+	sig := 64 - leading - trailing
+	w.writeBits(1, 1)
+	w.writeBits(uint64(leading), 5)
+	w.writeBits(uint64(sig), 6)
+	w.writeBits(delta>>trailing, sig)
+}
+
+func (w *chunkWriter) writeLayout(schema int64, zeroThreshold float64, positive, negative []nativeSpan) {
+	if zeroThreshold == 0 {
+		w.writeBits(0, 8)
+	} else if frac, exp := math.Frexp(zeroThreshold); frac == 0.5 && exp >= -242 && exp <= 11 {
+		w.writeBits(uint64(exp+243), 8)
+	} else {
+		w.writeBits(255, 8)
+		w.writeBits(math.Float64bits(zeroThreshold), 64)
+	}
+	w.writeVarbitInt(schema)
+	for _, spans := range [][]nativeSpan{positive, negative} {
+		w.writeVarbitUint(uint64(len(spans)))
+		for _, s := range spans {
+			w.writeVarbitUint(uint64(s.length))
+			w.writeVarbitInt(int64(s.offset))
+		}
+	}
+}
+
+type testIntHistogram struct {
+	t, count, zeroCount int64
+	sum                 float64
+	buckets             []int64 // Delta-encoded as in Prometheus.
+}
+
+func encodeIntChunk(schema int64, zeroThreshold float64, positive, negative []nativeSpan, hs []testIntHistogram) []byte {
+	w := &chunkWriter{}
+	w.writeBits(uint64(len(hs)), 16)
+	w.writeBits(0, 8)
+	w.writeLayout(schema, zeroThreshold, positive, negative)
+	sumState := xorState{leading: 0xff}
+	var prevDeltas []int64
+	var tDelta, cDelta, zDelta int64
+	for i, h := range hs {
+		if i == 0 {
+			w.writeVarbitInt(h.t)
+			w.writeVarbitUint(uint64(h.count))
+			w.writeVarbitUint(uint64(h.zeroCount))
+			w.writeBits(math.Float64bits(h.sum), 64)
+			for _, b := range h.buckets {
+				w.writeVarbitInt(b)
+			}
+			prevDeltas = make([]int64, len(h.buckets))
+			continue
+		}
+		prev := hs[i-1]
+		td, cd, zd := h.t-prev.t, h.count-prev.count, h.zeroCount-prev.zeroCount
+		if i == 1 {
+			w.writeVarbitInt(td)
+			w.writeVarbitInt(cd)
+			w.writeVarbitInt(zd)
+		} else {
+			w.writeVarbitInt(td - tDelta)
+			w.writeVarbitInt(cd - cDelta)
+			w.writeVarbitInt(zd - zDelta)
+		}
+		tDelta, cDelta, zDelta = td, cd, zd
+		w.writeXOR(h.sum, prev.sum, &sumState)
+		for j, b := range h.buckets {
+			d := b - prev.buckets[j]
+			if i == 1 {
+				w.writeVarbitInt(d)
+			} else {
+				w.writeVarbitInt(d - prevDeltas[j])
+			}
+			prevDeltas[j] = d
+		}
+	}
+	return w.data
+}
+
+func TestHistogramFromChunk(t *testing.T) {
+	positive := []nativeSpan{{offset: 0, length: 2}, {offset: 1, length: 1}}
+	negative := []nativeSpan{{offset: 1, length: 1}}
+	chunk := encodeIntChunk(0, 0.5, positive, negative, []testIntHistogram{
+		{t: 1000, count: 4, zeroCount: 1, sum: 3.5, buckets: []int64{1, 0, 1, 0}},
+		{t: 2000, count: 9, zeroCount: 2, sum: 10, buckets: []int64{2, 1, -2, 1}},
+		// Positive buckets 3, 4, 0 and negative bucket 5.
+		{t: 3000, count: 15, zeroCount: 3, sum: -7.25, buckets: []int64{3, 1, -4, 5}},
+	})
+
+	got, err := HistogramFromChunk(chunk, chunkEncodingHistogram)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &SampleHistogram{
+		Count: 15,
+		Sum:   -7.25,
+		Buckets: HistogramBuckets{
+			{Boundaries: 1, Lower: -2, Upper: -1, Count: 5},
+			{Boundaries: 3, Lower: -0.5, Upper: 0.5, Count: 3},
+			{Boundaries: 0, Lower: 0.5, Upper: 1, Count: 3},
+			{Boundaries: 0, Lower: 1, Upper: 2, Count: 4},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := HistogramFromChunk(chunk, 1); err == nil {
+		t.Error("expected error for XOR chunk encoding")
+	}
+	for n := 0; n < len(chunk)-1; n++ {
+		if _, err := HistogramFromChunk(chunk[:n], chunkEncodingHistogram); err == nil {
+			t.Errorf("expected error for chunk truncated to %d bytes", n)
+		}
+	}
+	if _, err := HistogramFromChunk([]byte{0, 0, 0}, chunkEncodingHistogram); err == nil {
+		t.Error("expected error for chunk without samples")
+	}
+	bad := encodeIntChunk(9, 0, nil, nil, []testIntHistogram{{t: 1, count: 0}})
+	if _, err := HistogramFromChunk(bad, chunkEncodingHistogram); err == nil {
+		t.Error("expected error for unsupported schema")
+	}
+}
+
+func TestHistogramFromFloatChunk(t *testing.T) {
+	type floatHistogram struct {
+		count, zeroCount, sum float64
+		buckets               []float64
+	}
+	hs := []floatHistogram{
+		{count: 2.5, sum: 1, buckets: []float64{0.5, 2}},
+		{count: 4, sum: 1.5, buckets: []float64{1, 3}},
+		{count: 6.75, sum: 1.5, buckets: []float64{1.75, 5}},
+	}
+
+	w := &chunkWriter{}
+	w.writeBits(uint64(len(hs)), 16)
+	w.writeBits(0, 8)
+	w.writeLayout(3, 0, []nativeSpan{{offset: 8, length: 2}}, nil)
+	states := make([]xorState, 5)
+	for i := range states {
+		states[i].leading = 0xff
+	}
+	for i, h := range hs {
+		values := append([]float64{h.count, h.zeroCount, h.sum}, h.buckets...)
+		w.writeVarbitInt(int64(i))
+		for j, v := range values {
+			if i == 0 {
+				w.writeBits(math.Float64bits(v), 64)
+				continue
+			}
+			prev := append([]float64{hs[i-1].count, hs[i-1].zeroCount, hs[i-1].sum}, hs[i-1].buckets...)
+			w.writeXOR(v, prev[j], &states[j])
+		}
+	}
+
+	got, err := HistogramFromChunk(w.data, chunkEncodingFloatHistogram)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &SampleHistogram{
+		Count: 6.75,
+		Sum:   1.5,
+		Buckets: HistogramBuckets{
+			{Lower: FloatString(math.Exp2(0.875)), Upper: 2, Count: 1.75},
+			{Lower: 2, Upper: FloatString(math.Exp2(1.125)), Count: 5},
+		},
+	}
+	if got.Count != expected.Count || got.Sum != expected.Sum || len(got.Buckets) != len(expected.Buckets) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i, b := range expected.Buckets {
+		g := got.Buckets[i]
+		if g.Boundaries != b.Boundaries || g.Count != b.Count ||
+			!almostEqual(float64(g.Lower), float64(b.Lower), 1e-12) || !almostEqual(float64(g.Upper), float64(b.Upper), 1e-12) {
+			t.Errorf("bucket %d: expected %v, got %v", i, b, g)
+		}
+	}
+}
+
+func TestNativeBucketBound(t *testing.T) {
+	tests := []struct {
+		idx, schema int32
+		expected    float64
+	}{
+		{idx: 0, schema: 0, expected: 1},
+		{idx: 1, schema: 0, expected: 2},
+		{idx: -1, schema: 0, expected: 0.5},
+		{idx: 1, schema: -2, expected: 16},
+		{idx: 1, schema: 1, expected: math.Sqrt2},
+		{idx: -3, schema: 2, expected: math.Exp2(-0.75)},
+	}
+	for _, test := range tests {
+		if got := nativeBucketBound(test.idx, test.schema); !almostEqual(got, test.expected, 1e-12) {
+			t.Errorf("bucket %d of schema %d: expected %v, got %v", test.idx, test.schema, test.expected, got)
+		}
+	}
+}
+
+// The fixtures below were written by the chunkenc package of Prometheus
+// v0.53.0, so that they do not share the assumptions of chunkWriter.
+
+// prometheusIntChunk holds three integer histograms of schema 0 with a zero
+// threshold of 0.5, appended at 1s, 2s and 3s. The last one has 3
+// observations in the zero bucket, 3, 4 and 1 in the positive buckets 0, 1
+// and 3 and 5 in the negative bucket 1.
+var prometheusIntChunk = []byte{
+	0x00, 0x03, 0x00, 0xf3, 0x4a, 0x48, 0xc6, 0x31, 0x8f, 0x8f, 0xa2, 0x91,
+	0x40, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x8a, 0xf1, 0xf1, 0xf4,
+	0x61, 0x63, 0xa8, 0x3b, 0x1b, 0xc6, 0x49, 0x30, 0x21, 0x00, 0x72, 0x9e,
+	0xf0,
+}
+
+// prometheusFloatChunk holds the float histograms of
+// TestHistogramFromFloatChunk, appended at 0ms, 1ms and 2ms.
+var prometheusFloatChunk = []byte{
+	0x00, 0x03, 0x00, 0x00, 0x9c, 0x65, 0x88, 0x10, 0x01, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0f,
+	0xfc, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0f, 0xf8, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x23,
+	0xac, 0x3a, 0xd8, 0x0f, 0x58, 0x3d, 0x80, 0xdb, 0x04, 0xb3, 0x60, 0x5e,
+	0xb0, 0xf8,
+}
+
+func TestHistogramFromPrometheusChunk(t *testing.T) {
+	got, err := HistogramFromChunk(prometheusIntChunk, chunkEncodingHistogram)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &SampleHistogram{
+		Count: 16,
+		Sum:   -7.25,
+		Buckets: HistogramBuckets{
+			{Boundaries: 1, Lower: -2, Upper: -1, Count: 5},
+			{Boundaries: 3, Lower: -0.5, Upper: 0.5, Count: 3},
+			{Boundaries: 0, Lower: 0.5, Upper: 1, Count: 3},
+			{Boundaries: 0, Lower: 1, Upper: 2, Count: 4},
+			{Boundaries: 0, Lower: 4, Upper: 8, Count: 1},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got, err = HistogramFromChunk(prometheusFloatChunk, chunkEncodingFloatHistogram)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = &SampleHistogram{
+		Count: 6.75,
+		Sum:   1.5,
+		Buckets: HistogramBuckets{
+			{Lower: FloatString(math.Exp2(0.875)), Upper: 2, Count: 1.75},
+			{Lower: 2, Upper: FloatString(math.Exp2(1.125)), Count: 5},
+		},
+	}
+	if got.Count != expected.Count || got.Sum != expected.Sum || len(got.Buckets) != len(expected.Buckets) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i, b := range expected.Buckets {
+		g := got.Buckets[i]
+		if g.Boundaries != b.Boundaries || g.Count != b.Count ||
+			!almostEqual(float64(g.Lower), float64(b.Lower), 1e-12) || !almostEqual(float64(g.Upper), float64(b.Upper), 1e-12) {
+			t.Errorf("bucket %d: expected %v, got %v", i, b, g)
+		}
+	}
+}
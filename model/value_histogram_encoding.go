@@ -0,0 +1,877 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// bucketLayout is a HistogramBucket without its count. It is encoded as a
+// JSON array of the boundary rule and the bounds.
+type bucketLayout struct {
+	Boundaries int32
+	Lower      FloatString
+	Upper      FloatString
+}
+
+func (l bucketLayout) MarshalJSON() ([]byte, error) {
+	return json.Marshal([...]interface{}{l.Boundaries, l.Lower, l.Upper})
+}
+
+func (l *bucketLayout) UnmarshalJSON(buf []byte) error {
+	tmp := []interface{}{&l.Boundaries, &l.Lower, &l.Upper}
+	wantLen := len(tmp)
+	if err := json.Unmarshal(buf, &tmp); err != nil {
+		return err
+	}
+	if gotLen := len(tmp); gotLen != wantLen {
+		return fmt.Errorf("wrong number of fields: %d != %d", gotLen, wantLen)
+	}
+	return nil
+}
+
+type schemaTableHistogram struct {
+	Count  FloatString   `json:"count"`
+	Sum    FloatString   `json:"sum"`
+	Schema int           `json:"schema"`
+	Counts []FloatString `json:"counts"`
+}
+
+type schemaTableSample struct {
+	Metric    Metric                `json:"metric"`
+	Timestamp Time                  `json:"timestamp"`
+	Value     *SampleValue          `json:"value,omitempty"`
+	Histogram *schemaTableHistogram `json:"histogram,omitempty"`
+}
+
+type schemaTableVector struct {
+	Schemas [][]bucketLayout    `json:"schemas"`
+	Samples []schemaTableSample `json:"samples"`
+}
+
+// MarshalVectorWithSchemaTable encodes the vector as a JSON object in which
+// every distinct bucket layout is listed once in a top-level "schemas" array.
+// Histograms only carry their bucket counts and the index of their layout.
+// Nil buckets are not encoded. Use UnmarshalVectorWithSchemaTable to decode
+// the result.
+func MarshalVectorWithSchemaTable(v Vector) ([]byte, error) {
+	var (
+		table   schemaTableVector
+		indices = map[string]int{}
+	)
+	for _, s := range v {
+		ts := schemaTableSample{Metric: s.Metric, Timestamp: s.Timestamp}
+		if s.Histogram == nil {
+			value := s.Value
+			ts.Value = &value
+			table.Samples = append(table.Samples, ts)
+			continue
+		}
+
+		var (
+			layout []bucketLayout
+			counts []FloatString
+		)
+		for _, b := range s.Histogram.Buckets {
+			if b == nil {
+				continue
+			}
+			layout = append(layout, bucketLayout{Boundaries: b.Boundaries, Lower: b.Lower, Upper: b.Upper})
+			counts = append(counts, b.Count)
+		}
+		key, err := json.Marshal(layout)
+		if err != nil {
+			return nil, err
+		}
+		index, ok := indices[string(key)]
+		if !ok {
+			index = len(table.Schemas)
+			indices[string(key)] = index
+			table.Schemas = append(table.Schemas, layout)
+		}
+		ts.Histogram = &schemaTableHistogram{
+			Count:  s.Histogram.Count,
+			Sum:    s.Histogram.Sum,
+			Schema: index,
+			Counts: counts,
+		}
+		table.Samples = append(table.Samples, ts)
+	}
+	return json.Marshal(table)
+}
+
+// UnmarshalVectorWithSchemaTable decodes a vector encoded by
+// MarshalVectorWithSchemaTable.
+func UnmarshalVectorWithSchemaTable(data []byte) (Vector, error) {
+	var table schemaTableVector
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, err
+	}
+
+	v := make(Vector, 0, len(table.Samples))
+	for i, ts := range table.Samples {
+		s := &Sample{Metric: ts.Metric, Timestamp: ts.Timestamp}
+		switch {
+		case ts.Histogram != nil:
+			th := ts.Histogram
+			if th.Schema < 0 || th.Schema >= len(table.Schemas) {
+				return nil, fmt.Errorf("sample %d: unknown schema %d", i, th.Schema)
+			}
+			layout := table.Schemas[th.Schema]
+			if len(layout) != len(th.Counts) {
+				return nil, fmt.Errorf("sample %d: got %d counts for schema with %d buckets", i, len(th.Counts), len(layout))
+			}
+			s.Histogram = &SampleHistogram{Count: th.Count, Sum: th.Sum}
+			for j, l := range layout {
+				s.Histogram.Buckets = append(s.Histogram.Buckets, &HistogramBucket{
+					Boundaries: l.Boundaries,
+					Lower:      l.Lower,
+					Upper:      l.Upper,
+					Count:      th.Counts[j],
+				})
+			}
+		case ts.Value != nil:
+			s.Value = *ts.Value
+		default:
+			return nil, fmt.Errorf("sample %d: neither value nor histogram set", i)
+		}
+		v = append(v, s)
+	}
+	return v, nil
+}
+
+// WriteHistogramNDJSON writes the pairs as newline-delimited JSON, one pair
+// per line in the same encoding as SampleHistogramPair.MarshalJSON. If w
+// can be flushed, it is flushed after every line so that followers see the
+// output incrementally. Writing stops at the first pair that cannot be
+// encoded.
+func WriteHistogramNDJSON(w io.Writer, pairs []SampleHistogramPair) error {
+	for _, p := range pairs {
+		b, err := p.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		switch f := w.(type) {
+		case interface{ Flush() error }:
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		case interface{ Flush() }:
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+// MessagePack type codes used by the histogram encoding.
+const (
+	msgpackFixArray  = 0x90
+	msgpackFloat32   = 0xca
+	msgpackFloat64   = 0xcb
+	msgpackUint8     = 0xcc
+	msgpackUint16    = 0xcd
+	msgpackUint32    = 0xce
+	msgpackUint64    = 0xcf
+	msgpackInt8      = 0xd0
+	msgpackInt16     = 0xd1
+	msgpackInt32     = 0xd2
+	msgpackInt64     = 0xd3
+	msgpackArray16   = 0xdc
+	msgpackArray32   = 0xdd
+	msgpackNegFixInt = 0xe0
+)
+
+// MarshalMsgpack encodes the histogram as a MessagePack array of the count,
+// the sum and an array of buckets, like [count, sum, [[boundaries, lower,
+// upper, count], ...]]. The boundary rule is encoded as the smallest
+// fitting integer, all other values as float64. Nil buckets are not
+// encoded. The method satisfies the Marshaler interface of
+// github.com/vmihailenco/msgpack.
+func (s *SampleHistogram) MarshalMsgpack() ([]byte, error) {
+	n := 0
+	for _, b := range s.Buckets {
+		if b != nil {
+			n++
+		}
+	}
+	buf := make([]byte, 0, 1+2*9+5+n*(1+5+3*9))
+	buf = append(buf, msgpackFixArray|3)
+	buf = appendMsgpackFloat(buf, s.Count)
+	buf = appendMsgpackFloat(buf, s.Sum)
+	buf = appendMsgpackArrayHeader(buf, n)
+	for _, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		buf = append(buf, msgpackFixArray|4)
+		buf = appendMsgpackInt(buf, b.Boundaries)
+		buf = appendMsgpackFloat(buf, b.Lower)
+		buf = appendMsgpackFloat(buf, b.Upper)
+		buf = appendMsgpackFloat(buf, b.Count)
+	}
+	return buf, nil
+}
+
+func appendMsgpackArrayHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, msgpackFixArray|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, msgpackArray16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, msgpackArray32), uint32(n))
+	}
+}
+
+func appendMsgpackInt(buf []byte, v int32) []byte {
+	switch {
+	case v >= 0 && v <= 127, v >= -32 && v < 0:
+		return append(buf, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return append(buf, msgpackInt8, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(buf, msgpackInt16), uint16(v))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, msgpackInt32), uint32(v))
+	}
+}
+
+func appendMsgpackFloat(buf []byte, v FloatString) []byte {
+	return binary.BigEndian.AppendUint64(append(buf, msgpackFloat64), math.Float64bits(float64(v)))
+}
+
+// msgpackReader decodes the subset of MessagePack used by the histogram
+// encoding, rejecting truncated input with an error.
+type msgpackReader struct {
+	data []byte
+}
+
+func (r *msgpackReader) next(n int, field string) ([]byte, error) {
+	if len(r.data) < n {
+		return nil, fmt.Errorf("msgpack: truncated input reading %s", field)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+// readArrayHeader reads the header of an array and returns its length.
+func (r *msgpackReader) readArrayHeader(field string) (int, error) {
+	code, err := r.next(1, field)
+	if err != nil {
+		return 0, err
+	}
+	switch c := code[0]; {
+	case c&0xf0 == msgpackFixArray:
+		return int(c & 0x0f), nil
+	case c == msgpackArray16:
+		b, err := r.next(2, field)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint16(b)), nil
+	case c == msgpackArray32:
+		b, err := r.next(4, field)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint32(b)), nil
+	default:
+		return 0, fmt.Errorf("msgpack: unexpected type code 0x%x for %s", c, field)
+	}
+}
+
+// readInt reads an integer of any size. Unsigned 64-bit integers beyond
+// the range of int64 are rejected.
+func (r *msgpackReader) readInt(field string) (int64, error) {
+	code, err := r.next(1, field)
+	if err != nil {
+		return 0, err
+	}
+	c := code[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= msgpackNegFixInt:
+		return int64(int8(c)), nil
+	}
+	var size int
+	switch c {
+	case msgpackUint8, msgpackInt8:
+		size = 1
+	case msgpackUint16, msgpackInt16:
+		size = 2
+	case msgpackUint32, msgpackInt32:
+		size = 4
+	case msgpackUint64, msgpackInt64:
+		size = 8
+	default:
+		return 0, fmt.Errorf("msgpack: unexpected type code 0x%x for %s", c, field)
+	}
+	b, err := r.next(size, field)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, x := range b {
+		u = u<<8 | uint64(x)
+	}
+	if c >= msgpackInt8 {
+		// Sign-extend the big-endian two's complement value.
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	}
+	if u > math.MaxInt64 {
+		return 0, fmt.Errorf("msgpack: %s %d out of range", field, u)
+	}
+	return int64(u), nil
+}
+
+// readInt32 reads an integer that fits into an int32.
+func (r *msgpackReader) readInt32(field string) (int32, error) {
+	v, err := r.readInt(field)
+	if err != nil {
+		return 0, err
+	}
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return 0, fmt.Errorf("msgpack: %s %d out of range", field, v)
+	}
+	return int32(v), nil
+}
+
+// readFloat reads a float32 or float64. Integers are accepted as well, as
+// some encoders use them for integral floats.
+func (r *msgpackReader) readFloat(field string) (FloatString, error) {
+	if len(r.data) == 0 {
+		return 0, fmt.Errorf("msgpack: truncated input reading %s", field)
+	}
+	switch r.data[0] {
+	case msgpackFloat32:
+		b, err := r.next(5, field)
+		if err != nil {
+			return 0, err
+		}
+		return FloatString(math.Float32frombits(binary.BigEndian.Uint32(b[1:]))), nil
+	case msgpackFloat64:
+		b, err := r.next(9, field)
+		if err != nil {
+			return 0, err
+		}
+		return FloatString(math.Float64frombits(binary.BigEndian.Uint64(b[1:]))), nil
+	}
+	v, err := r.readInt(field)
+	return FloatString(v), err
+}
+
+// UnmarshalMsgpack decodes a histogram encoded as by MarshalMsgpack. Any
+// MessagePack encoder producing the same structure can be used. The method
+// satisfies the Unmarshaler interface of github.com/vmihailenco/msgpack.
+func (s *SampleHistogram) UnmarshalMsgpack(data []byte) error {
+	r := &msgpackReader{data: data}
+	n, err := r.readArrayHeader("histogram")
+	if err != nil {
+		return err
+	}
+	if n != 3 {
+		return fmt.Errorf("msgpack: expected array of 3 elements, got %d", n)
+	}
+	count, err := r.readFloat("count")
+	if err != nil {
+		return err
+	}
+	sum, err := r.readFloat("sum")
+	if err != nil {
+		return err
+	}
+	n, err = r.readArrayHeader("buckets")
+	if err != nil {
+		return err
+	}
+	// Every bucket occupies at least 5 bytes, which bounds the allocation
+	// for corrupt lengths.
+	if n > len(r.data)/5 {
+		return fmt.Errorf("msgpack: truncated input reading buckets")
+	}
+	backing := make([]HistogramBucket, n)
+	buckets := make(HistogramBuckets, n)
+	for i := range backing {
+		field := fmt.Sprintf("bucket %d", i)
+		m, err := r.readArrayHeader(field)
+		if err != nil {
+			return err
+		}
+		if m != 4 {
+			return fmt.Errorf("msgpack: expected array of 4 elements for %s, got %d", field, m)
+		}
+		b := &backing[i]
+		if b.Boundaries, err = r.readInt32(field); err != nil {
+			return err
+		}
+		if b.Lower, err = r.readFloat(field); err != nil {
+			return err
+		}
+		if b.Upper, err = r.readFloat(field); err != nil {
+			return err
+		}
+		if b.Count, err = r.readFloat(field); err != nil {
+			return err
+		}
+		buckets[i] = b
+	}
+	if len(r.data) > 0 {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(r.data))
+	}
+	s.Count, s.Sum, s.Buckets = count, sum, buckets
+	return nil
+}
+
+// formatSeconds renders a number of seconds as a duration string like "1.5s"
+// or "250ms". Infinite values are rendered as "+Inf" and "-Inf", values
+// beyond the range of time.Duration as plain numbers of seconds.
+func formatSeconds(v FloatString) string {
+	ns := float64(v) * float64(time.Second)
+	if math.IsInf(ns, 0) || math.IsNaN(ns) {
+		return v.String()
+	}
+	if math.Abs(ns) >= math.MaxInt64 {
+		return v.String() + "s"
+	}
+	return time.Duration(math.Round(ns)).String()
+}
+
+// MarshalDurationJSON encodes the histogram like MarshalJSON, but with the
+// bucket bounds and the sum, interpreted as seconds, rendered as
+// human-readable duration strings such as "1.5s" or "250ms". The result is
+// meant for debugging and cannot be decoded by UnmarshalJSON.
+func (s *SampleHistogram) MarshalDurationJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	c, err := json.Marshal(s.Count)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(`{"count":`)
+	buf.Write(c)
+	fmt.Fprintf(&buf, `,"sum":%q,"buckets":[`, formatSeconds(s.Sum))
+	for i, b := range s.Buckets {
+		if b == nil {
+			return nil, fmt.Errorf("bucket %d is nil", i)
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		count, err := json.Marshal(b.Count)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "[%d,%q,%q,%s]", b.Boundaries, formatSeconds(b.Lower), formatSeconds(b.Upper), count)
+	}
+	buf.WriteString("]}")
+	return buf.Bytes(), nil
+}
+
+// LazyHistogramView is a partially decoded JSON histogram. Count and Sum are
+// decoded upfront, while buckets are only decoded when accessed, which saves
+// consumers of the totals from decoding hundreds of buckets.
+type LazyHistogramView struct {
+	Count FloatString
+	Sum   FloatString
+
+	buckets json.RawMessage
+	// elems holds the encoded bucket elements once they are indexed.
+	elems [][]byte
+}
+
+// LazyHistogram decodes the totals of the JSON histogram in data and returns
+// a view decoding its buckets on demand. The options controlling
+// SampleHistogram's UnmarshalJSON do not apply.
+func LazyHistogram(data []byte) (*LazyHistogramView, error) {
+	var v struct {
+		Count   FloatString     `json:"count"`
+		Sum     FloatString     `json:"sum"`
+		Buckets json.RawMessage `json:"buckets"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return &LazyHistogramView{Count: v.Count, Sum: v.Sum, buckets: v.Buckets}, nil
+}
+
+// index splits the encoded buckets into their elements unless done before.
+func (v *LazyHistogramView) index() error {
+	if v.elems != nil {
+		return nil
+	}
+	raw := bytes.TrimSpace(v.buckets)
+	elems := [][]byte{}
+	if len(raw) == 0 || string(raw) == "null" {
+		v.elems = elems
+		return nil
+	}
+	err := scanJSONArray(raw, func(elem []byte) error {
+		elems = append(elems, elem)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid buckets: %w", err)
+	}
+	v.elems = elems
+	return nil
+}
+
+// Len returns the number of buckets.
+func (v *LazyHistogramView) Len() (int, error) {
+	if err := v.index(); err != nil {
+		return 0, err
+	}
+	return len(v.elems), nil
+}
+
+// Bucket decodes and returns the bucket at index i. Buckets encoded as null
+// yield nil.
+func (v *LazyHistogramView) Bucket(i int) (*HistogramBucket, error) {
+	if err := v.index(); err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(v.elems) {
+		return nil, fmt.Errorf("bucket index %d out of range [0,%d)", i, len(v.elems))
+	}
+	elem := v.elems[i]
+	if string(elem) == "null" {
+		return nil, nil
+	}
+	b := &HistogramBucket{}
+	if !parseBucket(elem, b) {
+		if err := b.UnmarshalJSON(elem); err != nil {
+			return nil, fmt.Errorf("invalid bucket %d: %w", i, err)
+		}
+	}
+	return b, nil
+}
+
+// SplitSchemaAndData splits the histogram into its bucket layout, returned
+// as buckets with zero counts, and the parallel bucket counts, so that the
+// layout of a series can be stored once and the counts per sample. Nil
+// buckets are skipped. Count and Sum are not part of either and need to be
+// stored separately if required.
+func (s *SampleHistogram) SplitSchemaAndData() (schema []HistogramBucket, counts []FloatString) {
+	schema = make([]HistogramBucket, 0, len(s.Buckets))
+	counts = make([]FloatString, 0, len(s.Buckets))
+	for _, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		schema = append(schema, HistogramBucket{Boundaries: b.Boundaries, Lower: b.Lower, Upper: b.Upper})
+		counts = append(counts, b.Count)
+	}
+	return schema, counts
+}
+
+// RejoinSchemaAndData reverses SplitSchemaAndData. The counts of the schema
+// buckets are ignored. As Count is not part of the split data, it is
+// recomputed from the bucket counts, while Sum is left zero.
+func RejoinSchemaAndData(schema []HistogramBucket, counts []FloatString) (*SampleHistogram, error) {
+	if len(schema) != len(counts) {
+		return nil, fmt.Errorf("schema has %d buckets but got %d counts", len(schema), len(counts))
+	}
+	res := &SampleHistogram{Buckets: make(HistogramBuckets, len(schema))}
+	backing := make([]HistogramBucket, len(schema))
+	for i, b := range schema {
+		backing[i] = HistogramBucket{Boundaries: b.Boundaries, Lower: b.Lower, Upper: b.Upper, Count: counts[i]}
+		res.Buckets[i] = &backing[i]
+		res.Count += counts[i]
+	}
+	return res, nil
+}
+
+// histogramCSVHeader names the columns written by WriteHistogramCSV.
+var histogramCSVHeader = []string{"timestamp", "count", "sum", "boundaries", "lower", "upper", "bucket_count"}
+
+// WriteHistogramCSV writes the pairs as CSV with a header line and one row
+// per bucket. Every row repeats the timestamp, count and sum of its
+// histogram. A histogram without buckets is written as a single row with
+// empty bucket columns. Nil buckets are not written.
+func WriteHistogramCSV(w io.Writer, pairs []SampleHistogramPair) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(histogramCSVHeader); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		h := p.Histogram
+		if h == nil {
+			return fmt.Errorf("histogram is nil")
+		}
+		prefix := []string{p.Timestamp.String(), h.Count.String(), h.Sum.String()}
+		written := false
+		for _, b := range h.Buckets {
+			if b == nil {
+				continue
+			}
+			row := append(prefix[:3:3], strconv.Itoa(int(b.Boundaries)), b.Lower.String(), b.Upper.String(), b.Count.String())
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+			written = true
+		}
+		if !written {
+			if err := cw.Write(append(prefix, "", "", "", "")); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadHistogramCSV parses pairs written by WriteHistogramCSV. Consecutive
+// rows with the same timestamp form one histogram, and they have to agree
+// on its count and sum.
+func ReadHistogramCSV(r io.Reader) ([]SampleHistogramPair, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(histogramCSVHeader)
+	cr.ReuseRecord = true
+
+	var pairs []SampleHistogramPair
+	for first := true; ; first = false {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if first {
+			for i, name := range histogramCSVHeader {
+				if row[i] != name {
+					return nil, fmt.Errorf("line %d: expected column %q, got %q", line, name, row[i])
+				}
+			}
+			continue
+		}
+
+		var ts Time
+		if err := ts.UnmarshalJSON([]byte(row[0])); err != nil {
+			return nil, fmt.Errorf("line %d: invalid timestamp %q", line, row[0])
+		}
+		parse := func(col int) (FloatString, error) {
+			v, err := strconv.ParseFloat(row[col], 64)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: invalid %s %q", line, histogramCSVHeader[col], row[col])
+			}
+			return FloatString(v), nil
+		}
+		count, err := parse(1)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := parse(2)
+		if err != nil {
+			return nil, err
+		}
+
+		if n := len(pairs); n == 0 || pairs[n-1].Timestamp != ts {
+			pairs = append(pairs, SampleHistogramPair{
+				Timestamp: ts,
+				Histogram: &SampleHistogram{Count: count, Sum: sum},
+			})
+		} else if h := pairs[n-1].Histogram; h.Count != count || math.Float64bits(float64(h.Sum)) != math.Float64bits(float64(sum)) {
+			return nil, fmt.Errorf("line %d: count and sum differ from previous rows of timestamp %v", line, ts)
+		}
+		h := pairs[len(pairs)-1].Histogram
+
+		if row[3] == "" && row[4] == "" && row[5] == "" && row[6] == "" {
+			continue
+		}
+		boundaries, err := strconv.ParseInt(row[3], 10, 32)
+		if err != nil || boundaries < 0 || boundaries > 3 {
+			return nil, fmt.Errorf("line %d: unknown boundaries %q", line, row[3])
+		}
+		b := &HistogramBucket{Boundaries: int32(boundaries)}
+		if b.Lower, err = parse(4); err != nil {
+			return nil, err
+		}
+		if b.Upper, err = parse(5); err != nil {
+			return nil, err
+		}
+		if b.Count, err = parse(6); err != nil {
+			return nil, err
+		}
+		h.Buckets = append(h.Buckets, b)
+	}
+	return pairs, nil
+}
+
+// heatmapFrame is a Grafana data frame in its JSON encoding.
+type heatmapFrame struct {
+	Schema struct {
+		Meta struct {
+			Type        string `json:"type"`
+			TypeVersion [2]int `json:"typeVersion"`
+		} `json:"meta"`
+		Fields []heatmapField `json:"fields"`
+	} `json:"schema"`
+	Data struct {
+		Values   []interface{}      `json:"values"`
+		Entities []*heatmapEntities `json:"entities,omitempty"`
+	} `json:"data"`
+}
+
+// heatmapField describes a field of a Grafana data frame. TypeInfo holds the
+// Go type of the values, which Grafana's own decoder requires.
+type heatmapField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	TypeInfo struct {
+		Frame    string `json:"frame"`
+		Nullable bool   `json:"nullable,omitempty"`
+	} `json:"typeInfo"`
+}
+
+func newHeatmapField(name, typ, frame string, nullable bool) heatmapField {
+	f := heatmapField{Name: name, Type: typ}
+	f.TypeInfo.Frame, f.TypeInfo.Nullable = frame, nullable
+	return f
+}
+
+// heatmapEntities lists the indices of the values of a field that JSON
+// cannot represent. They are encoded as null in the values.
+type heatmapEntities struct {
+	Inf    []int `json:"Inf,omitempty"`
+	NegInf []int `json:"NegInf,omitempty"`
+	NaN    []int `json:"NaN,omitempty"`
+}
+
+// ToHeatmapFrame encodes the histogram as a Grafana data frame in the
+// "heatmap-cells" format understood by the heatmap panel. The frame holds
+// one row per bucket with the timestamp as end of the cell in milliseconds,
+// the bucket bounds as yMin and yMax and the bucket count. Buckets are
+// sorted by their bounds and nil buckets are left out. The frame is encoded
+// the way grafana-plugin-sdk-go encodes frames, including the type info of
+// the fields and entities for infinite values.
+func (s *SampleHistogram) ToHeatmapFrame(timestamp Time) ([]byte, error) {
+	if s == nil {
+		return nil, fmt.Errorf("histogram is nil")
+	}
+	buckets := s.sortedBuckets()
+	var (
+		frame    heatmapFrame
+		times    = make([]int64, len(buckets))
+		columns  = [3][]*float64{make([]*float64, len(buckets)), make([]*float64, len(buckets)), make([]*float64, len(buckets))}
+		entities [3]heatmapEntities
+	)
+	for i, b := range buckets {
+		times[i] = int64(timestamp)
+		for c, v := range []FloatString{b.Lower, b.Upper, b.Count} {
+			f := float64(v)
+			switch {
+			case math.IsInf(f, 1):
+				entities[c].Inf = append(entities[c].Inf, i)
+			case math.IsInf(f, -1):
+				entities[c].NegInf = append(entities[c].NegInf, i)
+			case math.IsNaN(f):
+				entities[c].NaN = append(entities[c].NaN, i)
+			default:
+				columns[c][i] = &f
+			}
+		}
+	}
+
+	frame.Schema.Meta.Type = "heatmap-cells"
+	frame.Schema.Fields = []heatmapField{
+		newHeatmapField("xMax", "time", "time.Time", false),
+		newHeatmapField("yMin", "number", "float64", true),
+		newHeatmapField("yMax", "number", "float64", true),
+		newHeatmapField("count", "number", "float64", true),
+	}
+	frame.Data.Values = []interface{}{times, columns[0], columns[1], columns[2]}
+	for c, e := range entities {
+		if e.Inf == nil && e.NegInf == nil && e.NaN == nil {
+			continue
+		}
+		if frame.Data.Entities == nil {
+			frame.Data.Entities = make([]*heatmapEntities, len(frame.Schema.Fields))
+		}
+		frame.Data.Entities[c+1] = &entities[c]
+	}
+	return json.Marshal(frame)
+}
+
+// Centroid is a cluster of observations in a t-digest, summarized by their
+// mean and their number.
+type Centroid struct {
+	Mean   FloatString
+	Weight FloatString
+}
+
+// ToTDigest converts the histogram into the centroids of a merging t-digest
+// with the given compression, for use with systems storing t-digests. Every
+// populated bucket becomes a centroid at its midpoint weighted by its count.
+// Neighbouring centroids are then merged as long as they span at most one
+// unit of the scale function k(q) = compression / (2π) · asin(2q - 1), so
+// that the centroids stay small at the tails and the result holds no more
+// than about compression centroids. The centroids are sorted by their mean.
+func (s *SampleHistogram) ToTDigest(compression float64) ([]Centroid, error) {
+	if !(compression > 0) {
+		return nil, fmt.Errorf("compression %v must be positive", compression)
+	}
+	var (
+		points []Centroid
+		total  float64
+	)
+	for _, b := range s.Buckets {
+		if b != nil && b.Count > 0 {
+			points = append(points, Centroid{Mean: FloatString(b.midpoint()), Weight: b.Count})
+			total += float64(b.Count)
+		}
+	}
+	if len(points) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Mean < points[j].Mean })
+
+	k := func(q float64) float64 {
+		return compression / (2 * math.Pi) * math.Asin(math.Max(-1, math.Min(1, 2*q-1)))
+	}
+	var (
+		res    []Centroid
+		before float64 // Weight of the centroids in res.
+		cur    = points[0]
+		kLeft  = k(0)
+	)
+	for _, p := range points[1:] {
+		w := float64(cur.Weight) + float64(p.Weight)
+		if k((before+w)/total)-kLeft <= 1 {
+			cur.Mean += (p.Mean - cur.Mean) * p.Weight / FloatString(w)
+			cur.Weight = FloatString(w)
+			continue
+		}
+		res = append(res, cur)
+		before += float64(cur.Weight)
+		kLeft = k(before / total)
+		cur = p
+	}
+	return append(res, cur), nil
+}
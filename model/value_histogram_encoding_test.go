@@ -0,0 +1,737 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVectorWithSchemaTable(t *testing.T) {
+	other := genLinearHistogram([]float64{0, 1, 2}, 3, 4)
+	other.Sum = 5
+	v := Vector{
+		{Metric: Metric{"job": "a"}, Timestamp: 1234567, Histogram: genSampleHistogram()},
+		{Metric: Metric{"job": "b"}, Timestamp: 1234567, Histogram: other},
+		{Metric: Metric{"job": "c"}, Timestamp: 1234567, Histogram: genSampleHistogram()},
+		{Metric: Metric{"job": "d"}, Timestamp: 1234567, Value: 42},
+	}
+
+	b, err := MarshalVectorWithSchemaTable(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"schemas":[` +
+		`[[1,"-4870.992343051145","-4466.7196729968955"],[1,"-861.0779292198035","-789.6119426088657"],[1,"-558.3399591246119","-512"],` +
+		`[0,"2048","2233.3598364984477"],[0,"2896.3093757400984","3158.4477704354626"],[0,"4466.7196729968955","4870.992343051145"]],` +
+		`[[0,"0","1"],[0,"1","2"]]` +
+		`],"samples":[` +
+		`{"metric":{"job":"a"},"timestamp":1234.567,"histogram":{"count":"6","sum":"3897","schema":0,"counts":["1","1","1","1","1","1"]}},` +
+		`{"metric":{"job":"b"},"timestamp":1234.567,"histogram":{"count":"7","sum":"5","schema":1,"counts":["3","4"]}},` +
+		`{"metric":{"job":"c"},"timestamp":1234.567,"histogram":{"count":"6","sum":"3897","schema":0,"counts":["1","1","1","1","1","1"]}},` +
+		`{"metric":{"job":"d"},"timestamp":1234.567,"value":"42"}` +
+		`]}`
+	if string(b) != expected {
+		t.Errorf("encoding error: expected %q, got %q", expected, b)
+	}
+
+	got, err := UnmarshalVectorWithSchemaTable(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(v) {
+		t.Errorf("decoding error: expected %v, got %v", v, got)
+	}
+}
+
+func TestInvalidVectorWithSchemaTable(t *testing.T) {
+	for _, plain := range []string{
+		`{"schemas":[],"samples":[{"metric":{},"timestamp":1,"histogram":{"count":"1","sum":"1","schema":0,"counts":["1"]}}]}`,
+		`{"schemas":[[[0,"0","1"]]],"samples":[{"metric":{},"timestamp":1,"histogram":{"count":"1","sum":"1","schema":0,"counts":["1","2"]}}]}`,
+		`{"schemas":[],"samples":[{"metric":{},"timestamp":1}]}`,
+		`{"schemas":[[[0,"0"]]],"samples":[]}`,
+	} {
+		if _, err := UnmarshalVectorWithSchemaTable([]byte(plain)); err == nil {
+			t.Errorf("expected error when decoding %s", plain)
+		}
+	}
+}
+
+// lineRecorder records the data it has received whenever it is flushed.
+type lineRecorder struct {
+	bytes.Buffer
+	flushed []string
+}
+
+func (r *lineRecorder) Flush() error {
+	r.flushed = append(r.flushed, r.String())
+	return nil
+}
+
+func TestWriteHistogramNDJSON(t *testing.T) {
+	pairs := []SampleHistogramPair{
+		{Timestamp: 1000, Histogram: genLinearHistogram([]float64{0, 1}, 1)},
+		{Timestamp: 2000, Histogram: genLinearHistogram([]float64{0, 1}, 2)},
+	}
+	var r lineRecorder
+	if err := WriteHistogramNDJSON(&r, pairs); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`[1,{"count":"1","sum":"0","buckets":[[0,"0","1","1"]]}]` + "\n",
+		`[1,{"count":"1","sum":"0","buckets":[[0,"0","1","1"]]}]` + "\n" +
+			`[2,{"count":"2","sum":"0","buckets":[[0,"0","1","2"]]}]` + "\n",
+	}
+	if !reflect.DeepEqual(r.flushed, expected) {
+		t.Errorf("expected flushed output %q, got %q", expected, r.flushed)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(r.String(), "\n"), "\n")
+	for i, line := range lines {
+		var p SampleHistogramPair
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			t.Fatalf("line %d: %s", i, err)
+		}
+		if !p.Equal(&pairs[i]) {
+			t.Errorf("line %d: expected %v, got %v", i, pairs[i], p)
+		}
+	}
+
+	var buf bytes.Buffer
+	pairs = append([]SampleHistogramPair{{Timestamp: 0}}, pairs...)
+	if err := WriteHistogramNDJSON(&buf, pairs); err == nil || err.Error() != "histogram is nil" {
+		t.Errorf("expected error for nil histogram, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output, got %q", buf.String())
+	}
+}
+
+func TestSampleHistogramMsgpack(t *testing.T) {
+	for _, h := range []*SampleHistogram{
+		genSampleHistogram(),
+		{Count: 1, Sum: FloatString(math.Inf(1)), Buckets: HistogramBuckets{{Boundaries: 3, Lower: 0, Upper: FloatString(math.Inf(1)), Count: 1}}},
+		{Buckets: HistogramBuckets{}},
+	} {
+		b, err := h.MarshalMsgpack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded SampleHistogram
+		if err := decoded.UnmarshalMsgpack(b); err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.Equal(h) {
+			t.Errorf("expected %v, got %v", h, decoded)
+		}
+	}
+
+	// The packed encoding is smaller than JSON.
+	h := genSampleHistogram()
+	b, err := h.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The array headers, count and sum take 20 bytes, each bucket 29 bytes.
+	if len(b) != 20+6*29 {
+		t.Errorf("unexpected size %d of msgpack encoding", len(b))
+	}
+	if len(b) >= len(j) {
+		t.Errorf("msgpack encoding of %d bytes is not smaller than JSON encoding of %d bytes", len(b), len(j))
+	}
+}
+
+func TestSampleHistogramMsgpackLarge(t *testing.T) {
+	h := &SampleHistogram{}
+	for i := 0; i < 3000; i++ {
+		h.Buckets = append(h.Buckets, &HistogramBucket{Lower: FloatString(i), Upper: FloatString(i + 1), Count: FloatString(i)})
+	}
+	b, err := h.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[19] != msgpackArray16 {
+		t.Errorf("expected array16 header, got 0x%x", b[19])
+	}
+	var decoded SampleHistogram
+	if err := decoded.UnmarshalMsgpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(h) {
+		t.Error("large histogram does not round-trip")
+	}
+}
+
+func TestSampleHistogramMsgpackInterop(t *testing.T) {
+	h := &SampleHistogram{
+		Count: 3,
+		Sum:   4.5,
+		Buckets: HistogramBuckets{
+			{Boundaries: 3, Lower: 0, Upper: 1, Count: 1},
+			{Boundaries: 0, Lower: 1, Upper: FloatString(math.Inf(1)), Count: 2},
+		},
+	}
+	// Produced by github.com/vmihailenco/msgpack/v5 from the generic value
+	// []interface{}{3.0, 4.5, []interface{}{[]interface{}{3, 0.0, 1.0, 1.0},
+	// []interface{}{0, 1.0, math.Inf(1), 2.0}}}.
+	fixture, err := hex.DecodeString("93cb4008000000000000cb4012000000000000" +
+		"929403cb0000000000000000cb3ff0000000000000cb3ff0000000000000" +
+		"9400cb3ff0000000000000cb7ff0000000000000cb4000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := h.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, fixture) {
+		t.Errorf("expected %x, got %x", fixture, b)
+	}
+	var decoded SampleHistogram
+	if err := decoded.UnmarshalMsgpack(fixture); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(h) {
+		t.Errorf("expected %v, got %v", h, decoded)
+	}
+
+	// Other encoders may use integers and float32 for the values. Produced
+	// by the same library from []interface{}{uint64(3), float32(4.5),
+	// []interface{}{[]interface{}{int8(3), 0, float32(1), int64(1)},
+	// []interface{}{-1, 1, math.Inf(1), uint16(300)}}}.
+	fixture, err = hex.DecodeString("93cf0000000000000003ca40900000" +
+		"9294d00300ca3f800000d30000000000000001" +
+		"94ff01cb7ff0000000000000cd012c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.UnmarshalMsgpack(fixture); err != nil {
+		t.Fatal(err)
+	}
+	expected := &SampleHistogram{
+		Count: 3,
+		Sum:   4.5,
+		Buckets: HistogramBuckets{
+			{Boundaries: 3, Lower: 0, Upper: 1, Count: 1},
+			{Boundaries: -1, Lower: 1, Upper: FloatString(math.Inf(1)), Count: 300},
+		},
+	}
+	if !decoded.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, decoded)
+	}
+}
+
+func TestInvalidSampleHistogramMsgpack(t *testing.T) {
+	b, err := genSampleHistogram().MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every truncation of a valid encoding must be rejected.
+	for i := 0; i < len(b); i++ {
+		var h SampleHistogram
+		if err := h.UnmarshalMsgpack(b[:i]); err == nil {
+			t.Errorf("expected error when decoding %d of %d bytes", i, len(b))
+		}
+	}
+
+	var h SampleHistogram
+	if err := h.UnmarshalMsgpack(append(b, 0)); err == nil {
+		t.Error("expected error for trailing bytes")
+	}
+	for _, data := range []string{
+		// Array of 2 elements.
+		"92cb0000000000000000cb0000000000000000",
+		// Bucket array of 3 elements.
+		"93cb0000000000000000cb00000000000000009193000000",
+		// Boundaries beyond int32.
+		"93cb0000000000000000cb00000000000000009194ce800000000000",
+		// String instead of a float.
+		"93a13000cb000000000000000090",
+	} {
+		b, err := hex.DecodeString(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.UnmarshalMsgpack(b); err == nil {
+			t.Errorf("expected error when decoding %s", data)
+		}
+	}
+}
+
+func TestSampleHistogramMarshalDurationJSON(t *testing.T) {
+	h := &SampleHistogram{
+		Count: 6,
+		Sum:   3.75,
+		Buckets: HistogramBuckets{
+			{Boundaries: 3, Lower: 0, Upper: 0.0005, Count: 1},
+			{Boundaries: 0, Lower: 0.0005, Upper: 0.25, Count: 2},
+			{Boundaries: 0, Lower: 0.25, Upper: 1.5, Count: 2},
+			{Boundaries: 0, Lower: 1.5, Upper: 90, Count: 1},
+			{Boundaries: 0, Lower: 90, Upper: FloatString(math.Inf(1)), Count: 0},
+		},
+	}
+	b, err := h.MarshalDurationJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"count":"6","sum":"3.75s","buckets":[` +
+		`[3,"0s","500µs","1"],` +
+		`[0,"500µs","250ms","2"],` +
+		`[0,"250ms","1.5s","2"],` +
+		`[0,"1.5s","1m30s","1"],` +
+		`[0,"1m30s","+Inf","0"]]}`
+	if string(b) != expected {
+		t.Errorf("expected %s, got %s", expected, b)
+	}
+
+	if _, err := (&SampleHistogram{Buckets: HistogramBuckets{nil}}).MarshalDurationJSON(); err == nil {
+		t.Error("expected error for nil bucket")
+	}
+}
+
+func TestLazyHistogram(t *testing.T) {
+	data := []byte(`{"count":"6","sum":"3.5","buckets":[[0,"0","1","2"], null ,[3,"1","2","4"],[0,"2"]]}`)
+	v, err := LazyHistogram(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Count != 6 || v.Sum != 3.5 {
+		t.Errorf("expected count 6 and sum 3.5, got %v and %v", v.Count, v.Sum)
+	}
+	if n, err := v.Len(); err != nil || n != 4 {
+		t.Errorf("expected 4 buckets, got %d (%v)", n, err)
+	}
+
+	expected := []*HistogramBucket{
+		{Boundaries: 0, Lower: 0, Upper: 1, Count: 2},
+		nil,
+		{Boundaries: 3, Lower: 1, Upper: 2, Count: 4},
+	}
+	for i, e := range expected {
+		b, err := v.Bucket(i)
+		if err != nil {
+			t.Fatalf("bucket %d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(b, e) {
+			t.Errorf("bucket %d: expected %v, got %v", i, e, b)
+		}
+	}
+	if _, err := v.Bucket(3); err == nil {
+		t.Error("expected error for invalid bucket")
+	}
+	for _, i := range []int{-1, 4} {
+		if _, err := v.Bucket(i); err == nil {
+			t.Errorf("expected error for bucket index %d", i)
+		}
+	}
+
+	v, err = LazyHistogram([]byte(`{"count":"0","sum":"0","buckets":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := v.Len(); err != nil || n != 0 {
+		t.Errorf("expected no buckets, got %d (%v)", n, err)
+	}
+	if _, err := LazyHistogram([]byte(`{"count":`)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestLazyHistogramMatchesUnmarshalJSON(t *testing.T) {
+	data := genLargeSampleHistogramJSON(64)
+	var h SampleHistogram
+	if err := json.Unmarshal(data, &h); err != nil {
+		t.Fatal(err)
+	}
+	v, err := LazyHistogram(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Count != h.Count || v.Sum != h.Sum {
+		t.Errorf("expected totals %v and %v, got %v and %v", h.Count, h.Sum, v.Count, v.Sum)
+	}
+	for i, e := range h.Buckets {
+		b, err := v.Bucket(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.Equal(e) {
+			t.Errorf("bucket %d: expected %v, got %v", i, e, b)
+		}
+	}
+}
+
+// BenchmarkLazyHistogramCount only accesses the total count of a large
+// histogram, to be compared with BenchmarkSampleHistogramUnmarshalJSON.
+func BenchmarkLazyHistogramCount(b *testing.B) {
+	data := genLargeSampleHistogramJSON(256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v, err := LazyHistogram(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if v.Count == 0 {
+			b.Fatal("unexpected count")
+		}
+	}
+}
+
+func TestSplitSchemaAndData(t *testing.T) {
+	h := genSampleHistogram()
+	h.Sum = 0
+	schema, counts := h.SplitSchemaAndData()
+	if len(schema) != len(h.Buckets) || len(counts) != len(h.Buckets) {
+		t.Fatalf("expected %d buckets, got %d and %d", len(h.Buckets), len(schema), len(counts))
+	}
+	for i, b := range schema {
+		if b.Count != 0 {
+			t.Errorf("bucket %d: expected zero count in schema, got %v", i, b.Count)
+		}
+		if counts[i] != h.Buckets[i].Count {
+			t.Errorf("bucket %d: expected count %v, got %v", i, h.Buckets[i].Count, counts[i])
+		}
+	}
+
+	got, err := RejoinSchemaAndData(schema, counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(h) {
+		t.Errorf("expected %v, got %v", h, got)
+	}
+
+	// The same schema serves other counts.
+	got, err = RejoinSchemaAndData(schema, []FloatString{0, 0, 0, 1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Count != 6 || !got.SameSchema(h) {
+		t.Errorf("unexpected histogram %v", got)
+	}
+
+	if _, err := RejoinSchemaAndData(schema, counts[1:]); err == nil {
+		t.Error("expected error for length mismatch")
+	}
+}
+
+func TestHistogramCSV(t *testing.T) {
+	pairs := []SampleHistogramPair{
+		{Timestamp: 1500, Histogram: genSampleHistogram()},
+		{Timestamp: 2000, Histogram: &SampleHistogram{}},
+		{Timestamp: 3000, Histogram: &SampleHistogram{Count: 2, Sum: 3, Buckets: HistogramBuckets{
+			{Boundaries: 2, Lower: 1, Upper: FloatString(math.Inf(1)), Count: 2},
+		}}},
+	}
+	var buf bytes.Buffer
+	if err := WriteHistogramCSV(&buf, pairs); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if expected := "3,2,3,2,1,+Inf,2"; lines[len(lines)-2] != expected {
+		t.Errorf("expected last row %q, got %q", expected, lines[len(lines)-2])
+	}
+
+	got, err := ReadHistogramCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pairs) {
+		t.Fatalf("expected %d pairs, got %d", len(pairs), len(got))
+	}
+	for i := range pairs {
+		if !got[i].Equal(&pairs[i]) {
+			t.Errorf("pair %d: expected %v, got %v", i, pairs[i], got[i])
+		}
+	}
+
+	header := "timestamp,count,sum,boundaries,lower,upper,bucket_count\n"
+	for _, test := range []struct {
+		input, err string
+	}{
+		{input: "", err: ""},
+		{input: "time,count,sum,boundaries,lower,upper,bucket_count\n", err: `line 1: expected column "timestamp", got "time"`},
+		{input: header + "1,1,1,0,0,1,1\n1,x,1,0,1,2,0\n", err: `line 3: invalid count "x"`},
+		{input: header + "1,1,1,4,0,1,1\n", err: `line 2: unknown boundaries "4"`},
+		{input: header + "1,1,1,0,0,1,one\n", err: `line 2: invalid bucket_count "one"`},
+		{input: header + "1.2.3,1,1,0,0,1,1\n", err: `line 2: invalid timestamp "1.2.3"`},
+		{input: header + "1,1,1,0,0,1,1\n1,2,1,0,1,2,1\n", err: "line 3: count and sum differ from previous rows of timestamp 1"},
+	} {
+		got, err := ReadHistogramCSV(strings.NewReader(test.input))
+		if test.err == "" {
+			if err != nil || len(got) != 0 {
+				t.Errorf("%q: expected no pairs, got %v, %v", test.input, got, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: expected error %q, got %v", test.input, test.err, err)
+		}
+	}
+
+	if err := WriteHistogramCSV(&buf, []SampleHistogramPair{{Timestamp: 0}}); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+}
+
+func TestToHeatmapFrame(t *testing.T) {
+	h := &SampleHistogram{Count: 6, Sum: 10, Buckets: HistogramBuckets{
+		{Lower: 1, Upper: 2, Count: 4},
+		{Lower: 0.5, Upper: 1, Count: 1.5},
+		{Lower: 2, Upper: FloatString(math.Inf(1)), Count: 0.5},
+	}}
+	got, err := h.ToHeatmapFrame(1700000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Captured from grafana-plugin-sdk-go v0.250.0, encoding a frame of
+	// type heatmap-cells with the fields xMax of []time.Time and yMin, yMax
+	// and count of []*float64 holding the same rows.
+	expected := `{"schema":{"meta":{"type":"heatmap-cells","typeVersion":[0,0]},"fields":[` +
+		`{"name":"xMax","type":"time","typeInfo":{"frame":"time.Time"}},` +
+		`{"name":"yMin","type":"number","typeInfo":{"frame":"float64","nullable":true}},` +
+		`{"name":"yMax","type":"number","typeInfo":{"frame":"float64","nullable":true}},` +
+		`{"name":"count","type":"number","typeInfo":{"frame":"float64","nullable":true}}]},` +
+		`"data":{"values":[[1700000000000,1700000000000,1700000000000],[0.5,1,2],[1,2,null],[1.5,4,0.5]],` +
+		`"entities":[null,null,{"Inf":[2]},null]}}`
+	if string(got) != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	got, err = (&SampleHistogram{}).ToHeatmapFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Captured the same way from a frame without rows.
+	expected = `{"schema":{"meta":{"type":"heatmap-cells","typeVersion":[0,0]},"fields":[` +
+		`{"name":"xMax","type":"time","typeInfo":{"frame":"time.Time"}},` +
+		`{"name":"yMin","type":"number","typeInfo":{"frame":"float64","nullable":true}},` +
+		`{"name":"yMax","type":"number","typeInfo":{"frame":"float64","nullable":true}},` +
+		`{"name":"count","type":"number","typeInfo":{"frame":"float64","nullable":true}}]},` +
+		`"data":{"values":[[],[],[],[]]}}`
+	if string(got) != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	if _, err := (*SampleHistogram)(nil).ToHeatmapFrame(0); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+}
+
+// TestToHeatmapFrameContract checks the frame against the contract of
+// Grafana's heatmap-cells frame type, independently of the exact bytes: the
+// frame type in meta.type, a time field xMax holding epoch milliseconds,
+// number fields yMin, yMax and count, columnar values of equal length, and
+// entities listing the indices of values JSON cannot represent.
+func TestToHeatmapFrameContract(t *testing.T) {
+	h := &SampleHistogram{Count: 6, Sum: 10, Buckets: HistogramBuckets{
+		{Lower: FloatString(math.Inf(-1)), Upper: 0.5, Count: 0},
+		{Lower: 0.5, Upper: 1, Count: 1.5},
+		{Lower: 1, Upper: 2, Count: 4},
+		{Lower: 2, Upper: FloatString(math.Inf(1)), Count: 0.5},
+	}}
+	ts := TimeFromUnixNano(1700000000123456789)
+	b, err := h.ToHeatmapFrame(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame struct {
+		Schema struct {
+			Meta struct {
+				Type string `json:"type"`
+			} `json:"meta"`
+			Fields []struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"fields"`
+		} `json:"schema"`
+		Data struct {
+			Values   [][]*float64 `json:"values"`
+			Entities []*struct {
+				Inf    []int `json:"Inf"`
+				NegInf []int `json:"NegInf"`
+				NaN    []int `json:"NaN"`
+			} `json:"entities"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.Schema.Meta.Type != "heatmap-cells" {
+		t.Errorf("expected meta.type heatmap-cells, got %q", frame.Schema.Meta.Type)
+	}
+	fields := map[string]string{"xMax": "time", "yMin": "number", "yMax": "number", "count": "number"}
+	index := map[string]int{}
+	for i, f := range frame.Schema.Fields {
+		if want, ok := fields[f.Name]; !ok || f.Type != want {
+			t.Errorf("field %d: unexpected field %q of type %q", i, f.Name, f.Type)
+		}
+		index[f.Name] = i
+	}
+	if len(index) != len(fields) {
+		t.Fatalf("expected fields %v, got %v", fields, frame.Schema.Fields)
+	}
+	if len(frame.Data.Values) != len(fields) {
+		t.Fatalf("expected %d value columns, got %d", len(fields), len(frame.Data.Values))
+	}
+	for i, column := range frame.Data.Values {
+		if len(column) != len(h.Buckets) {
+			t.Errorf("column %d: expected %d rows, got %d", i, len(h.Buckets), len(column))
+		}
+	}
+	if len(frame.Data.Entities) != len(fields) {
+		t.Fatalf("expected %d entity entries, got %d", len(fields), len(frame.Data.Entities))
+	}
+
+	for _, x := range frame.Data.Values[index["xMax"]] {
+		if x == nil || *x != float64(ts.UnixNano()/1e6) {
+			t.Errorf("expected time in epoch milliseconds %d, got %v", ts.UnixNano()/1e6, x)
+		}
+	}
+	// Rebuild the buckets from the columns, resolving the entities.
+	column := func(name string) []float64 {
+		i := index[name]
+		res := make([]float64, len(frame.Data.Values[i]))
+		for j, v := range frame.Data.Values[i] {
+			if v != nil {
+				res[j] = *v
+			}
+		}
+		if e := frame.Data.Entities[i]; e != nil {
+			for _, j := range e.Inf {
+				res[j] = math.Inf(1)
+			}
+			for _, j := range e.NegInf {
+				res[j] = math.Inf(-1)
+			}
+			for _, j := range e.NaN {
+				res[j] = math.NaN()
+			}
+		}
+		for j, v := range frame.Data.Values[i] {
+			if v == nil && res[j] == 0 {
+				t.Errorf("%s: null at row %d without entity", name, j)
+			}
+		}
+		return res
+	}
+	yMin, yMax, count := column("yMin"), column("yMax"), column("count")
+	for i, b := range h.Buckets {
+		if yMin[i] != float64(b.Lower) || yMax[i] != float64(b.Upper) || count[i] != float64(b.Count) {
+			t.Errorf("row %d: expected %v, got [%v,%v]:%v", i, b, yMin[i], yMax[i], count[i])
+		}
+	}
+}
+
+// tdigestQuantile estimates the q-quantile from centroids by interpolating
+// linearly between the centers of neighbouring centroids.
+func tdigestQuantile(centroids []Centroid, q float64) float64 {
+	var total float64
+	for _, c := range centroids {
+		total += float64(c.Weight)
+	}
+	rank := q * total
+	var before float64
+	for i, c := range centroids {
+		center := before + float64(c.Weight)/2
+		if rank <= center || i == len(centroids)-1 {
+			if i == 0 || rank >= center {
+				return float64(c.Mean)
+			}
+			prev := centroids[i-1]
+			prevCenter := before - float64(prev.Weight)/2
+			f := (rank - prevCenter) / (center - prevCenter)
+			return float64(prev.Mean) + f*float64(c.Mean-prev.Mean)
+		}
+		before += float64(c.Weight)
+	}
+	return math.NaN()
+}
+
+func TestToTDigest(t *testing.T) {
+	// 1000 buckets of width 1 following a triangular distribution.
+	abs := func(i int) int {
+		if i < 0 {
+			return -i
+		}
+		return i
+	}
+	edges := make([]float64, 1001)
+	counts := make([]float64, 1000)
+	for i := range edges {
+		edges[i] = float64(i)
+	}
+	for i := range counts {
+		counts[i] = float64(500 - abs(i-500))
+	}
+	h := genLinearHistogram(edges, counts...)
+
+	for _, compression := range []float64{20, 100, 500} {
+		centroids, err := h.ToTDigest(compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if float64(len(centroids)) > compression {
+			t.Errorf("%v: expected at most %v centroids, got %d", compression, compression, len(centroids))
+		}
+		var weight, sum float64
+		for i, c := range centroids {
+			if i > 0 && c.Mean < centroids[i-1].Mean {
+				t.Fatalf("%v: centroids not sorted: %v", compression, centroids)
+			}
+			weight += float64(c.Weight)
+			sum += float64(c.Mean * c.Weight)
+		}
+		if weight != float64(h.Count) || !almostEqual(sum/h.midpointSum(), 1, 1e-12) {
+			t.Errorf("%v: expected weight %v and sum %v, got %v and %v", compression, h.Count, h.midpointSum(), weight, sum)
+		}
+		for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+			expected, _ := h.Quantile(q)
+			// The error shrinks with growing compression.
+			if got := tdigestQuantile(centroids, q); math.Abs(got-float64(expected)) > 1000/compression {
+				t.Errorf("%v: expected quantile %v to be close to %v, got %v", compression, q, expected, got)
+			}
+		}
+	}
+
+	// Without the need to merge, every bucket becomes a centroid.
+	small := genLinearHistogram([]float64{0, 2, 4}, 1, 3)
+	centroids, err := small.ToTDigest(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Centroid{{Mean: 1, Weight: 1}, {Mean: 3, Weight: 3}}; !reflect.DeepEqual(centroids, expected) {
+		t.Errorf("expected %v, got %v", expected, centroids)
+	}
+
+	if centroids, err := (&SampleHistogram{}).ToTDigest(100); err != nil || centroids != nil {
+		t.Errorf("expected no centroids for empty histogram, got %v, %v", centroids, err)
+	}
+	for _, compression := range []float64{0, -1, math.NaN()} {
+		if _, err := h.ToTDigest(compression); err == nil {
+			t.Errorf("expected error for compression %v", compression)
+		}
+	}
+}
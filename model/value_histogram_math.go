@@ -0,0 +1,2445 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// The estimators in this file assume that observations are distributed
+// uniformly within each bucket. Buckets with an infinite bound have no
+// meaningful width, so their observations are treated as if they were all
+// located at the finite bound, or just beyond it if the bucket excludes it.
+
+// midpoint returns the center of the bucket. For buckets with one infinite
+// bound the finite bound is returned instead.
+func (b *HistogramBucket) midpoint() float64 {
+	lower, upper := float64(b.Lower), float64(b.Upper)
+	switch {
+	case math.IsInf(lower, -1) && math.IsInf(upper, 1):
+		return 0
+	case math.IsInf(lower, -1):
+		return upper
+	case math.IsInf(upper, 1):
+		return lower
+	}
+	return lower + (upper-lower)/2
+}
+
+// valueAt returns the value located at fraction f (between 0 and 1) of the
+// way through the bucket, interpolating linearly between its bounds.
+func (b *HistogramBucket) valueAt(f float64) float64 {
+	lower, upper := float64(b.Lower), float64(b.Upper)
+	switch {
+	case math.IsInf(lower, -1):
+		return upper
+	case math.IsInf(upper, 1):
+		return lower
+	}
+	return lower + f*(upper-lower)
+}
+
+// sortedBuckets returns the non-nil buckets ordered by their lower and then
+// upper bound. The receiver is not modified.
+func (s *SampleHistogram) sortedBuckets() HistogramBuckets {
+	buckets := make(HistogramBuckets, 0, len(s.Buckets))
+	for _, b := range s.Buckets {
+		if b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].Lower != buckets[j].Lower {
+			return buckets[i].Lower < buckets[j].Lower
+		}
+		return buckets[i].Upper < buckets[j].Upper
+	})
+	return buckets
+}
+
+// bucketTotal returns the number of observations held by the buckets.
+func (s *SampleHistogram) bucketTotal() float64 {
+	var total float64
+	for _, b := range s.Buckets {
+		if b != nil {
+			total += float64(b.Count)
+		}
+	}
+	return total
+}
+
+// mirrored returns the bucket reflected at zero.
+func (b *HistogramBucket) mirrored() *HistogramBucket {
+	boundaries := b.Boundaries
+	switch boundaries {
+	case 0:
+		boundaries = 1
+	case 1:
+		boundaries = 0
+	}
+	return &HistogramBucket{
+		Boundaries: boundaries,
+		Lower:      -b.Upper,
+		Upper:      -b.Lower,
+		Count:      b.Count,
+	}
+}
+
+// isPointMass reports whether the bucket has no usable width, either because
+// both bounds are equal or because one of them is infinite.
+func (b *HistogramBucket) isPointMass() bool {
+	return b.Lower == b.Upper || math.IsInf(float64(b.Lower), 0) || math.IsInf(float64(b.Upper), 0)
+}
+
+// massLocation returns where the observations of a point-mass bucket are
+// located, at p for offset 0, or just above or below p for offsets 1 and -1.
+// The latter apply to buckets with an infinite bound that exclude their
+// finite bound, like the classic (10,+Inf] overflow bucket, whose
+// observations are all above 10.
+func (b *HistogramBucket) massLocation() (p float64, offset int) {
+	p = b.midpoint()
+	switch {
+	case math.IsInf(float64(b.Lower), -1) && math.IsInf(float64(b.Upper), 1):
+	case math.IsInf(float64(b.Upper), 1) && (b.Boundaries == 0 || b.Boundaries == 2):
+		offset = 1
+	case math.IsInf(float64(b.Lower), -1) && (b.Boundaries == 1 || b.Boundaries == 2):
+		offset = -1
+	}
+	return p, offset
+}
+
+// rankBelow estimates how many observations in the buckets are smaller
+// than x, or smaller than or equal to x if inclusive is set.
+func rankBelow(buckets HistogramBuckets, x float64, inclusive bool) float64 {
+	var rank float64
+	for _, b := range buckets {
+		if b == nil || b.Count <= 0 {
+			continue
+		}
+		if b.isPointMass() {
+			p, offset := b.massLocation()
+			if p < x || (p == x && (offset < 0 || (offset == 0 && inclusive))) {
+				rank += float64(b.Count)
+			}
+			continue
+		}
+		lower, upper := float64(b.Lower), float64(b.Upper)
+		f := math.Min(math.Max((x-lower)/(upper-lower), 0), 1)
+		rank += f * float64(b.Count)
+	}
+	return rank
+}
+
+// valueAtRank returns the lowest value below which rank observations of the
+// sorted buckets are estimated to lie.
+func valueAtRank(buckets HistogramBuckets, rank float64) float64 {
+	return valuesAtRanks(buckets, []float64{rank})[0]
+}
+
+// valuesAtRanks is like valueAtRank for several ranks, which must be sorted
+// in ascending order, but walks the buckets only once.
+func valuesAtRanks(buckets HistogramBuckets, ranks []float64) []float64 {
+	res := make([]float64, len(ranks))
+	var (
+		cum  float64
+		last *HistogramBucket
+		r    int
+	)
+	for _, b := range buckets {
+		c := float64(b.Count)
+		if c <= 0 {
+			continue
+		}
+		for ; r < len(ranks) && cum+c >= ranks[r]; r++ {
+			res[r] = b.valueAt(math.Max(ranks[r]-cum, 0) / c)
+		}
+		cum += c
+		last = b
+	}
+	for ; r < len(ranks); r++ {
+		if last == nil {
+			res[r] = math.NaN()
+		} else {
+			res[r] = last.valueAt(1)
+		}
+	}
+	return res
+}
+
+// clipRanks returns the part of the distribution located between the ranks
+// lo and hi, counted in observations from the lowest value. Buckets that are
+// only partially covered are narrowed to the covered sub-interval and their
+// counts are prorated accordingly.
+func (s *SampleHistogram) clipRanks(lo, hi float64) HistogramBuckets {
+	var (
+		clipped HistogramBuckets
+		cum     float64
+	)
+	for _, b := range s.sortedBuckets() {
+		c := float64(b.Count)
+		if c <= 0 {
+			continue
+		}
+		start, end := math.Max(lo, cum), math.Min(hi, cum+c)
+		if end > start {
+			clipped = append(clipped, &HistogramBucket{
+				Boundaries: b.Boundaries,
+				Lower:      FloatString(b.valueAt((start - cum) / c)),
+				Upper:      FloatString(b.valueAt((end - cum) / c)),
+				Count:      FloatString(end - start),
+			})
+		}
+		cum += c
+	}
+	return clipped
+}
+
+// midpointSum estimates the sum of all observations from the bucket
+// midpoints weighted by their counts.
+func (s *SampleHistogram) midpointSum() float64 {
+	var sum float64
+	for _, b := range s.Buckets {
+		if b != nil {
+			sum += b.midpoint() * float64(b.Count)
+		}
+	}
+	return sum
+}
+
+// midpointMean returns the count-weighted mean of the bucket midpoints.
+func midpointMean(buckets HistogramBuckets) float64 {
+	var sum, count float64
+	for _, b := range buckets {
+		sum += b.midpoint() * float64(b.Count)
+		count += float64(b.Count)
+	}
+	return sum / count
+}
+
+// TrimmedMean estimates the mean of the observations after discarding the
+// lowest and highest trimFraction of them. Buckets at the edges of the
+// retained range are prorated.
+func (s *SampleHistogram) TrimmedMean(trimFraction float64) (FloatString, error) {
+	if !(trimFraction >= 0 && trimFraction < 0.5) {
+		return 0, fmt.Errorf("trim fraction %v must be in [0,0.5)", trimFraction)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	clipped := s.clipRanks(trimFraction*total, (1-trimFraction)*total)
+	return FloatString(midpointMean(clipped)), nil
+}
+
+// SameSchema reports whether both histograms have the same bucket layout,
+// that is identical bounds and boundary rules in the same order.
+func (s *SampleHistogram) SameSchema(o *SampleHistogram) bool {
+	if len(s.Buckets) != len(o.Buckets) {
+		return false
+	}
+	for i, b := range s.Buckets {
+		ob := o.Buckets[i]
+		if b == nil || ob == nil {
+			if b != ob {
+				return false
+			}
+			continue
+		}
+		if b.Boundaries != ob.Boundaries || b.Lower != ob.Lower || b.Upper != ob.Upper {
+			return false
+		}
+	}
+	return true
+}
+
+// Add returns a new histogram holding the observations of both histograms.
+// The histograms must share the same schema.
+func (s *SampleHistogram) Add(o *SampleHistogram) (*SampleHistogram, error) {
+	if s == nil || o == nil {
+		return nil, fmt.Errorf("histogram is nil")
+	}
+	if !s.SameSchema(o) {
+		return nil, fmt.Errorf("incompatible histogram schemas")
+	}
+	res := &SampleHistogram{
+		Count:   s.Count + o.Count,
+		Sum:     s.Sum + o.Sum,
+		Buckets: make(HistogramBuckets, len(s.Buckets)),
+	}
+	for i, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		res.Buckets[i] = &HistogramBucket{
+			Boundaries: b.Boundaries,
+			Lower:      b.Lower,
+			Upper:      b.Upper,
+			Count:      b.Count + o.Buckets[i].Count,
+		}
+	}
+	return res, nil
+}
+
+// AddHistogramVectors adds up the histograms of samples with identical
+// metrics in both vectors. Samples without a histogram or without a
+// counterpart in the other vector are dropped.
+func AddHistogramVectors(a, b Vector) (Vector, error) {
+	byFingerprint := make(map[Fingerprint]*Sample, len(b))
+	for _, s := range b {
+		if s.Histogram != nil {
+			byFingerprint[s.Metric.Fingerprint()] = s
+		}
+	}
+
+	var res Vector
+	for _, s := range a {
+		if s.Histogram == nil {
+			continue
+		}
+		o, ok := byFingerprint[s.Metric.Fingerprint()]
+		if !ok || !s.Metric.Equal(o.Metric) {
+			continue
+		}
+		h, err := s.Histogram.Add(o.Histogram)
+		if err != nil {
+			return nil, fmt.Errorf("adding histograms of %s: %w", s.Metric, err)
+		}
+		res = append(res, &Sample{
+			Metric:    s.Metric,
+			Timestamp: s.Timestamp,
+			Histogram: h,
+		})
+	}
+	return res, nil
+}
+
+// DominantRange returns the narrowest value range holding at least the given
+// fraction of all observations.
+func (s *SampleHistogram) DominantRange(fraction float64) (lo, hi FloatString, err error) {
+	if !(fraction > 0 && fraction <= 1) {
+		return 0, 0, fmt.Errorf("fraction %v must be in (0,1]", fraction)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, 0, fmt.Errorf("histogram is empty")
+	}
+
+	// The narrowest range of a piecewise uniform distribution starts or ends at
+	// a bucket bound. Ranges ending at a bound are found by searching the
+	// mirrored histogram for ranges starting at a bound.
+	buckets := s.sortedBuckets()
+	mirrored := make(HistogramBuckets, 0, len(buckets))
+	for i := len(buckets) - 1; i >= 0; i-- {
+		mirrored = append(mirrored, buckets[i].mirrored())
+	}
+	l1, h1 := narrowestRangeFromBound(buckets, fraction*total, total)
+	l2, h2 := narrowestRangeFromBound(mirrored, fraction*total, total)
+	if h2-l2 < h1-l1 {
+		return FloatString(-h2), FloatString(-l2), nil
+	}
+	return FloatString(l1), FloatString(h1), nil
+}
+
+// narrowestRangeFromBound returns the narrowest range that starts at a finite
+// bucket bound and holds mass observations of the sorted buckets.
+func narrowestRangeFromBound(buckets HistogramBuckets, mass, total float64) (lo, hi float64) {
+	lo, hi = math.Inf(-1), math.Inf(1)
+	for _, b := range buckets {
+		if b.Count <= 0 {
+			continue
+		}
+		for _, start := range []float64{float64(b.Lower), float64(b.Upper)} {
+			if math.IsInf(start, 0) {
+				continue
+			}
+			rank := rankBelow(buckets, start, false) + mass
+			if rank > total*(1+1e-12) {
+				continue
+			}
+			end := valueAtRank(buckets, rank)
+			if end-start < hi-lo {
+				lo, hi = start, end
+			}
+		}
+	}
+	return lo, hi
+}
+
+// unionEdges returns the sorted distinct bounds of all buckets of the given
+// histograms.
+func unionEdges(hs ...*SampleHistogram) []float64 {
+	set := map[float64]struct{}{}
+	for _, h := range hs {
+		for _, b := range h.Buckets {
+			if b != nil {
+				set[float64(b.Lower)] = struct{}{}
+				set[float64(b.Upper)] = struct{}{}
+			}
+		}
+	}
+	edges := make([]float64, 0, len(set))
+	for e := range set {
+		edges = append(edges, e)
+	}
+	sort.Float64s(edges)
+	return edges
+}
+
+// rebucketCounts distributes the observations of the histogram onto the
+// intervals between consecutive edges, which must be sorted. Observations
+// outside of the edges are dropped.
+func (s *SampleHistogram) rebucketCounts(edges []float64) []float64 {
+	if len(edges) < 2 {
+		return nil
+	}
+	counts := make([]float64, len(edges)-1)
+	for _, b := range s.Buckets {
+		if b == nil || b.Count == 0 {
+			continue
+		}
+		if b.isPointMass() {
+			// The intervals include their upper edge, so observations
+			// located exactly at an edge belong to the interval ending
+			// there, and those just above it to the interval starting
+			// there.
+			p, offset := b.massLocation()
+			i := sort.SearchFloat64s(edges, p) - 1
+			if offset > 0 && i+1 < len(edges) && edges[i+1] == p {
+				i++
+			}
+			if i < 0 && p == edges[0] {
+				i = 0
+			}
+			if i >= 0 && i < len(counts) {
+				counts[i] += float64(b.Count)
+			}
+			continue
+		}
+		lower, upper := float64(b.Lower), float64(b.Upper)
+		for i := range counts {
+			overlap := math.Min(upper, edges[i+1]) - math.Max(lower, edges[i])
+			if overlap > 0 {
+				counts[i] += float64(b.Count) * overlap / (upper - lower)
+			}
+		}
+	}
+	return counts
+}
+
+// checkEdges verifies that edges describe at least one interval and are
+// strictly increasing, and converts them to float64.
+func checkEdges(edges []FloatString) ([]float64, error) {
+	if len(edges) < 2 {
+		return nil, fmt.Errorf("at least two edges required, got %d", len(edges))
+	}
+	res := make([]float64, len(edges))
+	for i, e := range edges {
+		if math.IsNaN(float64(e)) || (i > 0 && e <= edges[i-1]) {
+			return nil, fmt.Errorf("edges must be strictly increasing, got %v at index %d", e, i)
+		}
+		res[i] = float64(e)
+	}
+	return res, nil
+}
+
+// flattened returns the histogram's observations rebucketed onto
+// non-overlapping buckets between the union of its bounds.
+func (s *SampleHistogram) flattened() *SampleHistogram {
+	edges := unionEdges(s)
+	if len(edges) < 2 {
+		// All bounds coincide, so there is nothing to flatten.
+		return s
+	}
+	res := &SampleHistogram{Count: s.Count, Sum: s.Sum}
+	for i, c := range s.rebucketCounts(edges) {
+		res.Buckets = append(res.Buckets, &HistogramBucket{
+			Lower: FloatString(edges[i]),
+			Upper: FloatString(edges[i+1]),
+			Count: FloatString(c),
+		})
+	}
+	return res
+}
+
+// covers reports whether any bucket of the histograms spans the interval
+// between lower and upper.
+func covers(lower, upper float64, hs ...*SampleHistogram) bool {
+	for _, h := range hs {
+		for _, b := range h.Buckets {
+			if b != nil && float64(b.Lower) <= lower && float64(b.Upper) >= upper {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// alignHistograms expresses the buckets of all histograms on a common
+// layout. If all histograms share the schema of the first one, its layout is
+// used as is. Otherwise the histograms are rebucketed onto upper-inclusive
+// buckets between the union of their bounds, omitting gaps that none of them
+// covers. The returned layout holds no counts; counts[i][j] is the count of
+// histogram i in the layout's bucket j.
+func alignHistograms(hs ...*SampleHistogram) (layout HistogramBuckets, counts [][]float64) {
+	counts = make([][]float64, len(hs))
+
+	same := true
+	for _, h := range hs[1:] {
+		if !hs[0].SameSchema(h) {
+			same = false
+			break
+		}
+	}
+	if same {
+		for j, b := range hs[0].Buckets {
+			if b == nil {
+				continue
+			}
+			layout = append(layout, &HistogramBucket{Boundaries: b.Boundaries, Lower: b.Lower, Upper: b.Upper})
+			for i, h := range hs {
+				counts[i] = append(counts[i], float64(h.Buckets[j].Count))
+			}
+		}
+		return layout, counts
+	}
+
+	edges := unionEdges(hs...)
+	all := make([][]float64, len(hs))
+	for i, h := range hs {
+		all[i] = h.rebucketCounts(edges)
+	}
+	for j := 0; j+1 < len(edges); j++ {
+		keep := covers(edges[j], edges[j+1], hs...)
+		for i := range hs {
+			keep = keep || all[i][j] != 0
+		}
+		if !keep {
+			continue
+		}
+		layout = append(layout, &HistogramBucket{Lower: FloatString(edges[j]), Upper: FloatString(edges[j+1])})
+		for i := range hs {
+			counts[i] = append(counts[i], all[i][j])
+		}
+	}
+	return layout, counts
+}
+
+// SignedDelta returns the bucket-wise difference between the histogram and
+// o. Unlike the counts of a regular histogram, the resulting counts are
+// negative for buckets that shrank. Histograms with different schemas are
+// rebucketed onto the union of their bounds first.
+func (s *SampleHistogram) SignedDelta(o *SampleHistogram) (*SampleHistogram, error) {
+	if s == nil || o == nil {
+		return nil, fmt.Errorf("histogram is nil")
+	}
+	layout, counts := alignHistograms(s, o)
+	for j, b := range layout {
+		b.Count = FloatString(counts[0][j] - counts[1][j])
+	}
+	return &SampleHistogram{
+		Count:   s.Count - o.Count,
+		Sum:     s.Sum - o.Sum,
+		Buckets: layout,
+	}, nil
+}
+
+// bucketKey identifies the interval covered by a bucket.
+type bucketKey struct {
+	boundaries   int32
+	lower, upper FloatString
+}
+
+func (b *HistogramBucket) key() bucketKey {
+	return bucketKey{boundaries: b.Boundaries, lower: b.Lower, upper: b.Upper}
+}
+
+// addCount adds the count of o to the bucket. CountExact is kept exact as
+// long as the counts of both buckets are exact, and dropped otherwise.
+func (b *HistogramBucket) addCount(o *HistogramBucket) {
+	if b.CountExact == nil && o.CountExact == nil {
+		b.Count += o.Count
+		return
+	}
+	x, okX := b.ExactCount()
+	y, okY := o.ExactCount()
+	b.Count += o.Count
+	b.CountExact = nil
+	if okX && okY {
+		b.CountExact = x.Add(x, y)
+		f, _ := new(big.Float).SetInt(b.CountExact).Float64()
+		b.Count = FloatString(f)
+	}
+}
+
+// Dedup returns a copy of the histogram in which buckets covering the same
+// interval with the same boundary rule are merged into one by summing their
+// counts. The order of first occurrence is kept.
+func (s *SampleHistogram) Dedup() *SampleHistogram {
+	res := &SampleHistogram{Count: s.Count, Sum: s.Sum}
+	index := make(map[bucketKey]int, len(s.Buckets))
+	for _, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		if i, ok := index[b.key()]; ok {
+			res.Buckets[i].addCount(b)
+			continue
+		}
+		index[b.key()] = len(res.Buckets)
+		nb := *b
+		res.Buckets = append(res.Buckets, &nb)
+	}
+	return res
+}
+
+// Quantile estimates the q-quantile (0 <= q <= 1) of the observations by
+// linear interpolation within the bucket holding it.
+func (s *SampleHistogram) Quantile(q float64) (FloatString, error) {
+	if !(q >= 0 && q <= 1) {
+		return 0, fmt.Errorf("quantile %v must be in [0,1]", q)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	return FloatString(valueAtRank(s.sortedBuckets(), q*total)), nil
+}
+
+// CDF returns the estimated fraction of observations that are smaller than
+// or equal to x. Empty histograms yield 0.
+func (s *SampleHistogram) CDF(x FloatString) FloatString {
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0
+	}
+	return FloatString(rankBelow(s.Buckets, float64(x), true) / total)
+}
+
+// CenterOfMassQuantile returns the quantile at which the distribution
+// reaches its mean, Sum/Count. Values above 0.5 indicate a distribution
+// skewed towards lower values with a long tail of high ones.
+func (s *SampleHistogram) CenterOfMassQuantile() (float64, error) {
+	if s.Count <= 0 || s.bucketTotal() <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	return float64(s.CDF(s.Sum / s.Count)), nil
+}
+
+// MAD estimates the median absolute deviation of the observations from
+// their median. The buckets are folded at the median into a histogram of
+// absolute deviations, whose median is returned.
+func (s *SampleHistogram) MAD() (FloatString, error) {
+	median, err := s.Quantile(0.5)
+	if err != nil {
+		return 0, err
+	}
+	m := float64(median)
+
+	var dev SampleHistogram
+	add := func(lower, upper, count float64) {
+		if count > 0 {
+			dev.Buckets = append(dev.Buckets, &HistogramBucket{
+				Boundaries: 3,
+				Lower:      FloatString(lower),
+				Upper:      FloatString(upper),
+				Count:      FloatString(count),
+			})
+		}
+	}
+	for _, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		lower, upper, c := float64(b.Lower), float64(b.Upper), float64(b.Count)
+		switch {
+		case b.isPointMass():
+			d := math.Abs(b.midpoint() - m)
+			add(d, d, c)
+		case lower >= m:
+			add(lower-m, upper-m, c)
+		case upper <= m:
+			add(m-upper, m-lower, c)
+		default:
+			// The bucket straddles the median and folds onto itself.
+			width := upper - lower
+			add(0, m-lower, c*(m-lower)/width)
+			add(0, upper-m, c*(upper-m)/width)
+		}
+	}
+	// Folding produces overlapping buckets, which are flattened onto
+	// their common bounds before taking the median.
+	return dev.flattened().Quantile(0.5)
+}
+
+// SumContribution estimates how much each bucket contributes to the sum of
+// all observations as the product of its midpoint and count. The result is
+// in the order of the buckets and adds up to approximately Sum.
+func (s *SampleHistogram) SumContribution() []FloatString {
+	res := make([]FloatString, len(s.Buckets))
+	for i, b := range s.Buckets {
+		if b != nil {
+			res[i] = FloatString(b.midpoint()) * b.Count
+		}
+	}
+	return res
+}
+
+// NewSampleHistogramFromDurationLE builds a histogram from cumulative bucket
+// counts of a classic histogram whose upper bounds are given as duration
+// strings, like "250ms", "1.5s" or "+Inf". The bounds are converted to
+// seconds. As durations are never negative, the first bucket is [0,le],
+// closed at 0 so that it holds zero-duration observations, and negative
+// bounds are rejected. The sum of the observations is unknown and left
+// at 0.
+func NewSampleHistogramFromDurationLE(les []string, cumCounts []float64) (*SampleHistogram, error) {
+	if len(les) != len(cumCounts) {
+		return nil, fmt.Errorf("got %d bounds but %d counts", len(les), len(cumCounts))
+	}
+	h := &SampleHistogram{}
+	var lower, prev float64
+	for i, le := range les {
+		upper, err := parseDurationSeconds(le)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bound %q at index %d: %w", le, i, err)
+		}
+		if upper <= lower && i > 0 {
+			return nil, fmt.Errorf("bound %q at index %d is not increasing", le, i)
+		}
+		if cumCounts[i] < prev {
+			return nil, fmt.Errorf("cumulative count %v at index %d is decreasing", cumCounts[i], i)
+		}
+		b := &HistogramBucket{
+			Lower: FloatString(lower),
+			Upper: FloatString(upper),
+			Count: FloatString(cumCounts[i] - prev),
+		}
+		if i == 0 {
+			b.Boundaries = 3
+		}
+		h.Buckets = append(h.Buckets, b)
+		lower, prev = upper, cumCounts[i]
+	}
+	h.Count = FloatString(prev)
+	return h, nil
+}
+
+// parseDurationSeconds parses a duration as understood by ParseDuration, or
+// a fractional duration as understood by time.ParseDuration, into seconds.
+// "+Inf" is accepted as an infinite duration.
+func parseDurationSeconds(s string) (float64, error) {
+	if s == "+Inf" {
+		return math.Inf(1), nil
+	}
+	if d, err := ParseDuration(s); err == nil {
+		return time.Duration(d).Seconds(), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration")
+	}
+	return d.Seconds(), nil
+}
+
+// width returns the distance between the bounds of the bucket.
+func (b *HistogramBucket) width() float64 {
+	return float64(b.Upper - b.Lower)
+}
+
+// mergeBuckets returns a bucket spanning from the lower bound of left to the
+// upper bound of right, holding the observations of both.
+func mergeBuckets(left, right *HistogramBucket) *HistogramBucket {
+	lowerInclusive := left.Boundaries == 1 || left.Boundaries == 3
+	upperInclusive := right.Boundaries == 0 || right.Boundaries == 3
+	var boundaries int32
+	switch {
+	case lowerInclusive && upperInclusive:
+		boundaries = 3
+	case lowerInclusive:
+		boundaries = 1
+	case upperInclusive:
+		boundaries = 0
+	default:
+		boundaries = 2
+	}
+	return &HistogramBucket{
+		Boundaries: boundaries,
+		Lower:      left.Lower,
+		Upper:      right.Upper,
+		Count:      left.Count + right.Count,
+	}
+}
+
+// EnforceMinWidth returns a copy of the histogram in which buckets narrower
+// than minWidth are merged with their narrower adjacent neighbor until every
+// bucket is at least minWidth wide. Buckets with an infinite bound are never
+// merged. Count and Sum are preserved.
+func (s *SampleHistogram) EnforceMinWidth(minWidth FloatString) *SampleHistogram {
+	buckets := s.sortedBuckets()
+	for {
+		narrowest := -1
+		for i, b := range buckets {
+			w := b.width()
+			if !math.IsInf(w, 0) && w < float64(minWidth) && (narrowest < 0 || w < buckets[narrowest].width()) {
+				narrowest = i
+			}
+		}
+		if narrowest < 0 {
+			break
+		}
+		neighbor := -1
+		for _, i := range []int{narrowest - 1, narrowest + 1} {
+			if i < 0 || i >= len(buckets) || math.IsInf(buckets[i].width(), 0) {
+				continue
+			}
+			if neighbor < 0 || buckets[i].width() < buckets[neighbor].width() {
+				neighbor = i
+			}
+		}
+		if neighbor < 0 {
+			// A lone finite bucket cannot be widened.
+			break
+		}
+		left := narrowest
+		if neighbor < left {
+			left = neighbor
+		}
+		merged := mergeBuckets(buckets[left], buckets[left+1])
+		buckets = append(buckets[:left], append(HistogramBuckets{merged}, buckets[left+2:]...)...)
+	}
+
+	res := &SampleHistogram{Count: s.Count, Sum: s.Sum, Buckets: make(HistogramBuckets, len(buckets))}
+	for i, b := range buckets {
+		nb := *b
+		res.Buckets[i] = &nb
+	}
+	return res
+}
+
+// normalized returns the counts scaled to add up to 1. It returns false if
+// the counts add up to 0.
+func normalized(counts []float64) ([]float64, bool) {
+	var total float64
+	for _, c := range counts {
+		total += c
+	}
+	if total <= 0 {
+		return nil, false
+	}
+	res := make([]float64, len(counts))
+	for i, c := range counts {
+		res[i] = c / total
+	}
+	return res, true
+}
+
+// alignedMasses rebuckets both histograms onto a common layout and returns
+// their per-bucket probability masses.
+func alignedMasses(a, b *SampleHistogram) (pa, pb []float64, err error) {
+	if a == nil || b == nil {
+		return nil, nil, fmt.Errorf("histogram is nil")
+	}
+	_, counts := alignHistograms(a, b)
+	pa, okA := normalized(counts[0])
+	pb, okB := normalized(counts[1])
+	if !okA || !okB {
+		return nil, nil, fmt.Errorf("histogram is empty")
+	}
+	return pa, pb, nil
+}
+
+// HistogramOverlap returns the overlap coefficient of the two distributions,
+// the sum of the smaller of both probability masses over all buckets. It is
+// 1 for identical distributions and 0 for disjoint ones. Both histograms are
+// rebucketed onto the union of their bounds first.
+func HistogramOverlap(a, b *SampleHistogram) (float64, error) {
+	pa, pb, err := alignedMasses(a, b)
+	if err != nil {
+		return 0, err
+	}
+	var overlap float64
+	for i := range pa {
+		overlap += math.Min(pa[i], pb[i])
+	}
+	return overlap, nil
+}
+
+// counts returns the counts of the non-nil buckets in stored order.
+func (s *SampleHistogram) counts() []float64 {
+	res := make([]float64, 0, len(s.Buckets))
+	for _, b := range s.Buckets {
+		if b != nil {
+			res = append(res, float64(b.Count))
+		}
+	}
+	return res
+}
+
+// EffectiveBuckets returns the inverse Simpson index of the bucket
+// probability masses, 1/Σp². It equals the number of buckets if all hold
+// the same number of observations and approaches 1 as a single bucket
+// dominates. Empty histograms yield 0.
+func (s *SampleHistogram) EffectiveBuckets() float64 {
+	masses, ok := normalized(s.counts())
+	if !ok {
+		return 0
+	}
+	var sum float64
+	for _, p := range masses {
+		sum += p * p
+	}
+	return 1 / sum
+}
+
+// TailRatio returns the ratio of the 99th percentile to the median, a
+// dimensionless measure of how far the tail of the distribution stretches.
+func (s *SampleHistogram) TailRatio() (FloatString, error) {
+	median, err := s.Quantile(0.5)
+	if err != nil {
+		return 0, err
+	}
+	if median == 0 {
+		return 0, fmt.Errorf("median is zero")
+	}
+	p99, err := s.Quantile(0.99)
+	if err != nil {
+		return 0, err
+	}
+	return p99 / median, nil
+}
+
+// SampleHistogramFromValues counts the values into upper-inclusive buckets
+// between consecutive edges, which must be strictly increasing. Values not
+// covered by the edges are counted into a bucket from -Inf to the first edge
+// or from the last edge to +Inf; these buckets only exist if they hold any
+// values. NaN values are counted in Count but in no bucket.
+func SampleHistogramFromValues(values []float64, edges []FloatString) (*SampleHistogram, error) {
+	fedges, err := checkEdges(edges)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]float64, len(fedges)+1)
+	h := &SampleHistogram{Count: FloatString(len(values))}
+	for _, v := range values {
+		h.Sum += FloatString(v)
+		if math.IsNaN(v) {
+			continue
+		}
+		counts[sort.SearchFloat64s(fedges, v)]++
+	}
+
+	if counts[0] > 0 {
+		h.Buckets = append(h.Buckets, &HistogramBucket{
+			Lower: FloatString(math.Inf(-1)),
+			Upper: edges[0],
+			Count: FloatString(counts[0]),
+		})
+	}
+	for i := 1; i < len(fedges); i++ {
+		h.Buckets = append(h.Buckets, &HistogramBucket{
+			Lower: edges[i-1],
+			Upper: edges[i],
+			Count: FloatString(counts[i]),
+		})
+	}
+	if c := counts[len(fedges)]; c > 0 {
+		h.Buckets = append(h.Buckets, &HistogramBucket{
+			Lower: edges[len(edges)-1],
+			Upper: FloatString(math.Inf(1)),
+			Count: FloatString(c),
+		})
+	}
+	return h, nil
+}
+
+// TopBucketFraction returns the fraction of all observations counted in the
+// bucket with the highest upper bound, often the +Inf overflow bucket. A high
+// value indicates that the buckets do not reach far enough for quantile
+// estimations to be reliable. Empty histograms yield 0.
+func (s *SampleHistogram) TopBucketFraction() FloatString {
+	if s.Count <= 0 {
+		return 0
+	}
+	var top *HistogramBucket
+	for _, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		if top == nil || b.Upper > top.Upper || (b.Upper == top.Upper && b.Lower > top.Lower) {
+			top = b
+		}
+	}
+	if top == nil {
+		return 0
+	}
+	return top.Count / s.Count
+}
+
+// copy returns a deep copy of the histogram.
+func (s *SampleHistogram) copy() *SampleHistogram {
+	res := &SampleHistogram{Count: s.Count, Sum: s.Sum}
+	if s.Buckets != nil {
+		res.Buckets = make(HistogramBuckets, len(s.Buckets))
+	}
+	for i, b := range s.Buckets {
+		if b != nil {
+			nb := *b
+			res.Buckets[i] = &nb
+		}
+	}
+	return res
+}
+
+// MaskBelow returns a copy of the histogram in which the count of every
+// bucket holding fewer than minCount observations is set to 0. The bucket
+// layout is kept and Count is recomputed from the remaining buckets. Sum is
+// left unchanged, as there is no way to tell how much the masked
+// observations contributed to it.
+func (s *SampleHistogram) MaskBelow(minCount FloatString) *SampleHistogram {
+	res := s.copy()
+	res.Count = 0
+	for _, b := range res.Buckets {
+		if b == nil {
+			continue
+		}
+		if b.Count < minCount {
+			b.Count, b.CountExact = 0, nil
+		}
+		res.Count += b.Count
+	}
+	return res
+}
+
+// InRange returns copies of the buckets whose bounds intersect the closed
+// interval from lo to hi, in their original order. Buckets merely touching
+// the interval at a bound are included.
+func (s HistogramBuckets) InRange(lo, hi FloatString) HistogramBuckets {
+	var res HistogramBuckets
+	for _, b := range s {
+		if b == nil || b.Upper < lo || b.Lower > hi {
+			continue
+		}
+		nb := *b
+		res = append(res, &nb)
+	}
+	return res
+}
+
+// Gini estimates the Gini coefficient of the observations from the Lorenz
+// curve of cumulative count versus cumulative value mass, with every
+// observation located at the midpoint of its bucket. It is 0 if all
+// observations have the same value and approaches 1 as the value mass
+// concentrates in few observations. Negative values are not supported.
+func (s *SampleHistogram) Gini() (FloatString, error) {
+	buckets := s.sortedBuckets()
+	var totalCount, totalMass float64
+	for _, b := range buckets {
+		if b.Count <= 0 {
+			continue
+		}
+		if b.midpoint() < 0 {
+			return 0, fmt.Errorf("negative values not supported")
+		}
+		totalCount += float64(b.Count)
+		totalMass += b.midpoint() * float64(b.Count)
+	}
+	if totalCount <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	if totalMass <= 0 {
+		return 0, fmt.Errorf("sum of values is zero")
+	}
+
+	// Integrate the area below the Lorenz curve with the trapezoidal rule.
+	var area, x, y float64
+	for _, b := range buckets {
+		if b.Count <= 0 {
+			continue
+		}
+		nx := x + float64(b.Count)/totalCount
+		ny := y + b.midpoint()*float64(b.Count)/totalMass
+		area += (nx - x) * (ny + y) / 2
+		x, y = nx, ny
+	}
+	return FloatString(1 - 2*area), nil
+}
+
+// ObservationsToShiftQuantile estimates how many additional observations are
+// needed to move the q-quantile up to targetValue, assuming that all of them
+// land above targetValue. The q-quantile reaches targetValue once the
+// observations not exceeding it make up a fraction of exactly q of the
+// total, so the 0-quantile cannot be shifted at all.
+func (s *SampleHistogram) ObservationsToShiftQuantile(q float64, targetValue FloatString) (FloatString, error) {
+	current, err := s.Quantile(q)
+	if err != nil {
+		return 0, err
+	}
+	if q == 0 {
+		return 0, fmt.Errorf("the 0-quantile cannot be shifted by adding observations above it")
+	}
+	if targetValue <= current {
+		return 0, fmt.Errorf("target value %v does not exceed current quantile %v", targetValue, current)
+	}
+	below := rankBelow(s.Buckets, float64(targetValue), true)
+	return FloatString(below/q - s.bucketTotal()), nil
+}
+
+// countInRange estimates how many observations lie within the closed
+// interval from lo to hi, prorating buckets that are only partially covered.
+func (s *SampleHistogram) countInRange(lo, hi float64) float64 {
+	if hi < lo {
+		return 0
+	}
+	return rankBelow(s.Buckets, hi, true) - rankBelow(s.Buckets, lo, false)
+}
+
+// SLOCompliance returns the estimated number of observations within the
+// closed interval from sloLo to sloHi together with their fraction of all
+// observations. Empty histograms yield 0 for both.
+func (s *SampleHistogram) SLOCompliance(sloLo, sloHi FloatString) (count, fraction FloatString) {
+	count = FloatString(s.countInRange(float64(sloLo), float64(sloHi)))
+	if s.Count <= 0 {
+		return count, 0
+	}
+	return count, count / s.Count
+}
+
+// UniformSample returns the estimated density of observations, in
+// observations per unit, at n points evenly spaced by step starting at
+// start. The density of each bucket is located at its midpoint and linearly
+// interpolated towards the midpoints of adjacent buckets. Points not covered
+// by any bucket of finite width yield 0.
+func (s *SampleHistogram) UniformSample(start, step FloatString, n int) []FloatString {
+	if n <= 0 {
+		return nil
+	}
+	var buckets HistogramBuckets
+	for _, b := range s.sortedBuckets() {
+		if !b.isPointMass() {
+			buckets = append(buckets, b)
+		}
+	}
+	density := func(i int) float64 {
+		return float64(buckets[i].Count) / buckets[i].width()
+	}
+
+	res := make([]FloatString, n)
+	for i := range res {
+		x := float64(start) + float64(i)*float64(step)
+		k := sort.Search(len(buckets), func(j int) bool { return float64(buckets[j].Upper) >= x })
+		if k == len(buckets) || float64(buckets[k].Lower) > x {
+			continue
+		}
+		mid, d := buckets[k].midpoint(), density(k)
+		switch {
+		case x < mid && k > 0 && buckets[k-1].Upper == buckets[k].Lower:
+			prevMid := buckets[k-1].midpoint()
+			d = density(k-1) + (d-density(k-1))*(x-prevMid)/(mid-prevMid)
+		case x > mid && k+1 < len(buckets) && buckets[k+1].Lower == buckets[k].Upper:
+			nextMid := buckets[k+1].midpoint()
+			d += (density(k+1) - d) * (x - mid) / (nextMid - mid)
+		}
+		res[i] = FloatString(d)
+	}
+	return res
+}
+
+// KLDivergence returns the Kullback-Leibler divergence of the distribution q
+// from p, Σ p_i ln(p_i/q_i) over the probability masses of both histograms
+// rebucketed onto the union of their bounds. It is +Inf if p has
+// observations in a bucket where q has none.
+func KLDivergence(p, q *SampleHistogram) (float64, error) {
+	pp, pq, err := alignedMasses(p, q)
+	if err != nil {
+		return 0, err
+	}
+	var kl float64
+	for i := range pp {
+		switch {
+		case pp[i] == 0:
+		case pq[i] == 0:
+			return math.Inf(1), nil
+		default:
+			kl += pp[i] * math.Log(pp[i]/pq[i])
+		}
+	}
+	return kl, nil
+}
+
+// QuantileSummary holds the percentiles of a histogram commonly shown on
+// dashboards, together with its count and sum.
+type QuantileSummary struct {
+	P50, P90, P95, P99, Max FloatString
+	Count, Sum              FloatString
+}
+
+// Summary computes the QuantileSummary of the histogram in a single walk over
+// its buckets.
+func (s *SampleHistogram) Summary() (QuantileSummary, error) {
+	total := s.bucketTotal()
+	if total <= 0 {
+		return QuantileSummary{}, fmt.Errorf("histogram is empty")
+	}
+	v := valuesAtRanks(s.sortedBuckets(), []float64{0.5 * total, 0.9 * total, 0.95 * total, 0.99 * total, total})
+	return QuantileSummary{
+		P50:   FloatString(v[0]),
+		P90:   FloatString(v[1]),
+		P95:   FloatString(v[2]),
+		P99:   FloatString(v[3]),
+		Max:   FloatString(v[4]),
+		Count: s.Count,
+		Sum:   s.Sum,
+	}, nil
+}
+
+// IsPartition reports whether the buckets, once sorted, tile a contiguous
+// value range without gaps or overlaps, that is whether each bucket starts
+// where the previous one ends, within the given tolerance.
+func (s HistogramBuckets) IsPartition(tolerance float64) bool {
+	for _, b := range s {
+		if b == nil {
+			return false
+		}
+	}
+	sorted := (&SampleHistogram{Buckets: s}).sortedBuckets()
+	for i := 1; i < len(sorted); i++ {
+		if math.Abs(float64(sorted[i].Lower-sorted[i-1].Upper)) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// AlignTo returns a copy of the histogram rebucketed onto the bucket layout
+// of template, so that the result shares its schema and can be added to or
+// compared with it directly. Counts are prorated assuming observations are
+// uniformly distributed within each bucket and honour the boundary rules of
+// the template's buckets. Observations outside the template's buckets are
+// dropped from the buckets, while Count and Sum are carried over unchanged.
+func (s *SampleHistogram) AlignTo(template *SampleHistogram) (*SampleHistogram, error) {
+	if s == nil || template == nil {
+		return nil, fmt.Errorf("histogram is nil")
+	}
+	if len(template.Buckets) == 0 {
+		return nil, fmt.Errorf("template histogram has no buckets")
+	}
+	if s.SameSchema(template) {
+		return s.copy(), nil
+	}
+	res := &SampleHistogram{
+		Count:   s.Count,
+		Sum:     s.Sum,
+		Buckets: make(HistogramBuckets, len(template.Buckets)),
+	}
+	for i, b := range template.Buckets {
+		if b == nil {
+			continue
+		}
+		lowerInclusive := b.Boundaries == 1 || b.Boundaries == 3
+		upperInclusive := b.Boundaries == 0 || b.Boundaries == 3
+		count := rankBelow(s.Buckets, float64(b.Upper), upperInclusive) -
+			rankBelow(s.Buckets, float64(b.Lower), !lowerInclusive)
+		res.Buckets[i] = &HistogramBucket{
+			Boundaries: b.Boundaries,
+			Lower:      b.Lower,
+			Upper:      b.Upper,
+			Count:      FloatString(math.Max(count, 0)),
+		}
+	}
+	return res, nil
+}
+
+// ErrorBudgetRemaining returns how many more observations could exceed
+// threshold before the fraction of observations smaller than or equal to
+// threshold drops below targetCompliance (0 < targetCompliance <= 1). A
+// negative result means that the compliance target is already missed by
+// that many observations.
+func (s *SampleHistogram) ErrorBudgetRemaining(threshold FloatString, targetCompliance float64) (FloatString, error) {
+	if !(targetCompliance > 0 && targetCompliance <= 1) {
+		return 0, fmt.Errorf("target compliance %v must be in (0,1]", targetCompliance)
+	}
+	good := rankBelow(s.Buckets, float64(threshold), true)
+	return FloatString(good/targetCompliance - float64(s.Count)), nil
+}
+
+// IsPointMass reports whether at least the given fraction (0 < fraction <=
+// 1) of all observations is counted in a single bucket, in which case the
+// distribution is well described by that bucket alone. Empty histograms and
+// fractions out of range yield false.
+func (s *SampleHistogram) IsPointMass(fraction float64) bool {
+	if !(fraction > 0 && fraction <= 1) {
+		return false
+	}
+	var total, max float64
+	for _, b := range s.Buckets {
+		if b == nil || b.Count <= 0 {
+			continue
+		}
+		total += float64(b.Count)
+		if float64(b.Count) > max {
+			max = float64(b.Count)
+		}
+	}
+	return total > 0 && max >= fraction*total
+}
+
+// QuantileGap returns the distance between the q1- and the q2-quantile of
+// the observations, where 0 <= q1 <= q2 <= 1. Small gaps between high
+// quantiles indicate a compressed tail.
+func (s *SampleHistogram) QuantileGap(q1, q2 float64) (FloatString, error) {
+	if !(q1 >= 0 && q1 <= 1) || !(q2 >= 0 && q2 <= 1) {
+		return 0, fmt.Errorf("quantiles %v and %v must be in [0,1]", q1, q2)
+	}
+	if q1 > q2 {
+		return 0, fmt.Errorf("quantile %v must not exceed quantile %v", q1, q2)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	v := valuesAtRanks(s.sortedBuckets(), []float64{q1 * total, q2 * total})
+	return FloatString(v[1] - v[0]), nil
+}
+
+// relativeChange returns (cur-base)/base. A zero base yields 0 if cur is
+// zero as well and an infinity of the sign of cur otherwise.
+func relativeChange(cur, base float64) float64 {
+	if base == 0 {
+		if cur == 0 {
+			return 0
+		}
+		return math.Inf(int(math.Copysign(1, cur)))
+	}
+	return (cur - base) / base
+}
+
+// RelativeTo returns the bucket-wise relative change of the histogram
+// compared to baseline, that is (s_i - baseline_i) / baseline_i for every
+// bucket i. Buckets empty in the baseline yield +Inf if the histogram has
+// observations in them and 0 otherwise. Count and Sum are the relative
+// changes of the respective totals. Histograms with different schemas are
+// rebucketed onto the union of their bounds first.
+func (s *SampleHistogram) RelativeTo(baseline *SampleHistogram) (*SampleHistogram, error) {
+	if s == nil || baseline == nil {
+		return nil, fmt.Errorf("histogram is nil")
+	}
+	layout, counts := alignHistograms(s, baseline)
+	for j, b := range layout {
+		b.Count = FloatString(relativeChange(counts[0][j], counts[1][j]))
+	}
+	return &SampleHistogram{
+		Count:   FloatString(relativeChange(float64(s.Count), float64(baseline.Count))),
+		Sum:     FloatString(relativeChange(float64(s.Sum), float64(baseline.Sum))),
+		Buckets: layout,
+	}, nil
+}
+
+// TotalObservations returns the sum of the total counts of all histograms.
+// Nil histograms are skipped.
+func TotalObservations(hists []*SampleHistogram) FloatString {
+	var total FloatString
+	for _, h := range hists {
+		if h != nil {
+			total += h.Count
+		}
+	}
+	return total
+}
+
+// snapToPower rounds x to the power of base nearest to it on a logarithmic
+// scale, keeping its sign. Zero and infinite values are returned unchanged.
+func snapToPower(x, base float64) float64 {
+	if x == 0 || math.IsInf(x, 0) || math.IsNaN(x) {
+		return x
+	}
+	p := math.Pow(base, math.Round(math.Log(math.Abs(x))/math.Log(base)))
+	return math.Copysign(p, x)
+}
+
+// SnapToBase returns a copy of the histogram in which every bucket bound is
+// rounded to the nearest power of base (base > 1), unifying bounds that only
+// differ by floating point noise. Buckets whose bounds snap to the same
+// powers are merged into one, so coarse bases can reduce the number of
+// buckets. A bucket whose bounds both snap to the same power would become an
+// empty interval; its count is folded into the next remaining bucket, or the
+// previous one if there is none. Only if no bucket remains is it kept as the
+// closed point [p,p]. The buckets of the result are sorted. Count and Sum are
+// preserved. It returns nil if base is not greater than 1.
+func (s *SampleHistogram) SnapToBase(base float64) *SampleHistogram {
+	if !(base > 1) || math.IsInf(base, 1) {
+		return nil
+	}
+	res := s.copy()
+	for _, b := range res.Buckets {
+		if b == nil {
+			continue
+		}
+		b.Lower = FloatString(snapToPower(float64(b.Lower), base))
+		b.Upper = FloatString(snapToPower(float64(b.Upper), base))
+	}
+	var (
+		kept    HistogramBuckets
+		pending *HistogramBucket
+	)
+	for _, b := range res.sortedBuckets() {
+		if b.Lower == b.Upper && b.Boundaries != 3 {
+			if pending == nil {
+				pending = &HistogramBucket{Boundaries: 3, Lower: b.Lower, Upper: b.Upper}
+			}
+			pending.Lower, pending.Upper = b.Lower, b.Upper
+			pending.addCount(b)
+			continue
+		}
+		if pending != nil {
+			b.addCount(pending)
+			pending = nil
+		}
+		kept = append(kept, b)
+	}
+	switch {
+	case pending == nil || pending.Count == 0:
+	case len(kept) > 0:
+		kept[len(kept)-1].addCount(pending)
+	default:
+		kept = HistogramBuckets{pending}
+	}
+	res.Buckets = kept
+	return res.Dedup()
+}
+
+// DynamicRangeDecades returns the number of decades spanned by the populated
+// buckets, log10(maxUpper/minLower). Only buckets with a positive lower and a
+// finite upper bound are considered. It returns false if there is no such
+// bucket.
+func (s *SampleHistogram) DynamicRangeDecades() (float64, bool) {
+	minLower, maxUpper := math.Inf(1), 0.0
+	for _, b := range s.Buckets {
+		if b == nil || b.Count <= 0 || !(b.Lower > 0) || math.IsInf(float64(b.Upper), 1) {
+			continue
+		}
+		minLower = math.Min(minLower, float64(b.Lower))
+		maxUpper = math.Max(maxUpper, float64(b.Upper))
+	}
+	if math.IsInf(minLower, 1) {
+		return 0, false
+	}
+	return math.Log10(maxUpper / minLower), true
+}
+
+// CountInterval returns an approximate confidence interval for the count of
+// the bucket, treating it as a Poisson variable approximated by a normal
+// distribution: Count ± z*sqrt(Count). For example, z = 1.96 yields a 95%
+// interval. The lower bound is clamped at 0. The approximation is poor for
+// very small counts.
+func (b HistogramBucket) CountInterval(z float64) (lo, hi FloatString) {
+	c := math.Max(float64(b.Count), 0)
+	d := math.Abs(z) * math.Sqrt(c)
+	return FloatString(math.Max(c-d, 0)), FloatString(c + d)
+}
+
+// Project returns a copy of the histogram with Count, Sum and all bucket
+// counts multiplied by growthFactor, forecasting the histogram under uniform
+// traffic growth. The bucket layout, and thus the shape of the distribution,
+// is kept.
+func (s *SampleHistogram) Project(growthFactor float64) *SampleHistogram {
+	res := s.copy()
+	res.Count *= FloatString(growthFactor)
+	res.Sum *= FloatString(growthFactor)
+	for _, b := range res.Buckets {
+		if b != nil {
+			b.Count *= FloatString(growthFactor)
+			b.CountExact = nil
+		}
+	}
+	return res
+}
+
+// TailSumFraction returns the fraction of the value mass of all
+// observations, estimated from the bucket midpoints, that is contributed by
+// observations above threshold. A bucket straddling threshold is narrowed to
+// its part above threshold with its count prorated accordingly. Buckets with
+// an infinite bound count as above threshold if their observations are
+// located above it, see massLocation, so that an overflow bucket at the
+// threshold counts only if it excludes its finite bound. Histograms without
+// value mass yield 0. Negative values are not supported.
+func (s *SampleHistogram) TailSumFraction(threshold FloatString) FloatString {
+	total := s.midpointSum()
+	if total == 0 {
+		return 0
+	}
+	tail, _ := s.tailAbove(threshold)
+	return FloatString(tail / total)
+}
+
+// tailAbove estimates the value mass and the number of the observations
+// above threshold as described for TailSumFraction.
+func (s *SampleHistogram) tailAbove(threshold FloatString) (mass, count float64) {
+	for _, b := range s.Buckets {
+		if b == nil || b.Count == 0 {
+			continue
+		}
+		switch {
+		case b.isPointMass():
+			if p, offset := b.massLocation(); p > float64(threshold) || (p == float64(threshold) && offset > 0) {
+				mass += p * float64(b.Count)
+				count += float64(b.Count)
+			}
+		case b.Lower >= threshold:
+			mass += b.midpoint() * float64(b.Count)
+			count += float64(b.Count)
+		case b.Upper > threshold:
+			part := HistogramBucket{
+				Lower: threshold,
+				Upper: b.Upper,
+				Count: b.Count * (b.Upper - threshold) / (b.Upper - b.Lower),
+			}
+			mass += part.midpoint() * float64(part.Count)
+			count += float64(part.Count)
+		}
+	}
+	return mass, count
+}
+
+// bucketAtRank returns the populated bucket of the sorted buckets holding
+// the observation of the given rank, together with the number of
+// observations in the buckets before it. Ranks beyond the total count fall
+// into the last populated bucket. It returns nil if no bucket is populated.
+func bucketAtRank(buckets HistogramBuckets, rank float64) (*HistogramBucket, float64) {
+	var (
+		cum  float64
+		last *HistogramBucket
+	)
+	for _, b := range buckets {
+		c := float64(b.Count)
+		if c <= 0 {
+			continue
+		}
+		if cum+c >= rank {
+			return b, cum
+		}
+		cum += c
+		last = b
+	}
+	if last != nil {
+		cum -= float64(last.Count)
+	}
+	return last, cum
+}
+
+// QuantileWithError estimates the q-quantile (0 <= q <= 1) of the
+// observations like Quantile and additionally returns the bounds of the
+// bucket holding it. As the observations may be located anywhere within
+// that bucket, the bounds limit the error of the estimation.
+func (s *SampleHistogram) QuantileWithError(q float64) (value, lowerBound, upperBound FloatString, err error) {
+	if !(q >= 0 && q <= 1) {
+		return 0, 0, 0, fmt.Errorf("quantile %v must be in [0,1]", q)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, 0, 0, fmt.Errorf("histogram is empty")
+	}
+	rank := q * total
+	b, cum := bucketAtRank(s.sortedBuckets(), rank)
+	f := math.Min(math.Max(rank-cum, 0)/float64(b.Count), 1)
+	return FloatString(b.valueAt(f)), b.Lower, b.Upper, nil
+}
+
+// ValueAtTopFraction estimates the value above which the given fraction (0
+// <= fraction <= 1) of all observations lies. It is the counterpart of
+// Quantile counted from the top, that is Quantile(1-fraction).
+func (s *SampleHistogram) ValueAtTopFraction(fraction float64) (FloatString, error) {
+	if !(fraction >= 0 && fraction <= 1) {
+		return 0, fmt.Errorf("fraction %v must be in [0,1]", fraction)
+	}
+	return s.Quantile(1 - fraction)
+}
+
+// density returns the count of the bucket per unit of width. Buckets with an
+// infinite or empty width yield 0.
+func (b *HistogramBucket) density() float64 {
+	w := b.width()
+	if !(w > 0) || math.IsInf(w, 1) {
+		return 0
+	}
+	return float64(b.Count) / w
+}
+
+// densestBucket returns the index of the populated bucket of the sorted
+// buckets with the highest density, that is count per unit of width, so
+// that wide buckets do not dominate narrow but denser ones. Buckets with
+// equal bounds are infinitely dense and win over all others. Buckets with an
+// infinite bound are only considered if no other bucket is populated. It
+// returns -1 if no bucket is populated.
+func densestBucket(buckets HistogramBuckets) int {
+	best, unbounded := -1, -1
+	var bestDensity float64
+	for i, b := range buckets {
+		if b.Count <= 0 {
+			continue
+		}
+		w := b.width()
+		if math.IsInf(w, 0) || math.IsNaN(w) {
+			if unbounded < 0 || b.Count > buckets[unbounded].Count {
+				unbounded = i
+			}
+			continue
+		}
+		density := math.Inf(1)
+		if w > 0 {
+			density = float64(b.Count) / w
+		}
+		if best < 0 || density > bestDensity || (density == bestDensity && math.IsInf(density, 1) && b.Count > buckets[best].Count) {
+			best, bestDensity = i, density
+		}
+	}
+	if best < 0 {
+		return unbounded
+	}
+	return best
+}
+
+// ModeValue estimates the most common value of the observations within the
+// densest bucket as chosen by PeakDensityValue. Rather than its midpoint, it
+// returns the peak of the density interpolated from the densities of the
+// adjacent buckets, following the mode formula for grouped data:
+//
+//	lower + (d - dPrev) / ((d - dPrev) + (d - dNext)) * width
+//
+// A missing neighbour has a density of 0, and so does one with an infinite
+// bound. Buckets with equal bounds yield their bound and buckets with an
+// infinite bound their finite bound. It returns false for empty histograms.
+func (s *SampleHistogram) ModeValue() (FloatString, bool) {
+	buckets := s.sortedBuckets()
+	i := densestBucket(buckets)
+	if i < 0 {
+		return 0, false
+	}
+	b := buckets[i]
+	if b.isPointMass() {
+		return FloatString(b.midpoint()), true
+	}
+	var prev, next float64
+	if i > 0 && buckets[i-1].Upper == b.Lower {
+		prev = buckets[i-1].density()
+	}
+	if i < len(buckets)-1 && buckets[i+1].Lower == b.Upper {
+		next = buckets[i+1].density()
+	}
+	d := b.density()
+	d1, d2 := d-prev, d-next
+	if !(d1+d2 > 0) {
+		return FloatString(b.midpoint()), true
+	}
+	return FloatString(float64(b.Lower) + d1/(d1+d2)*b.width()), true
+}
+
+// Median estimates the median of the observations. It is equivalent to
+// Quantile(0.5).
+func (s *SampleHistogram) Median() (FloatString, error) {
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	return FloatString(valueAtRank(s.sortedBuckets(), total/2)), nil
+}
+
+// unitVector returns the counts scaled to a Euclidean norm of 1. It returns
+// false if all counts are 0.
+func unitVector(counts []float64) ([]float64, bool) {
+	var norm float64
+	for _, c := range counts {
+		norm += c * c
+	}
+	if norm == 0 {
+		return nil, false
+	}
+	norm = math.Sqrt(norm)
+	res := make([]float64, len(counts))
+	for i, c := range counts {
+		res[i] = c / norm
+	}
+	return res, true
+}
+
+// ShapeVector rebuckets the histogram onto the intervals between the given
+// edges and returns the resulting counts scaled to a Euclidean norm of 1.
+// Histograms of the same shape thus yield the same vector regardless of
+// their number of observations.
+func (s *SampleHistogram) ShapeVector(edges []FloatString) ([]FloatString, error) {
+	fedges, err := checkEdges(edges)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := unitVector(s.rebucketCounts(fedges))
+	if !ok {
+		return nil, fmt.Errorf("histogram has no observations within the edges")
+	}
+	res := make([]FloatString, len(v))
+	for i, c := range v {
+		res[i] = FloatString(c)
+	}
+	return res, nil
+}
+
+// HistogramCosineSimilarity returns the cosine similarity of the bucket
+// counts of both histograms, which is 1 for distributions of the same shape
+// regardless of their number of observations and 0 for disjoint ones. Both
+// histograms are rebucketed onto the union of their bounds first.
+func HistogramCosineSimilarity(a, b *SampleHistogram) (float64, error) {
+	if a == nil || b == nil {
+		return 0, fmt.Errorf("histogram is nil")
+	}
+	_, counts := alignHistograms(a, b)
+	va, okA := unitVector(counts[0])
+	vb, okB := unitVector(counts[1])
+	if !okA || !okB {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	var dot float64
+	for i := range va {
+		dot += va[i] * vb[i]
+	}
+	// Rounding errors must not push the result beyond 1.
+	return math.Min(dot, 1), nil
+}
+
+// maxP2Observations limits the number of observations fed into the P²
+// estimator by P2Quantile.
+const maxP2Observations = 10000
+
+// P2Quantile estimates the q-quantile (0 <= q <= 1) of the observations with
+// the P² streaming algorithm by Jain and Chlamtac, as a reference for
+// validating streaming quantile estimators against the histogram. The
+// estimator is fed with observations located at the bucket midpoints, as
+// many per bucket as its count, up to maxP2Observations in total with the
+// counts scaled down proportionally. The observations are fed in a
+// deterministic but well-mixed order. On smooth distributions with many
+// observations, the result is usually within the width of the bucket
+// holding the quantile of the interpolated Quantile.
+func (s *SampleHistogram) P2Quantile(q float64) (FloatString, error) {
+	if !(q >= 0 && q <= 1) {
+		return 0, fmt.Errorf("quantile %v must be in [0,1]", q)
+	}
+	var (
+		buckets HistogramBuckets
+		cum     []float64
+		total   float64
+	)
+	for _, b := range s.sortedBuckets() {
+		if b.Count > 0 {
+			total += float64(b.Count)
+			buckets = append(buckets, b)
+			cum = append(cum, total)
+		}
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	switch q {
+	case 0:
+		return FloatString(buckets[0].midpoint()), nil
+	case 1:
+		return FloatString(buckets[len(buckets)-1].midpoint()), nil
+	}
+
+	n := int(math.Round(math.Min(math.Max(total, 5), maxP2Observations)))
+	// The golden ratio sequence visits the ranks in an order spreading
+	// consecutive observations over the whole distribution.
+	observation := func(i int) float64 {
+		_, frac := math.Modf(float64(i) * math.Phi)
+		j := sort.SearchFloat64s(cum, frac*total)
+		if j >= len(buckets) {
+			j = len(buckets) - 1
+		}
+		return buckets[j].midpoint()
+	}
+	p2 := newP2Estimator(q)
+	for i := 0; i < n; i++ {
+		p2.add(observation(i))
+	}
+	return FloatString(p2.quantile()), nil
+}
+
+// p2Estimator implements the P² algorithm for estimating a quantile of a
+// stream of observations with five markers and constant memory.
+type p2Estimator struct {
+	p       float64
+	count   int
+	heights [5]float64
+	pos     [5]float64
+	desired [5]float64
+	incr    [5]float64
+}
+
+func newP2Estimator(p float64) *p2Estimator {
+	return &p2Estimator{
+		p:       p,
+		pos:     [5]float64{1, 2, 3, 4, 5},
+		desired: [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5},
+		incr:    [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+func (e *p2Estimator) add(x float64) {
+	if e.count < 5 {
+		e.heights[e.count] = x
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.heights[:])
+		}
+		return
+	}
+	e.count++
+
+	h := &e.heights
+	var k int
+	switch {
+	case x < h[0]:
+		h[0] = x
+		k = 0
+	case x >= h[4]:
+		h[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3 && x >= h[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.desired {
+		e.desired[i] += e.incr[i]
+	}
+
+	n := &e.pos
+	for i := 1; i <= 3; i++ {
+		d := e.desired[i] - n[i]
+		if (d >= 1 && n[i+1]-n[i] > 1) || (d <= -1 && n[i-1]-n[i] < -1) {
+			d = math.Copysign(1, d)
+			// Piecewise-parabolic prediction of the new marker height,
+			// falling back to linear if it breaks the marker order.
+			hp := h[i] + d/(n[i+1]-n[i-1])*((n[i]-n[i-1]+d)*(h[i+1]-h[i])/(n[i+1]-n[i])+
+				(n[i+1]-n[i]-d)*(h[i]-h[i-1])/(n[i]-n[i-1]))
+			if !(h[i-1] < hp && hp < h[i+1]) {
+				j := i + int(d)
+				hp = h[i] + d*(h[j]-h[i])/(n[j]-n[i])
+			}
+			h[i] = hp
+			n[i] += d
+		}
+	}
+}
+
+// quantile returns the current estimation. With fewer than five
+// observations, the nearest observation by rank is returned.
+func (e *p2Estimator) quantile() float64 {
+	if e.count >= 5 {
+		return e.heights[2]
+	}
+	sorted := append([]float64(nil), e.heights[:e.count]...)
+	sort.Float64s(sorted)
+	return sorted[int(math.Round(e.p*float64(len(sorted)-1)))]
+}
+
+// PopulatedExtent returns the indices of the first and the last bucket, in
+// stored order, holding a non-zero count. It returns false if no bucket does.
+func (s *SampleHistogram) PopulatedExtent() (first, last int, ok bool) {
+	first = -1
+	for i, b := range s.Buckets {
+		if b == nil || b.Count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+	if first < 0 {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// CombineHistograms combines the histograms bucket by bucket, with the count
+// of every bucket determined by applying reduce to the counts of all
+// histograms in it, in the order of hists. This generalizes adding up
+// histograms to other aggregations like taking the maximum. Histograms with
+// different schemas are rebucketed onto the union of their bounds first.
+// Nil histograms are skipped. Count is the total of the combined bucket
+// counts. Sum cannot be derived from the bucket counts of an arbitrary
+// aggregation and is left zero for the caller to fill in.
+func CombineHistograms(hists []*SampleHistogram, reduce func(counts []FloatString) FloatString) (*SampleHistogram, error) {
+	if reduce == nil {
+		return nil, fmt.Errorf("reduce function is nil")
+	}
+	var nonNil []*SampleHistogram
+	for _, h := range hists {
+		if h != nil {
+			nonNil = append(nonNil, h)
+		}
+	}
+	if len(nonNil) == 0 {
+		return nil, fmt.Errorf("no histograms to combine")
+	}
+	layout, counts := alignHistograms(nonNil...)
+	res := &SampleHistogram{Buckets: layout}
+	bucketCounts := make([]FloatString, len(nonNil))
+	for j, b := range layout {
+		for i := range nonNil {
+			bucketCounts[i] = FloatString(counts[i][j])
+		}
+		b.Count = reduce(bucketCounts)
+		res.Count += b.Count
+	}
+	return res, nil
+}
+
+// BoxPlot returns the five-number summary of the observations for rendering
+// box plots: the lowest lower and the highest upper bound of the populated
+// buckets, and the estimated quartiles in between.
+func (s *SampleHistogram) BoxPlot() (min, q1, median, q3, max FloatString, err error) {
+	buckets := s.sortedBuckets()
+	var (
+		total float64
+		seen  bool
+	)
+	for _, b := range buckets {
+		if b.Count <= 0 {
+			continue
+		}
+		if !seen || b.Lower < min {
+			min = b.Lower
+		}
+		if !seen || b.Upper > max {
+			max = b.Upper
+		}
+		seen = true
+		total += float64(b.Count)
+	}
+	if total <= 0 {
+		return 0, 0, 0, 0, 0, fmt.Errorf("histogram is empty")
+	}
+	v := valuesAtRanks(buckets, []float64{total / 4, total / 2, total * 3 / 4})
+	return min, FloatString(v[0]), FloatString(v[1]), FloatString(v[2]), max, nil
+}
+
+// maxExactCount is the largest integer that a float64 represents exactly
+// without any other integer rounding to it.
+const maxExactCount = 1<<53 - 1
+
+// ExactCount returns the count of the bucket as an exact integer and true.
+// If CountExact is set and rounds to Count, a copy of it is returned.
+// Otherwise, the count is only exact if Count is integral and within
+// ±(2^53-1), where a float64 holds integers exactly. In all other cases the
+// count is rounded to the nearest integer and false is returned, as it may
+// have lost precision already. Counts that are infinite or NaN yield nil and
+// false.
+func (b *HistogramBucket) ExactCount() (*big.Int, bool) {
+	if b.CountExact != nil {
+		if f, _ := new(big.Float).SetInt(b.CountExact).Float64(); f == float64(b.Count) {
+			return new(big.Int).Set(b.CountExact), true
+		}
+	}
+	c := float64(b.Count)
+	if math.IsInf(c, 0) || math.IsNaN(c) {
+		return nil, false
+	}
+	r := math.Round(c)
+	i, _ := big.NewFloat(r).Int(nil)
+	return i, r == c && math.Abs(c) <= maxExactCount
+}
+
+// SmoothedDensity returns a kernel density estimation of the observations
+// for rendering them as a smooth curve. The observations of every bucket are
+// located at its midpoint and spread by a Gaussian kernel with the given
+// bandwidth as standard deviation. The curve is sampled at points evenly
+// spaced x values from three bandwidths below the lowest to three bandwidths
+// above the highest populated midpoint, so that the area below it is close
+// to the total count. The density y values are in observations per unit.
+// It returns nil slices if points is less than 2, bandwidth is not positive,
+// or the histogram is empty.
+func (s *SampleHistogram) SmoothedDensity(points int, bandwidth float64) ([]FloatString, []FloatString) {
+	if points < 2 || !(bandwidth > 0) || math.IsInf(bandwidth, 1) {
+		return nil, nil
+	}
+	var mids, counts []float64
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, b := range s.Buckets {
+		if b == nil || b.Count <= 0 {
+			continue
+		}
+		m := b.midpoint()
+		mids = append(mids, m)
+		counts = append(counts, float64(b.Count))
+		lo, hi = math.Min(lo, m), math.Max(hi, m)
+	}
+	if len(mids) == 0 {
+		return nil, nil
+	}
+	lo, hi = lo-3*bandwidth, hi+3*bandwidth
+	step := (hi - lo) / float64(points-1)
+	norm := 1 / (bandwidth * math.Sqrt(2*math.Pi))
+
+	xs := make([]FloatString, points)
+	ys := make([]FloatString, points)
+	for i := range xs {
+		x := lo + float64(i)*step
+		var y float64
+		for j, m := range mids {
+			u := (x - m) / bandwidth
+			y += counts[j] * norm * math.Exp(-u*u/2)
+		}
+		xs[i], ys[i] = FloatString(x), FloatString(y)
+	}
+	return xs, ys
+}
+
+// DetectInternalReset checks the consistency of the bucket counts with the
+// total count. It returns the index of the first bucket, in stored order, at
+// which the cumulative bucket count exceeds Count, and true if there is such
+// a bucket, which indicates a corrupted histogram, for example one partially
+// updated across a counter reset.
+func (s *SampleHistogram) DetectInternalReset() (int, bool) {
+	var cum FloatString
+	for i, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		cum += b.Count
+		if cum > s.Count {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// QuantileTable holds precomputed quantiles of a histogram for fast
+// repeated lookups.
+type QuantileTable struct {
+	// values[k] is the k/(len(values)-1)-quantile.
+	values []float64
+}
+
+// BuildQuantileTable precomputes the given number of quantiles, evenly
+// spaced from the 0- to the 1-quantile, in a single walk over the buckets.
+// It returns nil if resolution is less than 2 or the histogram is empty.
+func (s *SampleHistogram) BuildQuantileTable(resolution int) *QuantileTable {
+	total := s.bucketTotal()
+	if resolution < 2 || total <= 0 {
+		return nil
+	}
+	ranks := make([]float64, resolution)
+	for k := range ranks {
+		ranks[k] = total * float64(k) / float64(resolution-1)
+	}
+	return &QuantileTable{values: valuesAtRanks(s.sortedBuckets(), ranks)}
+}
+
+// Lookup returns the q-quantile (0 <= q <= 1), interpolating linearly
+// between the adjacent precomputed quantiles. The result approximates
+// Quantile more closely the higher the resolution of the table is. Invalid
+// quantiles and nil tables yield NaN.
+func (t *QuantileTable) Lookup(q float64) FloatString {
+	if t == nil || !(q >= 0 && q <= 1) {
+		return FloatString(math.NaN())
+	}
+	pos := q * float64(len(t.values)-1)
+	k := int(pos)
+	if k >= len(t.values)-1 {
+		return FloatString(t.values[len(t.values)-1])
+	}
+	f := pos - float64(k)
+	return FloatString(t.values[k] + f*(t.values[k+1]-t.values[k]))
+}
+
+// ProbExceeds returns the estimated probability that an observation drawn
+// from the distribution of the histogram exceeds x, that is 1-CDF(x).
+// Empty histograms yield 0.
+func (s *SampleHistogram) ProbExceeds(x FloatString) FloatString {
+	if s.bucketTotal() <= 0 {
+		return 0
+	}
+	return FloatString(math.Min(math.Max(1-float64(s.CDF(x)), 0), 1))
+}
+
+// SurvivalCurve samples the survival function of the observations, 1-CDF(x),
+// at points evenly spaced x values from the lowest to the highest value of
+// the populated buckets, where buckets with an infinite bound contribute
+// their finite bound. The y values decrease monotonically to 0, or to the
+// fraction of observations in an overflow bucket above the highest value.
+// They start at 1 unless observations are located at the lowest value. It
+// returns nil slices if points is less than 2 or the histogram is empty.
+func (s *SampleHistogram) SurvivalCurve(points int) ([]FloatString, []FloatString) {
+	if points < 2 || s.bucketTotal() <= 0 {
+		return nil, nil
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, b := range s.Buckets {
+		if b == nil || b.Count <= 0 {
+			continue
+		}
+		if b.isPointMass() {
+			lo, hi = math.Min(lo, b.midpoint()), math.Max(hi, b.midpoint())
+			continue
+		}
+		lo, hi = math.Min(lo, float64(b.Lower)), math.Max(hi, float64(b.Upper))
+	}
+	step := (hi - lo) / float64(points-1)
+	xs := make([]FloatString, points)
+	ys := make([]FloatString, points)
+	for i := range xs {
+		x := lo + float64(i)*step
+		if i == points-1 {
+			x = hi
+		}
+		xs[i] = FloatString(x)
+		ys[i] = s.ProbExceeds(xs[i])
+	}
+	return xs, ys
+}
+
+// QuantileAgreement returns the largest relative difference between the
+// quantiles of b and those of the reference histogram a over all given
+// quantiles, |Qb(q) - Qa(q)| / |Qa(q)|. Where the quantile of a is 0, any
+// difference counts as infinitely large.
+func QuantileAgreement(a, b *SampleHistogram, qs []float64) (maxRelErr float64, err error) {
+	if a == nil || b == nil {
+		return 0, fmt.Errorf("histogram is nil")
+	}
+	if len(qs) == 0 {
+		return 0, fmt.Errorf("no quantiles given")
+	}
+	for _, q := range qs {
+		if !(q >= 0 && q <= 1) {
+			return 0, fmt.Errorf("quantile %v must be in [0,1]", q)
+		}
+	}
+	if a.bucketTotal() <= 0 || b.bucketTotal() <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	for _, q := range qs {
+		qa, _ := a.Quantile(q)
+		qb, _ := b.Quantile(q)
+		rel := math.Abs(relativeChange(float64(qb), float64(qa)))
+		maxRelErr = math.Max(maxRelErr, rel)
+	}
+	return maxRelErr, nil
+}
+
+// HarmonicMean estimates the harmonic mean of the observations from the
+// count-weighted bucket midpoints. It is only defined if every populated
+// bucket has a positive midpoint.
+func (s *SampleHistogram) HarmonicMean() (FloatString, error) {
+	var total, reciprocals float64
+	for _, b := range s.Buckets {
+		if b == nil || b.Count <= 0 {
+			continue
+		}
+		m := b.midpoint()
+		if m <= 0 {
+			return 0, fmt.Errorf("bucket %v has non-positive midpoint %v", b, m)
+		}
+		total += float64(b.Count)
+		reciprocals += float64(b.Count) / m
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	return FloatString(total / reciprocals), nil
+}
+
+// GeometricMean estimates the geometric mean of the observations from the
+// count-weighted bucket midpoints. Like HarmonicMean, it is only defined if
+// every populated bucket has a positive midpoint.
+func (s *SampleHistogram) GeometricMean() (FloatString, error) {
+	var total, logSum float64
+	for _, b := range s.Buckets {
+		if b == nil || b.Count <= 0 {
+			continue
+		}
+		m := b.midpoint()
+		if m <= 0 {
+			return 0, fmt.Errorf("bucket %v has non-positive midpoint %v", b, m)
+		}
+		total += float64(b.Count)
+		logSum += float64(b.Count) * math.Log(m)
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	return FloatString(math.Exp(logSum / total)), nil
+}
+
+// EqualCountEdges returns the n+1 edges that split the observations into n
+// groups of roughly equal count. The first and last edge are the estimated
+// minimum and maximum.
+func (s *SampleHistogram) EqualCountEdges(n int) ([]FloatString, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("number of groups %d must be at least 1", n)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return nil, fmt.Errorf("histogram is empty")
+	}
+	ranks := make([]float64, n+1)
+	for i := range ranks {
+		ranks[i] = float64(i) / float64(n) * total
+	}
+	edges := make([]FloatString, n+1)
+	for i, v := range valuesAtRanks(s.sortedBuckets(), ranks) {
+		edges[i] = FloatString(v)
+	}
+	return edges, nil
+}
+
+// BucketZScores scores how far the count of every bucket deviates from the
+// baseline, (count - baselineCount) / sqrt(baselineCount), treating the
+// baseline counts as the expected values of Poisson-distributed counts. The
+// histogram is rebucketed onto the baseline's schema first, see AlignTo.
+// Scores are keyed by the interval notation of the bucket, as in "(0,1]".
+// Buckets that are empty in the baseline score 0 if they are empty as well
+// and +Inf otherwise.
+func (s *SampleHistogram) BucketZScores(baseline *SampleHistogram) (map[string]float64, error) {
+	aligned, err := s.AlignTo(baseline)
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[string]float64, len(baseline.Buckets))
+	for i, b := range baseline.Buckets {
+		if b == nil {
+			continue
+		}
+		expected, observed := float64(b.Count), float64(aligned.Buckets[i].Count)
+		switch {
+		case expected > 0:
+			scores[b.interval()] = (observed - expected) / math.Sqrt(expected)
+		case observed > 0:
+			scores[b.interval()] = math.Inf(1)
+		default:
+			scores[b.interval()] = 0
+		}
+	}
+	return scores, nil
+}
+
+// logValueAt is like valueAt, but interpolates geometrically between the
+// bounds of buckets with a positive lower bound, as if the logarithms of the
+// observations were distributed uniformly. Other buckets are interpolated
+// linearly.
+func (b *HistogramBucket) logValueAt(f float64) float64 {
+	lower, upper := float64(b.Lower), float64(b.Upper)
+	if lower <= 0 || math.IsInf(upper, 1) {
+		return b.valueAt(f)
+	}
+	return math.Exp(math.Log(lower) + f*(math.Log(upper)-math.Log(lower)))
+}
+
+// LogQuantile estimates the q-quantile (0 <= q <= 1) of the observations
+// like Quantile, but interpolates in log space within buckets whose bounds
+// are both positive and finite. For log-normally distributed observations,
+// such as latencies, this is less biased towards the upper bound of the
+// bucket. Other buckets are interpolated linearly.
+func (s *SampleHistogram) LogQuantile(q float64) (FloatString, error) {
+	if !(q >= 0 && q <= 1) {
+		return 0, fmt.Errorf("quantile %v must be in [0,1]", q)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, fmt.Errorf("histogram is empty")
+	}
+	rank := q * total
+	b, cum := bucketAtRank(s.sortedBuckets(), rank)
+	f := math.Min(math.Max(rank-cum, 0)/float64(b.Count), 1)
+	return FloatString(b.logValueAt(f)), nil
+}
+
+// minQuantizationBuckets is the smallest number of buckets between the first
+// and the last populated one that DetectQuantization needs to judge the
+// shape of the distribution.
+const minQuantizationBuckets = 5
+
+// DetectQuantization reports whether the observations look like they were
+// rounded to a coarser grid before being bucketed. Rounded values pile up in
+// the buckets next to the grid points while the buckets in between stay
+// (nearly) empty, so that the counts alternate between high and low instead
+// of varying smoothly. The returned confidence between 0 and 1 is the
+// product of two measures over the buckets strictly inside the populated
+// range:
+//
+//   - the fraction of them that are local extremes, that is with a count
+//     above both or below both of their neighbours, and
+//   - their roughness, Σ|c - e| / Σ(c + e), where c is the count of a bucket
+//     and e the average count of its neighbours.
+//
+// A perfect sawtooth yields 1, while smooth distributions, including sharply
+// peaked ones, yield values close to 0. Quantization is reported if the
+// confidence exceeds 0.5. Histograms with fewer than 5 buckets from the
+// first to the last populated one are never reported.
+func (s *SampleHistogram) DetectQuantization() (bool, float64) {
+	buckets := s.sortedBuckets()
+	first, last := -1, -1
+	for i, b := range buckets {
+		if b.Count > 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 || last-first+1 < minQuantizationBuckets {
+		return false, 0
+	}
+
+	var extremes, deviation, mass float64
+	for i := first + 1; i < last; i++ {
+		prev, c, next := float64(buckets[i-1].Count), float64(buckets[i].Count), float64(buckets[i+1].Count)
+		if (c > prev && c > next) || (c < prev && c < next) {
+			extremes++
+		}
+		e := (prev + next) / 2
+		deviation += math.Abs(c - e)
+		mass += c + e
+	}
+	interior := float64(last - first - 1)
+	confidence := extremes / interior * deviation / mass
+	return confidence > 0.5, confidence
+}
+
+// EstimatedSum estimates the sum of all observations from the bucket
+// midpoints weighted by their counts, independently of Sum. Buckets with one
+// infinite bound contribute their finite bound. Comparing the estimate with
+// Sum reveals producers reporting inconsistent sums.
+func (s *SampleHistogram) EstimatedSum() FloatString {
+	return FloatString(s.midpointSum())
+}
+
+// PeakDensityValue returns the midpoint of the bucket with the highest
+// density, that is count per unit of width, so that wide buckets do not
+// dominate narrow but denser ones. Buckets with equal bounds are infinitely
+// dense and win over all others. Buckets with an infinite bound are only
+// considered if no other bucket is populated and yield their finite bound.
+// It returns false for empty histograms. See ModeValue for an estimate
+// within the bucket.
+func (s *SampleHistogram) PeakDensityValue() (FloatString, bool) {
+	buckets := s.sortedBuckets()
+	i := densestBucket(buckets)
+	if i < 0 {
+		return 0, false
+	}
+	return FloatString(buckets[i].midpoint()), true
+}
+
+// ConditionalMeanAbove estimates the mean of the observations above
+// threshold from the bucket midpoints, answering how large observations are
+// on average once they exceed it. A bucket straddling threshold contributes
+// its part above threshold with its count prorated accordingly.
+func (s *SampleHistogram) ConditionalMeanAbove(threshold FloatString) (FloatString, error) {
+	mass, count := s.tailAbove(threshold)
+	if count <= 0 {
+		return 0, fmt.Errorf("no observations above %v", threshold)
+	}
+	return FloatString(mass / count), nil
+}
+
+// EquivalentTo reports whether both histograms describe the same
+// distribution of observations, however their buckets are split or merged.
+// Both are rebucketed onto the union of their bounds, assuming observations
+// are distributed uniformly within each bucket, and the resulting counts
+// must not differ by more than epsilon. Count and Sum are not compared.
+func (s *SampleHistogram) EquivalentTo(o *SampleHistogram, epsilon float64) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	_, counts := alignHistograms(s, o)
+	for i, c := range counts[0] {
+		if math.Abs(c-counts[1][i]) > epsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// OutlierFences returns Tukey's fences Q1 - k*IQR and Q3 + k*IQR, where Q1
+// and Q3 are the first and third quartile and IQR is their distance.
+// Observations beyond the fences are considered outliers, with k commonly
+// set to 1.5. A negative lower fence below the estimated minimum of the
+// observations is raised to that minimum, so that non-negative
+// observations such as latencies do not yield meaningless negative fences.
+func (s *SampleHistogram) OutlierFences(k float64) (lowerFence, upperFence FloatString, err error) {
+	if !(k >= 0) {
+		return 0, 0, fmt.Errorf("fence factor %v must not be negative", k)
+	}
+	total := s.bucketTotal()
+	if total <= 0 {
+		return 0, 0, fmt.Errorf("histogram is empty")
+	}
+	v := valuesAtRanks(s.sortedBuckets(), []float64{0, total / 4, total * 3 / 4})
+	min, q1, q3 := v[0], v[1], v[2]
+	lower, upper := q1-k*(q3-q1), q3+k*(q3-q1)
+	if lower < 0 && lower < min {
+		lower = min
+	}
+	return FloatString(lower), FloatString(upper), nil
+}
+
+// EmptyBucketFraction returns the fraction of the buckets that hold no
+// observations. A high fraction indicates a bucket layout that is too fine
+// for the range of the observations. Nil buckets are not counted, and
+// histograms without buckets yield 0.
+func (s *SampleHistogram) EmptyBucketFraction() float64 {
+	var empty, total int
+	for _, b := range s.Buckets {
+		if b == nil {
+			continue
+		}
+		if b.Count == 0 {
+			empty++
+		}
+		total++
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(empty) / float64(total)
+}
+
+// BlendHistograms returns the weighted mixture wa*a + wb*b of the two
+// histograms, bucket by bucket and for Count and Sum alike, for instance to
+// model the distribution after shifting part of the traffic from one backend
+// to another. The weights must not be negative but need not add up to 1.
+// Histograms with different schemas are rebucketed onto the union of their
+// bounds first.
+func BlendHistograms(a *SampleHistogram, wa float64, b *SampleHistogram, wb float64) (*SampleHistogram, error) {
+	if a == nil || b == nil {
+		return nil, fmt.Errorf("histogram is nil")
+	}
+	if !(wa >= 0) || !(wb >= 0) {
+		return nil, fmt.Errorf("weights %v and %v must not be negative", wa, wb)
+	}
+	layout, counts := alignHistograms(a, b)
+	for j, bucket := range layout {
+		bucket.Count = FloatString(wa*counts[0][j] + wb*counts[1][j])
+	}
+	return &SampleHistogram{
+		Count:   FloatString(wa*float64(a.Count) + wb*float64(b.Count)),
+		Sum:     FloatString(wa*float64(a.Sum) + wb*float64(b.Sum)),
+		Buckets: layout,
+	}, nil
+}
@@ -0,0 +1,2739 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+// genLinearHistogram returns a histogram with upper-inclusive buckets
+// spanning consecutive edges and holding the given counts.
+func genLinearHistogram(edges []float64, counts ...float64) *SampleHistogram {
+	h := &SampleHistogram{}
+	for i, c := range counts {
+		h.Buckets = append(h.Buckets, &HistogramBucket{
+			Lower: FloatString(edges[i]),
+			Upper: FloatString(edges[i+1]),
+			Count: FloatString(c),
+		})
+		h.Count += FloatString(c)
+	}
+	return h
+}
+
+func almostEqual(a, b, epsilon float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= epsilon
+}
+
+func TestSampleHistogramTrimmedMean(t *testing.T) {
+	tests := []struct {
+		h        *SampleHistogram
+		trim     float64
+		expected float64
+	}{
+		{
+			h:        genLinearHistogram([]float64{0, 1, 2, 3}, 10, 80, 10),
+			trim:     0,
+			expected: 1.5,
+		},
+		{
+			h:        genLinearHistogram([]float64{0, 1, 2, 3}, 10, 80, 10),
+			trim:     0.1,
+			expected: 1.5,
+		},
+		{
+			// The middle half lies within the last bucket, between 2.5 and 7.5.
+			h:        genLinearHistogram([]float64{0, 1, 2, 10}, 10, 10, 80),
+			trim:     0.25,
+			expected: 5,
+		},
+	}
+
+	for i, test := range tests {
+		got, err := test.h.TrimmedMean(test.trim)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	for _, trim := range []float64{-0.1, 0.5, math.NaN()} {
+		if _, err := genLinearHistogram([]float64{0, 1}, 1).TrimmedMean(trim); err == nil {
+			t.Errorf("expected error for trim fraction %v", trim)
+		}
+	}
+	if _, err := (&SampleHistogram{}).TrimmedMean(0.1); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramAdd(t *testing.T) {
+	a := genLinearHistogram([]float64{0, 1, 2}, 1, 2)
+	a.Sum = 3
+	b := genLinearHistogram([]float64{0, 1, 2}, 3, 4)
+	b.Sum = 7
+
+	got, err := a.Add(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := genLinearHistogram([]float64{0, 1, 2}, 4, 6)
+	expected.Sum = 10
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := a.Add(genLinearHistogram([]float64{0, 2}, 1)); err == nil {
+		t.Error("expected error for incompatible schemas")
+	}
+	if _, err := a.Add(nil); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+	if _, err := (*SampleHistogram)(nil).Add(a); err == nil {
+		t.Error("expected error for nil receiver")
+	}
+}
+
+func TestAddHistogramVectors(t *testing.T) {
+	a := Vector{
+		{Metric: Metric{"job": "a"}, Timestamp: 1, Histogram: genLinearHistogram([]float64{0, 1}, 1)},
+		{Metric: Metric{"job": "b"}, Timestamp: 1, Histogram: genLinearHistogram([]float64{0, 1}, 2)},
+		{Metric: Metric{"job": "c"}, Timestamp: 1, Value: 1},
+	}
+	b := Vector{
+		{Metric: Metric{"job": "b"}, Timestamp: 1, Histogram: genLinearHistogram([]float64{0, 1}, 5)},
+		{Metric: Metric{"job": "c"}, Timestamp: 1, Histogram: genLinearHistogram([]float64{0, 1}, 1)},
+		{Metric: Metric{"job": "d"}, Timestamp: 1, Histogram: genLinearHistogram([]float64{0, 1}, 1)},
+	}
+
+	got, err := AddHistogramVectors(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Vector{
+		{Metric: Metric{"job": "b"}, Timestamp: 1, Histogram: genLinearHistogram([]float64{0, 1}, 7)},
+	}
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	b[0].Histogram = genLinearHistogram([]float64{0, 2}, 5)
+	if _, err := AddHistogramVectors(a, b); err == nil {
+		t.Error("expected error for incompatible schemas")
+	}
+}
+
+func TestSampleHistogramDominantRange(t *testing.T) {
+	tests := []struct {
+		h        *SampleHistogram
+		fraction float64
+		lo, hi   float64
+	}{
+		{
+			h:        genLinearHistogram([]float64{0, 1, 2, 3}, 10, 80, 10),
+			fraction: 0.8,
+			lo:       1,
+			hi:       2,
+		},
+		{
+			h:        genLinearHistogram([]float64{0, 1, 2, 3}, 10, 80, 10),
+			fraction: 1,
+			lo:       0,
+			hi:       3,
+		},
+		{
+			h:        genLinearHistogram([]float64{0, 10, 11}, 50, 50),
+			fraction: 0.5,
+			lo:       10,
+			hi:       11,
+		},
+		{
+			// The missing 10 observations are cheapest to take from the
+			// denser bucket on the right.
+			h:        genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50),
+			fraction: 0.5,
+			lo:       1,
+			hi:       2.4,
+		},
+		{
+			// Same as above, but mirrored.
+			h:        genLinearHistogram([]float64{-4, -2, -1, 0}, 50, 40, 10),
+			fraction: 0.5,
+			lo:       -2.4,
+			hi:       -1,
+		},
+	}
+
+	for i, test := range tests {
+		lo, hi, err := test.h.DominantRange(test.fraction)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !almostEqual(float64(lo), test.lo, 1e-9) || !almostEqual(float64(hi), test.hi, 1e-9) {
+			t.Errorf("%d: expected [%v,%v], got [%v,%v]", i, test.lo, test.hi, lo, hi)
+		}
+	}
+
+	for _, fraction := range []float64{0, -1, 1.1, math.NaN()} {
+		if _, _, err := genLinearHistogram([]float64{0, 1}, 1).DominantRange(fraction); err == nil {
+			t.Errorf("expected error for fraction %v", fraction)
+		}
+	}
+	if _, _, err := (&SampleHistogram{}).DominantRange(0.5); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramSignedDelta(t *testing.T) {
+	a := genLinearHistogram([]float64{0, 1, 2}, 5, 2)
+	a.Sum = 6
+	b := genLinearHistogram([]float64{0, 1, 2}, 3, 4)
+	b.Sum = 7
+
+	got, err := a.SignedDelta(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SampleHistogram{
+		Count: 0,
+		Sum:   -1,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 1, Count: 2},
+			{Lower: 1, Upper: 2, Count: -2},
+		},
+	}
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Different schemas are reconciled on the union of their bounds.
+	c := genLinearHistogram([]float64{0, 2, 4}, 4, 2)
+	got, err = a.SignedDelta(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &SampleHistogram{
+		Count: 1,
+		Sum:   6,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 1, Count: 3},
+			{Lower: 1, Upper: 2, Count: 0},
+			{Lower: 2, Upper: 4, Count: -2},
+		},
+	}
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Overflow buckets stay above their finite bound.
+	inf := math.Inf(1)
+	d := genLinearHistogram([]float64{0, 5, 10, inf}, 1, 2, 3)
+	e := genLinearHistogram([]float64{0, 10, inf}, 1, 1)
+	got, err = d.SignedDelta(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &SampleHistogram{
+		Count: 4,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 5, Count: 0.5},
+			{Lower: 5, Upper: 10, Count: 1.5},
+			{Lower: 10, Upper: FloatString(inf), Count: 2},
+		},
+	}
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := a.SignedDelta(nil); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+}
+
+func TestSampleHistogramDedup(t *testing.T) {
+	h := &SampleHistogram{
+		Count: 6,
+		Sum:   9,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 1, Count: 1},
+			{Lower: 1, Upper: 2, Count: 2},
+			{Lower: 0, Upper: 1, Count: 2},
+			{Boundaries: 3, Lower: 1, Upper: 2, Count: 1},
+		},
+	}
+	expected := &SampleHistogram{
+		Count: 6,
+		Sum:   9,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 1, Count: 3},
+			{Lower: 1, Upper: 2, Count: 2},
+			{Boundaries: 3, Lower: 1, Upper: 2, Count: 1},
+		},
+	}
+	if got := h.Dedup(); !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if h.Buckets[0].Count != 1 || len(h.Buckets) != 4 {
+		t.Errorf("receiver was modified: %v", h)
+	}
+}
+
+func TestSampleHistogramQuantile(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50)
+	tests := []struct {
+		q        float64
+		expected float64
+	}{
+		{q: 0, expected: 0},
+		{q: 0.05, expected: 0.5},
+		{q: 0.1, expected: 1},
+		{q: 0.5, expected: 2},
+		{q: 0.75, expected: 3},
+		{q: 1, expected: 4},
+	}
+	for _, test := range tests {
+		got, err := h.Quantile(test.q)
+		if err != nil {
+			t.Errorf("q=%v: unexpected error: %s", test.q, err)
+			continue
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("q=%v: expected %v, got %v", test.q, test.expected, got)
+		}
+	}
+
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := h.Quantile(q); err == nil {
+			t.Errorf("expected error for quantile %v", q)
+		}
+	}
+	if _, err := (&SampleHistogram{}).Quantile(0.5); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramCDF(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50)
+	tests := []struct {
+		x        FloatString
+		expected float64
+	}{
+		{x: -1, expected: 0},
+		{x: 0.5, expected: 0.05},
+		{x: 2, expected: 0.5},
+		{x: 3, expected: 0.75},
+		{x: 10, expected: 1},
+	}
+	for _, test := range tests {
+		if got := h.CDF(test.x); !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("x=%v: expected %v, got %v", test.x, test.expected, got)
+		}
+	}
+	if got := (&SampleHistogram{}).CDF(1); got != 0 {
+		t.Errorf("expected 0 for empty histogram, got %v", got)
+	}
+
+	// Buckets with an infinite bound follow the boundary rule at their
+	// finite bound.
+	inf := FloatString(math.Inf(1))
+	for _, test := range []struct {
+		bucket   *HistogramBucket
+		x        FloatString
+		expected float64
+	}{
+		{bucket: &HistogramBucket{Boundaries: 0, Lower: 10, Upper: inf, Count: 3}, x: 10, expected: 0.25},
+		{bucket: &HistogramBucket{Boundaries: 2, Lower: 10, Upper: inf, Count: 3}, x: 10, expected: 0.25},
+		{bucket: &HistogramBucket{Boundaries: 1, Lower: 10, Upper: inf, Count: 3}, x: 10, expected: 1},
+		{bucket: &HistogramBucket{Boundaries: 0, Lower: 10, Upper: inf, Count: 3}, x: 10.5, expected: 1},
+		{bucket: &HistogramBucket{Boundaries: 0, Lower: -inf, Upper: 0, Count: 3}, x: 0, expected: 0.75},
+		{bucket: &HistogramBucket{Boundaries: 1, Lower: -inf, Upper: 0, Count: 3}, x: 0, expected: 0.75},
+		{bucket: &HistogramBucket{Boundaries: 0, Lower: -inf, Upper: 0, Count: 3}, x: -0.5, expected: 0},
+	} {
+		h := &SampleHistogram{Buckets: HistogramBuckets{{Lower: 0, Upper: 10, Count: 1}, test.bucket}}
+		if got := h.CDF(test.x); !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%v, x=%v: expected %v, got %v", test.bucket, test.x, test.expected, got)
+		}
+	}
+}
+
+func TestSampleHistogramCenterOfMassQuantile(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50)
+	h.Sum = 250 // A mean of 2.5.
+
+	got, err := h.CenterOfMassQuantile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !almostEqual(got, 0.625, 1e-9) {
+		t.Errorf("expected 0.625, got %v", got)
+	}
+	q, err := h.Quantile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !almostEqual(float64(q), 2.5, 1e-9) {
+		t.Errorf("expected quantile at center of mass to equal the mean, got %v", q)
+	}
+
+	if _, err := (&SampleHistogram{}).CenterOfMassQuantile(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramMAD(t *testing.T) {
+	tests := []struct {
+		h        *SampleHistogram
+		expected float64
+	}{
+		{
+			// Uniform between 0 and 4: median 2, deviations uniform in [0,2].
+			h:        genLinearHistogram([]float64{0, 1, 2, 3, 4}, 25, 25, 25, 25),
+			expected: 1,
+		},
+		{
+			// Median 1, the middle bucket folds onto 80 deviations in [0,0.5].
+			h:        genLinearHistogram([]float64{0, 0.5, 1.5, 10}, 10, 80, 10),
+			expected: 0.3125,
+		},
+		{
+			h:        &SampleHistogram{Count: 2, Buckets: HistogramBuckets{{Boundaries: 3, Lower: 5, Upper: 5, Count: 2}}},
+			expected: 0,
+		},
+	}
+	for i, test := range tests {
+		got, err := test.h.MAD()
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	if _, err := (&SampleHistogram{}).MAD(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramSumContribution(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 4, Upper: FloatString(math.Inf(1)), Count: 2})
+	h.Count += 2
+	h.Sum = 230
+
+	got := h.SumContribution()
+	expected := []FloatString{5, 60, 150, 8}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	var total FloatString
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("bucket %d: expected %v, got %v", i, expected[i], got[i])
+		}
+		total += got[i]
+	}
+	if !almostEqual(float64(total), float64(h.Sum), 0.1*float64(h.Sum)) {
+		t.Errorf("contributions sum to %v, which is far from %v", total, h.Sum)
+	}
+}
+
+func TestNewSampleHistogramFromDurationLE(t *testing.T) {
+	h, err := NewSampleHistogramFromDurationLE(
+		[]string{"250ms", "1.5s", "1m", "+Inf"},
+		[]float64{2, 5, 9, 10},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SampleHistogram{
+		Count: 10,
+		Buckets: HistogramBuckets{
+			{Boundaries: 3, Lower: 0, Upper: 0.25, Count: 2},
+			{Lower: 0.25, Upper: 1.5, Count: 3},
+			{Lower: 1.5, Upper: 60, Count: 4},
+			{Lower: 60, Upper: FloatString(math.Inf(1)), Count: 1},
+		},
+	}
+	if !h.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, h)
+	}
+
+	// A first bound of 0 yields the closed point [0,0] holding the
+	// zero-duration observations.
+	h, err = NewSampleHistogramFromDurationLE(
+		[]string{"0s", "1s", "+Inf"},
+		[]float64{3, 5, 6},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &SampleHistogram{
+		Count: 6,
+		Buckets: HistogramBuckets{
+			{Boundaries: 3, Lower: 0, Upper: 0, Count: 3},
+			{Lower: 0, Upper: 1, Count: 2},
+			{Lower: 1, Upper: FloatString(math.Inf(1)), Count: 1},
+		},
+	}
+	if !h.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, h)
+	}
+	if err := h.Validate(); err != nil {
+		t.Errorf("expected valid histogram, got %v", err)
+	}
+
+	tests := []struct {
+		les    []string
+		counts []float64
+		err    string
+	}{
+		{les: []string{"1s"}, counts: nil, err: "got 1 bounds but 0 counts"},
+		{les: []string{"-1s", "1s"}, counts: []float64{1, 2}, err: `invalid bound "-1s" at index 0: negative duration`},
+		{les: []string{"1s", "fast"}, counts: []float64{1, 2}, err: `invalid bound "fast" at index 1: time: invalid duration "fast"`},
+		{les: []string{"2s", "1s"}, counts: []float64{1, 2}, err: `bound "1s" at index 1 is not increasing`},
+		{les: []string{"1s", "2s"}, counts: []float64{2, 1}, err: "cumulative count 1 at index 1 is decreasing"},
+	}
+	for _, test := range tests {
+		_, err := NewSampleHistogramFromDurationLE(test.les, test.counts)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("expected error %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestSampleHistogramEnforceMinWidth(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 0.1, 0.2, 1, 2}, 1, 2, 3, 4)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 2, Upper: FloatString(math.Inf(1)), Count: 5})
+	h.Count += 5
+	h.Sum = 12
+
+	expected := &SampleHistogram{
+		Count: 15,
+		Sum:   12,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 1, Count: 6},
+			{Lower: 1, Upper: 2, Count: 4},
+			{Lower: 2, Upper: FloatString(math.Inf(1)), Count: 5},
+		},
+	}
+	if got := h.EnforceMinWidth(0.5); !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got := h.EnforceMinWidth(0.05); !got.Equal(h) {
+		t.Errorf("expected unchanged histogram %v, got %v", h, got)
+	}
+	if len(h.Buckets) != 5 {
+		t.Errorf("receiver was modified: %v", h)
+	}
+
+	// Boundary rules are taken from the outer sides of the merged buckets.
+	h = &SampleHistogram{
+		Count: 2,
+		Buckets: HistogramBuckets{
+			{Boundaries: 1, Lower: 0, Upper: 0.5, Count: 1},
+			{Boundaries: 3, Lower: 0.5, Upper: 1, Count: 1},
+		},
+	}
+	expected = &SampleHistogram{
+		Count:   2,
+		Buckets: HistogramBuckets{{Boundaries: 3, Lower: 0, Upper: 1, Count: 2}},
+	}
+	if got := h.EnforceMinWidth(1); !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestHistogramOverlap(t *testing.T) {
+	tests := []struct {
+		a, b     *SampleHistogram
+		expected float64
+	}{
+		{
+			a:        genLinearHistogram([]float64{0, 1, 2}, 1, 3),
+			b:        genLinearHistogram([]float64{0, 1, 2}, 10, 30),
+			expected: 1,
+		},
+		{
+			a:        genLinearHistogram([]float64{0, 1}, 1),
+			b:        genLinearHistogram([]float64{2, 3}, 1),
+			expected: 0,
+		},
+		{
+			a:        genLinearHistogram([]float64{0, 1, 2}, 1, 1),
+			b:        genLinearHistogram([]float64{0, 2}, 4),
+			expected: 1,
+		},
+		{
+			a:        genLinearHistogram([]float64{0, 1, 2}, 3, 1),
+			b:        genLinearHistogram([]float64{0, 1, 2}, 1, 3),
+			expected: 0.5,
+		},
+		{
+			// Only the quarter of a below 10 overlaps with b.
+			a:        genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3),
+			b:        genLinearHistogram([]float64{0, 10}, 4),
+			expected: 0.25,
+		},
+	}
+	for i, test := range tests {
+		got, err := HistogramOverlap(test.a, test.b)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !almostEqual(got, test.expected, 1e-9) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	h := genLinearHistogram([]float64{0, 1}, 1)
+	for _, pair := range [][2]*SampleHistogram{{h, nil}, {nil, h}, {h, genLinearHistogram([]float64{0, 1}, 0)}} {
+		if _, err := HistogramOverlap(pair[0], pair[1]); err == nil {
+			t.Errorf("expected error for %v and %v", pair[0], pair[1])
+		}
+	}
+}
+
+func TestSampleHistogramEffectiveBuckets(t *testing.T) {
+	tests := []struct {
+		h        *SampleHistogram
+		expected float64
+	}{
+		{h: genLinearHistogram([]float64{0, 1, 2, 3, 4}, 5, 5, 5, 5), expected: 4},
+		{h: genLinearHistogram([]float64{0, 1, 2, 3, 4}, 0, 10, 0, 0), expected: 1},
+		{h: genLinearHistogram([]float64{0, 1, 2}, 1, 3), expected: 1.6},
+		{h: genLinearHistogram([]float64{0, 1}, 0), expected: 0},
+		{h: &SampleHistogram{}, expected: 0},
+	}
+	for i, test := range tests {
+		if got := test.h.EffectiveBuckets(); !almostEqual(got, test.expected, 1e-9) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestSampleHistogramTailRatio(t *testing.T) {
+	// The median is 2 and the 99th percentile is 9.84.
+	got, err := genLinearHistogram([]float64{0, 1, 2, 10}, 10, 40, 50).TailRatio()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !almostEqual(float64(got), 4.92, 1e-9) {
+		t.Errorf("expected 4.92, got %v", got)
+	}
+
+	if _, err := (&SampleHistogram{}).TailRatio(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+	if _, err := genLinearHistogram([]float64{-1, 0, 1}, 50, 50).TailRatio(); err == nil {
+		t.Error("expected error for zero median")
+	}
+}
+
+func TestSampleHistogramFromValues(t *testing.T) {
+	got, err := SampleHistogramFromValues([]float64{0.5, 1, 1.5, 2, 2.5}, []FloatString{0, 1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SampleHistogram{
+		Count: 5,
+		Sum:   7.5,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 1, Count: 2},
+			{Lower: 1, Upper: 2, Count: 2},
+			{Lower: 2, Upper: 3, Count: 1},
+		},
+	}
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got, err = SampleHistogramFromValues([]float64{-1, 0, 0.5, 4, 5}, []FloatString{0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &SampleHistogram{
+		Count: 5,
+		Sum:   8.5,
+		Buckets: HistogramBuckets{
+			{Lower: FloatString(math.Inf(-1)), Upper: 0, Count: 2},
+			{Lower: 0, Upper: 1, Count: 1},
+			{Lower: 1, Upper: FloatString(math.Inf(1)), Count: 2},
+		},
+	}
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := SampleHistogramFromValues([]float64{1}, []FloatString{1, 0}); err == nil {
+		t.Error("expected error for decreasing edges")
+	}
+}
+
+func TestSampleHistogramTopBucketFraction(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2}, 6, 2)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 2, Upper: FloatString(math.Inf(1)), Count: 2})
+	h.Count += 2
+	if got := h.TopBucketFraction(); got != 0.2 {
+		t.Errorf("expected 0.2, got %v", got)
+	}
+
+	// The top bucket is found regardless of the order of the buckets.
+	h = genLinearHistogram([]float64{0, 1, 2}, 1, 3)
+	h.Buckets[0], h.Buckets[1] = h.Buckets[1], h.Buckets[0]
+	if got := h.TopBucketFraction(); got != 0.75 {
+		t.Errorf("expected 0.75, got %v", got)
+	}
+
+	if got := (&SampleHistogram{}).TopBucketFraction(); got != 0 {
+		t.Errorf("expected 0 for empty histogram, got %v", got)
+	}
+}
+
+func TestSampleHistogramMaskBelow(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 3, 4}, 1, 5, 2, 3)
+	h.Sum = 25
+
+	expected := genLinearHistogram([]float64{0, 1, 2, 3, 4}, 0, 5, 0, 3)
+	expected.Sum = 25
+	if got := h.MaskBelow(3); !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if h.Count != 11 || h.Buckets[0].Count != 1 {
+		t.Errorf("receiver was modified: %v", h)
+	}
+}
+
+func TestHistogramBucketsInRange(t *testing.T) {
+	buckets := genLinearHistogram([]float64{0, 1, 2, 3, 4}, 1, 2, 3, 4).Buckets
+
+	tests := []struct {
+		lo, hi   FloatString
+		expected HistogramBuckets
+	}{
+		{lo: 1.5, hi: 2.5, expected: HistogramBuckets{buckets[1], buckets[2]}},
+		{lo: 2, hi: 2, expected: HistogramBuckets{buckets[1], buckets[2]}},
+		{lo: -1, hi: 0, expected: HistogramBuckets{buckets[0]}},
+		{lo: 5, hi: 6, expected: nil},
+	}
+	for _, test := range tests {
+		got := buckets.InRange(test.lo, test.hi)
+		if !got.Equal(test.expected) {
+			t.Errorf("[%v,%v]: expected %v, got %v", test.lo, test.hi, test.expected, got)
+		}
+		for i := range got {
+			if got[i] == test.expected[i] {
+				t.Errorf("[%v,%v]: bucket %d was not copied", test.lo, test.hi, i)
+			}
+		}
+	}
+}
+
+func TestSampleHistogramGini(t *testing.T) {
+	tests := []struct {
+		h        *SampleHistogram
+		expected float64
+	}{
+		// All observations in one bucket are considered equal.
+		{h: genLinearHistogram([]float64{0, 2}, 10), expected: 0},
+		// Two equally frequent values 1 and 3.
+		{h: genLinearHistogram([]float64{0, 2, 4}, 5, 5), expected: 0.25},
+		// Almost all observations are 0 while a single one carries the mass.
+		{
+			h: &SampleHistogram{
+				Count: 100,
+				Buckets: HistogramBuckets{
+					{Boundaries: 3, Lower: 0, Upper: 0, Count: 99},
+					{Lower: 99, Upper: 101, Count: 1},
+				},
+			},
+			expected: 0.99,
+		},
+	}
+
+	for i, test := range tests {
+		got, err := test.h.Gini()
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	for _, h := range []*SampleHistogram{
+		{},
+		{Count: 1, Buckets: HistogramBuckets{{Boundaries: 3, Lower: 0, Upper: 0, Count: 1}}},
+		genLinearHistogram([]float64{-2, 0}, 1),
+	} {
+		if _, err := h.Gini(); err == nil {
+			t.Errorf("expected error for %v", h)
+		}
+	}
+}
+
+func TestSampleHistogramObservationsToShiftQuantile(t *testing.T) {
+	// 100 observations uniformly distributed between 0 and 10.
+	h := genLinearHistogram([]float64{0, 5, 10}, 50, 50)
+
+	tests := []struct {
+		q        float64
+		target   FloatString
+		expected float64
+	}{
+		// 60 observations are below 6, so 20 more make them 50%.
+		{q: 0.5, target: 6, expected: 20},
+		// 95 observations are below 9.5, so 0.9*(100+k)=95.
+		{q: 0.9, target: 9.5, expected: 100.0/0.9*0.95 - 100},
+		{q: 0.99, target: 10, expected: 100/0.99 - 100},
+	}
+	for _, test := range tests {
+		got, err := h.ObservationsToShiftQuantile(test.q, test.target)
+		if err != nil {
+			t.Errorf("q=%v: unexpected error: %s", test.q, err)
+			continue
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("q=%v: expected %v, got %v", test.q, test.expected, got)
+		}
+	}
+
+	for _, test := range []struct {
+		q      float64
+		target FloatString
+	}{
+		{q: -0.1, target: 5},
+		{q: 1.1, target: 5},
+		{q: 0, target: 5},
+		{q: 0.5, target: 5},
+		{q: 0.5, target: 4},
+	} {
+		if _, err := h.ObservationsToShiftQuantile(test.q, test.target); err == nil {
+			t.Errorf("expected error for q=%v and target %v", test.q, test.target)
+		}
+	}
+}
+
+func TestSampleHistogramSLOCompliance(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 4, Upper: FloatString(math.Inf(1)), Count: 100})
+	h.Count += 100
+
+	tests := []struct {
+		lo, hi          FloatString
+		count, fraction float64
+	}{
+		{lo: 0, hi: 2, count: 50, fraction: 0.25},
+		{lo: 0.5, hi: 3, count: 5 + 40 + 25, fraction: 0.35},
+		// The overflow bucket holds observations above 4 only.
+		{lo: 4, hi: 4, count: 0, fraction: 0},
+		{lo: 4, hi: 100, count: 100, fraction: 0.5},
+		{lo: 3, hi: 1, count: 0, fraction: 0},
+		{lo: -10, hi: 100, count: 200, fraction: 1},
+	}
+	for _, test := range tests {
+		count, fraction := h.SLOCompliance(test.lo, test.hi)
+		if !almostEqual(float64(count), test.count, 1e-9) || !almostEqual(float64(fraction), test.fraction, 1e-9) {
+			t.Errorf("[%v,%v]: expected %v (%v), got %v (%v)", test.lo, test.hi, test.count, test.fraction, count, fraction)
+		}
+	}
+
+	if count, fraction := (&SampleHistogram{}).SLOCompliance(0, 1); count != 0 || fraction != 0 {
+		t.Errorf("expected 0 for empty histogram, got %v (%v)", count, fraction)
+	}
+}
+
+func TestSampleHistogramUniformSample(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2}, 10, 30)
+	h.Buckets = append(h.Buckets,
+		&HistogramBucket{Lower: 3, Upper: 5, Count: 8},
+		&HistogramBucket{Lower: 5, Upper: FloatString(math.Inf(1)), Count: 100},
+	)
+
+	got := h.UniformSample(-0.5, 0.75, 10)
+	expected := []FloatString{0, 10, 20, 30, 0, 4, 4, 4, 0, 0}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if !almostEqual(float64(got[i]), float64(expected[i]), 1e-9) {
+			t.Errorf("point %d: expected %v, got %v", i, expected[i], got[i])
+		}
+	}
+
+	if got := h.UniformSample(0, 1, 0); got != nil {
+		t.Errorf("expected no points, got %v", got)
+	}
+}
+
+func TestKLDivergence(t *testing.T) {
+	tests := []struct {
+		p, q     *SampleHistogram
+		expected float64
+	}{
+		{
+			p:        genLinearHistogram([]float64{0, 1, 2}, 1, 3),
+			q:        genLinearHistogram([]float64{0, 1, 2}, 2, 6),
+			expected: 0,
+		},
+		{
+			p:        genLinearHistogram([]float64{0, 1, 2}, 1, 1),
+			q:        genLinearHistogram([]float64{0, 1, 2}, 1, 3),
+			expected: 0.5*math.Log(0.5/0.25) + 0.5*math.Log(0.5/0.75),
+		},
+		{
+			// Buckets empty in p do not contribute.
+			p:        genLinearHistogram([]float64{0, 1, 2}, 0, 1),
+			q:        genLinearHistogram([]float64{0, 2}, 4),
+			expected: math.Log(2),
+		},
+		{
+			p:        genLinearHistogram([]float64{0, 1, 2}, 1, 1),
+			q:        genLinearHistogram([]float64{0, 1, 2}, 0, 1),
+			expected: math.Inf(1),
+		},
+		{
+			// The overflow bucket of p has no counterpart in q.
+			p:        genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3),
+			q:        genLinearHistogram([]float64{0, 10}, 4),
+			expected: math.Inf(1),
+		},
+		{
+			p:        genLinearHistogram([]float64{0, 10}, 4),
+			q:        genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3),
+			expected: math.Log(4),
+		},
+	}
+	for i, test := range tests {
+		got, err := KLDivergence(test.p, test.q)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !almostEqual(got, test.expected, 1e-9) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	h := genLinearHistogram([]float64{0, 1}, 1)
+	for _, pair := range [][2]*SampleHistogram{{h, nil}, {nil, h}, {&SampleHistogram{}, h}} {
+		if _, err := KLDivergence(pair[0], pair[1]); err == nil {
+			t.Errorf("expected error for %v and %v", pair[0], pair[1])
+		}
+	}
+}
+
+func TestSampleHistogramSummary(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 10}, 10, 40, 50)
+	h.Sum = 300
+
+	got, err := h.Summary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []struct {
+		q   float64
+		got FloatString
+	}{{0.5, got.P50}, {0.9, got.P90}, {0.95, got.P95}, {0.99, got.P99}, {1, got.Max}} {
+		expected, err := h.Quantile(q.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !almostEqual(float64(q.got), float64(expected), 1e-9) {
+			t.Errorf("q=%v: expected %v, got %v", q.q, expected, q.got)
+		}
+	}
+	if got.Max != 10 || got.Count != 100 || got.Sum != 300 {
+		t.Errorf("unexpected summary %+v", got)
+	}
+
+	if _, err := (&SampleHistogram{}).Summary(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestHistogramBucketsIsPartition(t *testing.T) {
+	tests := []struct {
+		name     string
+		buckets  HistogramBuckets
+		expected bool
+	}{
+		{name: "empty", buckets: nil, expected: true},
+		{name: "contiguous", buckets: genLinearHistogram([]float64{0, 1, 2, 4}, 1, 1, 1).Buckets, expected: true},
+		{
+			name: "unsorted",
+			buckets: HistogramBuckets{
+				{Lower: 1, Upper: 2},
+				{Lower: 0, Upper: 1},
+			},
+			expected: true,
+		},
+		{
+			name: "gap",
+			buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1},
+				{Lower: 2, Upper: 3},
+			},
+			expected: false,
+		},
+		{
+			name: "overlap",
+			buckets: HistogramBuckets{
+				{Lower: 0, Upper: 2},
+				{Lower: 1, Upper: 3},
+			},
+			expected: false,
+		},
+		{
+			name: "within tolerance",
+			buckets: HistogramBuckets{
+				{Lower: 0, Upper: 0.1 + 0.2},
+				{Lower: 0.3, Upper: 1},
+			},
+			expected: true,
+		},
+		{
+			name:     "nil bucket",
+			buckets:  HistogramBuckets{{Lower: 0, Upper: 1}, nil},
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		if got := test.buckets.IsPartition(1e-9); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestSampleHistogramAlignTo(t *testing.T) {
+	template := genLinearHistogram([]float64{0, 2, 4}, 0, 0)
+	h := genLinearHistogram([]float64{0, 1, 2, 3, 4}, 1, 2, 3, 4)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 4, Upper: 6, Count: 5})
+
+	aligned, err := h.AlignTo(template)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !aligned.SameSchema(template) {
+		t.Fatalf("expected schema of template, got %v", aligned)
+	}
+	for i, expected := range []FloatString{3, 7} {
+		if got := aligned.Buckets[i].Count; got != expected {
+			t.Errorf("bucket %d: expected %v, got %v", i, expected, got)
+		}
+	}
+	if aligned.Count != h.Count || aligned.Sum != h.Sum {
+		t.Errorf("expected count %v and sum %v, got %v and %v", h.Count, h.Sum, aligned.Count, aligned.Sum)
+	}
+	if _, err := aligned.Add(template); err != nil {
+		t.Errorf("expected aligned histogram to be addable to template, got %v", err)
+	}
+
+	// Halving buckets prorates their counts.
+	fine := genLinearHistogram([]float64{0, 1, 2, 3, 4}, 0, 0, 0, 0)
+	aligned, err = genLinearHistogram([]float64{0, 2, 4}, 4, 8).AlignTo(fine)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, expected := range []FloatString{2, 2, 4, 4} {
+		if got := aligned.Buckets[i].Count; got != expected {
+			t.Errorf("bucket %d: expected %v, got %v", i, expected, got)
+		}
+	}
+
+	// Aligning to its own schema, including an overflow bucket, is the
+	// identity.
+	inf := math.Inf(1)
+	withInf := genLinearHistogram([]float64{0, 5, 10, inf}, 1, 2, 3)
+	aligned, err = withInf.AlignTo(withInf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !aligned.Equal(withInf) || aligned.Buckets[0] == withInf.Buckets[0] {
+		t.Errorf("expected a copy of %v, got %v", withInf, aligned)
+	}
+
+	// Overflow buckets only count towards buckets above their finite bound,
+	// where their observations are located just above it.
+	aligned, err = withInf.AlignTo(genLinearHistogram([]float64{0, 10, 20, inf}, 0, 0, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, expected := range []FloatString{3, 3, 0} {
+		if got := aligned.Buckets[i].Count; got != expected {
+			t.Errorf("bucket %d: expected %v, got %v", i, expected, got)
+		}
+	}
+	closed := &SampleHistogram{Buckets: HistogramBuckets{{Boundaries: 3, Lower: 0, Upper: 10}, {Boundaries: 2, Lower: 10, Upper: FloatString(inf)}}}
+	aligned, err = withInf.AlignTo(closed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, expected := range []FloatString{3, 3} {
+		if got := aligned.Buckets[i].Count; got != expected {
+			t.Errorf("closed template bucket %d: expected %v, got %v", i, expected, got)
+		}
+	}
+
+	if _, err := h.AlignTo(&SampleHistogram{}); err == nil {
+		t.Error("expected error for template without buckets")
+	}
+}
+
+func TestSampleHistogramErrorBudgetRemaining(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 4, Upper: FloatString(math.Inf(1)), Count: 100})
+	h.Count += 100
+
+	tests := []struct {
+		threshold FloatString
+		target    float64
+		expected  float64
+	}{
+		{threshold: 2, target: 0.2, expected: 50},
+		{threshold: 2, target: 0.25, expected: 0},
+		{threshold: 2, target: 0.5, expected: -100},
+		{threshold: 3, target: 1, expected: -125},
+		{threshold: FloatString(math.Inf(1)), target: 0.8, expected: 50},
+	}
+	for _, test := range tests {
+		got, err := h.ErrorBudgetRemaining(test.threshold, test.target)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%v at %v: expected %v, got %v", test.threshold, test.target, test.expected, got)
+		}
+	}
+
+	for _, target := range []float64{0, -0.5, 1.5, math.NaN()} {
+		if _, err := h.ErrorBudgetRemaining(2, target); err == nil {
+			t.Errorf("expected error for target compliance %v", target)
+		}
+	}
+}
+
+func TestSampleHistogramIsPointMass(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 3}, 5, 90, 5)
+	tests := []struct {
+		hist     *SampleHistogram
+		fraction float64
+		expected bool
+	}{
+		{hist: h, fraction: 0.9, expected: true},
+		{hist: h, fraction: 0.95, expected: false},
+		{hist: h, fraction: 0, expected: false},
+		{hist: h, fraction: 1.5, expected: false},
+		{hist: genLinearHistogram([]float64{0, 1, 2}, 0, 3), fraction: 1, expected: true},
+		{hist: genLinearHistogram([]float64{0, 1}, 0), fraction: 0.5, expected: false},
+		{hist: &SampleHistogram{}, fraction: 0.5, expected: false},
+	}
+	for i, test := range tests {
+		if got := test.hist.IsPointMass(test.fraction); got != test.expected {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestSampleHistogramQuantileGap(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 10, 20, 40}, 50, 40, 10)
+	tests := []struct {
+		q1, q2   float64
+		expected float64
+	}{
+		{q1: 0.9, q2: 0.95, expected: 10},
+		{q1: 0.25, q2: 0.75, expected: 11.25},
+		{q1: 0.5, q2: 0.5, expected: 0},
+		{q1: 0, q2: 1, expected: 40},
+	}
+	for _, test := range tests {
+		got, err := h.QuantileGap(test.q1, test.q2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%v-%v: expected %v, got %v", test.q1, test.q2, test.expected, got)
+		}
+	}
+
+	for _, qs := range [][2]float64{{0.9, 0.5}, {-0.1, 0.5}, {0.5, 1.1}, {math.NaN(), 1}} {
+		if _, err := h.QuantileGap(qs[0], qs[1]); err == nil {
+			t.Errorf("expected error for quantiles %v", qs)
+		}
+	}
+	if _, err := (&SampleHistogram{}).QuantileGap(0.1, 0.9); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramRelativeTo(t *testing.T) {
+	edges := []float64{0, 1, 2, 3, 4}
+	h := genLinearHistogram(edges, 15, 5, 3, 0)
+	baseline := genLinearHistogram(edges, 10, 10, 0, 0)
+	got, err := h.RelativeTo(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []float64{0.5, -0.5, math.Inf(1), 0} {
+		if c := float64(got.Buckets[i].Count); c != expected {
+			t.Errorf("bucket %d: expected %v, got %v", i, expected, c)
+		}
+	}
+	if got.Count != 0.15 {
+		t.Errorf("expected count 0.15, got %v", got.Count)
+	}
+
+	// Different schemas are rebucketed onto a common grid first.
+	got, err = genLinearHistogram([]float64{0, 2}, 30).RelativeTo(genLinearHistogram([]float64{0, 1, 2}, 10, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []float64{0.5, -0.25} {
+		if c := float64(got.Buckets[i].Count); !almostEqual(c, expected, 1e-9) {
+			t.Errorf("rebucketed bucket %d: expected %v, got %v", i, expected, c)
+		}
+	}
+
+	// The overflow bucket is compared with the overflow bucket only.
+	inf := math.Inf(1)
+	got, err = genLinearHistogram([]float64{0, 10, inf}, 1, 3).RelativeTo(genLinearHistogram([]float64{0, 5, 10, inf}, 1, 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []float64{-0.5, -0.5, 0.5} {
+		if c := float64(got.Buckets[i].Count); !almostEqual(c, expected, 1e-9) {
+			t.Errorf("overflow bucket %d: expected %v, got %v", i, expected, c)
+		}
+	}
+
+	if _, err := h.RelativeTo(nil); err == nil {
+		t.Error("expected error for nil baseline")
+	}
+}
+
+func TestTotalObservations(t *testing.T) {
+	tests := []struct {
+		hists    []*SampleHistogram
+		expected FloatString
+	}{
+		{hists: nil, expected: 0},
+		{hists: []*SampleHistogram{nil, nil}, expected: 0},
+		{
+			hists: []*SampleHistogram{
+				genLinearHistogram([]float64{0, 1}, 3),
+				nil,
+				{Count: 4.5},
+				genLinearHistogram([]float64{0, 1, 2}, 1, 1),
+			},
+			expected: 9.5,
+		},
+	}
+	for i, test := range tests {
+		if got := TotalObservations(test.hists); got != test.expected {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestSampleHistogramSnapToBase(t *testing.T) {
+	h := &SampleHistogram{
+		Count: 10,
+		Sum:   20,
+		Buckets: HistogramBuckets{
+			{Boundaries: 1, Lower: -2.0000001, Upper: -0.9999999, Count: 1},
+			{Boundaries: 3, Lower: 0, Upper: 0.99999999, Count: 2},
+			{Lower: 1.0000001, Upper: 1.9999999, Count: 3},
+			{Lower: 2.0000000001, Upper: FloatString(math.Inf(1)), Count: 4},
+		},
+	}
+	got := h.SnapToBase(2)
+	expected := &SampleHistogram{
+		Count: 10,
+		Sum:   20,
+		Buckets: HistogramBuckets{
+			{Boundaries: 1, Lower: -2, Upper: -1, Count: 1},
+			{Boundaries: 3, Lower: 0, Upper: 1, Count: 2},
+			{Lower: 1, Upper: 2, Count: 3},
+			{Lower: 2, Upper: FloatString(math.Inf(1)), Count: 4},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if h.Buckets[2].Lower != 1.0000001 {
+		t.Error("expected input to remain unchanged")
+	}
+
+	if err := got.Validate(); err != nil {
+		t.Errorf("expected valid result, got %v", err)
+	}
+
+	// A coarse base merges buckets whose bounds snap to the same powers and
+	// folds buckets collapsing to a single power into the next bucket, or
+	// the previous one if there is none.
+	tests := []struct {
+		h        *SampleHistogram
+		base     float64
+		expected *SampleHistogram
+	}{
+		{
+			h:    genLinearHistogram([]float64{10, 20, 30, 100}, 1, 2, 3),
+			base: 10,
+			expected: &SampleHistogram{
+				Count: 6,
+				Buckets: HistogramBuckets{
+					{Lower: 10, Upper: 100, Count: 6},
+				},
+			},
+		},
+		{
+			h:    genLinearHistogram([]float64{1, 2, 3, 4, 5}, 1, 2, 3, 4),
+			base: 10,
+			expected: &SampleHistogram{
+				Count: 10,
+				Buckets: HistogramBuckets{
+					{Lower: 1, Upper: 10, Count: 10},
+				},
+			},
+		},
+		{
+			h:    genLinearHistogram([]float64{1.9, 2.1}, 5),
+			base: 2,
+			expected: &SampleHistogram{
+				Count: 5,
+				Buckets: HistogramBuckets{
+					{Boundaries: 3, Lower: 2, Upper: 2, Count: 5},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		got := test.h.SnapToBase(test.base)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expected %v, got %v", test.expected, got)
+		}
+		if err := got.Validate(); err != nil {
+			t.Errorf("expected valid result for %v, got %v", got, err)
+		}
+	}
+
+	for _, base := range []float64{1, 0.5, -2, math.NaN()} {
+		if got := h.SnapToBase(base); got != nil {
+			t.Errorf("expected nil for base %v, got %v", base, got)
+		}
+	}
+}
+
+func TestSampleHistogramDynamicRangeDecades(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 0.001, 0.01, 0.1, 1, 10}, 5, 1, 0, 3, 0)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 10, Upper: FloatString(math.Inf(1)), Count: 2})
+	got, ok := h.DynamicRangeDecades()
+	if !ok {
+		t.Fatal("expected ok")
+	}
+	// The bucket (0,0.001] has no positive lower bound, the bucket (1,10]
+	// is empty and the overflow bucket has no finite upper bound.
+	if !almostEqual(got, 3, 1e-9) {
+		t.Errorf("expected 3, got %v", got)
+	}
+
+	tests := []*SampleHistogram{
+		{},
+		genLinearHistogram([]float64{-10, 0}, 5),
+		genLinearHistogram([]float64{0, 1}, 5),
+		genLinearHistogram([]float64{1, 2}, 0),
+		{Buckets: HistogramBuckets{{Lower: 1, Upper: FloatString(math.Inf(1)), Count: 1}}},
+	}
+	for i, h := range tests {
+		if _, ok := h.DynamicRangeDecades(); ok {
+			t.Errorf("%d: expected not ok", i)
+		}
+	}
+}
+
+func TestHistogramBucketCountInterval(t *testing.T) {
+	tests := []struct {
+		count, z float64
+		lo, hi   float64
+	}{
+		{count: 100, z: 1.96, lo: 80.4, hi: 119.6},
+		{count: 100, z: 1, lo: 90, hi: 110},
+		{count: 4, z: 2.576, lo: 0, hi: 9.152},
+		{count: 9, z: 0, lo: 9, hi: 9},
+		{count: 0, z: 1.96, lo: 0, hi: 0},
+	}
+	for _, test := range tests {
+		lo, hi := HistogramBucket{Count: FloatString(test.count)}.CountInterval(test.z)
+		if !almostEqual(float64(lo), test.lo, 1e-9) || !almostEqual(float64(hi), test.hi, 1e-9) {
+			t.Errorf("%v at z=%v: expected [%v,%v], got [%v,%v]", test.count, test.z, test.lo, test.hi, lo, hi)
+		}
+	}
+}
+
+func TestSampleHistogramProject(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2}, 10, 30)
+	h.Sum = 50
+	got := h.Project(1.5)
+	expected := genLinearHistogram([]float64{0, 1, 2}, 15, 45)
+	expected.Sum = 75
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if h.Count != 40 || h.Buckets[0].Count != 10 {
+		t.Error("expected input to remain unchanged")
+	}
+	q, err := got.Quantile(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig, _ := h.Quantile(0.5); q != orig {
+		t.Errorf("expected unchanged median %v, got %v", orig, q)
+	}
+}
+
+func TestSampleHistogramTailSumFraction(t *testing.T) {
+	// Midpoint masses are 0.5*10 = 5, 1.5*10 = 15 and 3*10 = 30.
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 10, 10)
+	tests := []struct {
+		threshold FloatString
+		expected  float64
+	}{
+		{threshold: 2, expected: 0.6},
+		{threshold: 1, expected: 0.9},
+		// Half of the last bucket, 5 observations at 3.5.
+		{threshold: 3, expected: 17.5 / 50},
+		{threshold: 4, expected: 0},
+		{threshold: -1, expected: 1},
+	}
+	for _, test := range tests {
+		if got := h.TailSumFraction(test.threshold); !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%v: expected %v, got %v", test.threshold, test.expected, got)
+		}
+	}
+
+	// The overflow bucket is located at its finite bound.
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 4, Upper: FloatString(math.Inf(1)), Count: 5})
+	if got := h.TailSumFraction(3.5); !almostEqual(float64(got), (3.75*2.5+20)/70, 1e-9) {
+		t.Errorf("expected %v, got %v", (3.75*2.5+20)/70, got)
+	}
+
+	// Its observations are above its finite bound.
+	if got := h.TailSumFraction(4); !almostEqual(float64(got), 20.0/70, 1e-9) {
+		t.Errorf("expected %v, got %v", 20.0/70, got)
+	}
+
+	// Unless it includes its finite bound, like ProbExceeds assumes.
+	for _, boundaries := range []int32{1, 3} {
+		h.Buckets[len(h.Buckets)-1].Boundaries = boundaries
+		if got := h.TailSumFraction(4); got != 0 {
+			t.Errorf("boundaries %d: expected 0, got %v", boundaries, got)
+		}
+		if got := h.ProbExceeds(4); got != 0 {
+			t.Errorf("boundaries %d: expected ProbExceeds 0, got %v", boundaries, got)
+		}
+	}
+
+	if got := (&SampleHistogram{}).TailSumFraction(1); got != 0 {
+		t.Errorf("expected 0 for empty histogram, got %v", got)
+	}
+}
+
+func TestSampleHistogramQuantileWithError(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 0.1, 0.48, 0.52}, 90, 9, 1)
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 0.52, Upper: FloatString(math.Inf(1))})
+	tests := []struct {
+		q                   float64
+		value, lower, upper float64
+	}{
+		{q: 0.995, value: 0.5, lower: 0.48, upper: 0.52},
+		{q: 0.5, value: 0.1 * 50 / 90, lower: 0, upper: 0.1},
+		{q: 0.9, value: 0.1, lower: 0, upper: 0.1},
+		{q: 1, value: 0.52, lower: 0.48, upper: 0.52},
+		{q: 0, value: 0, lower: 0, upper: 0.1},
+	}
+	for _, test := range tests {
+		value, lower, upper, err := h.QuantileWithError(test.q)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !almostEqual(float64(value), test.value, 1e-9) || float64(lower) != test.lower || float64(upper) != test.upper {
+			t.Errorf("%v: expected %v in [%v,%v], got %v in [%v,%v]", test.q, test.value, test.lower, test.upper, value, lower, upper)
+		}
+		if q, _ := h.Quantile(test.q); !almostEqual(float64(q), float64(value), 1e-12) {
+			t.Errorf("%v: expected value to match Quantile %v, got %v", test.q, q, value)
+		}
+	}
+
+	if _, _, _, err := h.QuantileWithError(1.5); err == nil {
+		t.Error("expected error for invalid quantile")
+	}
+	if _, _, _, err := (&SampleHistogram{}).QuantileWithError(0.5); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramValueAtTopFraction(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 100, 200, 1000}, 90, 9, 1)
+	tests := []struct {
+		fraction, expected float64
+	}{
+		{fraction: 0.01, expected: 200},
+		{fraction: 0.1, expected: 100},
+		{fraction: 0.005, expected: 600},
+		{fraction: 0, expected: 1000},
+		{fraction: 1, expected: 0},
+	}
+	for _, test := range tests {
+		got, err := h.ValueAtTopFraction(test.fraction)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%v: expected %v, got %v", test.fraction, test.expected, got)
+		}
+	}
+
+	for _, fraction := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := h.ValueAtTopFraction(fraction); err == nil {
+			t.Errorf("expected error for fraction %v", fraction)
+		}
+	}
+}
+
+func TestSampleHistogramModeValue(t *testing.T) {
+	inf := FloatString(math.Inf(1))
+	tests := []struct {
+		name     string
+		hist     *SampleHistogram
+		expected FloatString
+		ok       bool
+	}{
+		{
+			// The wide bucket holds most observations, but the narrow one
+			// is denser. The peak leans towards the denser neighbour.
+			name:     "density",
+			hist:     genLinearHistogram([]float64{0, 1, 2, 100}, 5, 20, 100),
+			expected: 1 + 15/(15+(20-100.0/98)),
+			ok:       true,
+		},
+		{
+			name:     "interpolated",
+			hist:     genLinearHistogram([]float64{0, 1, 2, 3}, 2, 10, 6),
+			expected: 1 + 8.0/12,
+			ok:       true,
+		},
+		{
+			// Neighbours that do not touch the bucket count as empty.
+			name: "gap",
+			hist: &SampleHistogram{Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1, Count: 8},
+				{Lower: 2, Upper: 3, Count: 10},
+				{Lower: 3, Upper: 4, Count: 5},
+			}},
+			expected: 2 + 10.0/15,
+			ok:       true,
+		},
+		{
+			name: "zero width",
+			hist: &SampleHistogram{Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1, Count: 1000},
+				{Boundaries: 3, Lower: 5, Upper: 5, Count: 1},
+				{Boundaries: 3, Lower: 7, Upper: 7, Count: 2},
+			}},
+			expected: 7,
+			ok:       true,
+		},
+		{
+			name: "overflow ignored",
+			hist: &SampleHistogram{Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 10, Count: 1},
+				{Lower: 10, Upper: inf, Count: 1000},
+			}},
+			expected: 5,
+			ok:       true,
+		},
+		{
+			name: "overflow only",
+			hist: &SampleHistogram{Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 10, Count: 0},
+				{Lower: 10, Upper: inf, Count: 3},
+			}},
+			expected: 10,
+			ok:       true,
+		},
+		{name: "empty", hist: genLinearHistogram([]float64{0, 1}, 0)},
+	}
+	for _, test := range tests {
+		got, ok := test.hist.ModeValue()
+		if !almostEqual(float64(got), float64(test.expected), 1e-12) || ok != test.ok {
+			t.Errorf("%s: expected %v (%v), got %v (%v)", test.name, test.expected, test.ok, got, ok)
+		}
+	}
+}
+
+func TestSampleHistogramMedian(t *testing.T) {
+	tests := []*SampleHistogram{
+		genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50),
+		genLinearHistogram([]float64{0, 10}, 1),
+		genSampleHistogram(),
+		{Buckets: HistogramBuckets{
+			{Lower: 5, Upper: 10, Count: 3},
+			{Lower: FloatString(math.Inf(-1)), Upper: 0, Count: 1},
+			{Lower: 0, Upper: 5, Count: 0},
+		}},
+	}
+	for i, h := range tests {
+		got, err := h.Median()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		expected, err := h.Quantile(0.5)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if got != expected {
+			t.Errorf("%d: expected %v, got %v", i, expected, got)
+		}
+	}
+	if got, _ := tests[0].Median(); got != 2 {
+		t.Errorf("expected 2, got %v", got)
+	}
+
+	if _, err := (&SampleHistogram{}).Median(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramShapeVector(t *testing.T) {
+	edges := []FloatString{0, 1, 2, 4}
+	small := genLinearHistogram([]float64{0, 1, 2, 4}, 3, 0, 4)
+	// The same shape with a hundred times the observations and a gap
+	// instead of an empty bucket.
+	large := &SampleHistogram{Count: 700, Buckets: HistogramBuckets{
+		{Lower: 0, Upper: 1, Count: 300},
+		{Lower: 2, Upper: 4, Count: 400},
+	}}
+
+	for _, h := range []*SampleHistogram{small, large} {
+		got, err := h.ShapeVector(edges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, expected := range []float64{0.6, 0, 0.8} {
+			if !almostEqual(float64(got[i]), expected, 1e-9) {
+				t.Errorf("%v: element %d: expected %v, got %v", h, i, expected, got[i])
+			}
+		}
+	}
+
+	// Observations of the overflow bucket lie above 10.
+	withInf := genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3)
+	got, err := withInf.ShapeVector([]FloatString{0, 10, FloatString(math.Inf(1))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []float64{1 / math.Sqrt(10), 3 / math.Sqrt(10)} {
+		if !almostEqual(float64(got[i]), expected, 1e-9) {
+			t.Errorf("%v: element %d: expected %v, got %v", withInf, i, expected, got[i])
+		}
+	}
+
+	if _, err := small.ShapeVector([]FloatString{10, 20}); err == nil {
+		t.Error("expected error for histogram without observations within the edges")
+	}
+	if _, err := small.ShapeVector([]FloatString{1}); err == nil {
+		t.Error("expected error for invalid edges")
+	}
+}
+
+func TestHistogramCosineSimilarity(t *testing.T) {
+	edges := []float64{0, 1, 2, 3}
+	h := genLinearHistogram(edges, 1, 2, 3)
+	tests := []struct {
+		name     string
+		a, b     *SampleHistogram
+		expected float64
+	}{
+		{name: "scaled", a: h, b: genLinearHistogram(edges, 10, 20, 30), expected: 1},
+		{name: "disjoint", a: genLinearHistogram(edges, 1, 0, 0), b: genLinearHistogram(edges, 0, 0, 5), expected: 0},
+		{name: "partial", a: genLinearHistogram(edges, 1, 1, 0), b: genLinearHistogram(edges, 0, 1, 1), expected: 0.5},
+		// Splitting the first bucket yields counts of 0.5, 0.5, 2, 3
+		// against 2, 2, 0, 0.
+		{name: "rebucketed", a: h, b: genLinearHistogram([]float64{0, 0.5, 1}, 2, 2), expected: 2 / math.Sqrt(13.5) / math.Sqrt(8)},
+		// Counts of 1, 3 against 4, 0 with the overflow bucket kept apart.
+		{name: "overflow", a: genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3), b: genLinearHistogram([]float64{0, 10}, 4), expected: 1 / math.Sqrt(10)},
+	}
+	for _, test := range tests {
+		got, err := HistogramCosineSimilarity(test.a, test.b)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !almostEqual(got, test.expected, 1e-9) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+
+	if _, err := HistogramCosineSimilarity(h, nil); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+	if _, err := HistogramCosineSimilarity(h, genLinearHistogram(edges, 0, 0, 0)); err == nil {
+		t.Error("expected error for all-zero histogram")
+	}
+}
+
+func TestSampleHistogramP2Quantile(t *testing.T) {
+	// A smooth, bell-shaped distribution over 50 buckets of width 1.
+	edges := make([]float64, 51)
+	counts := make([]float64, 50)
+	for i := range edges {
+		edges[i] = float64(i)
+	}
+	for i := range counts {
+		x := (float64(i) + 0.5 - 25) / 8
+		counts[i] = math.Round(1000 * math.Exp(-x*x/2))
+	}
+	h := genLinearHistogram(edges, counts...)
+
+	// The estimations are expected to be within one bucket width of the
+	// interpolated quantiles.
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		got, err := h.P2Quantile(q)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", q, err)
+		}
+		expected, _ := h.Quantile(q)
+		if !almostEqual(float64(got), float64(expected), 1) {
+			t.Errorf("%v: expected %v within 1, got %v", q, expected, got)
+		}
+	}
+
+	if got, _ := h.P2Quantile(0); got != 0.5 {
+		t.Errorf("expected lowest midpoint 0.5, got %v", got)
+	}
+	if got, _ := h.P2Quantile(1); got != 49.5 {
+		t.Errorf("expected highest midpoint 49.5, got %v", got)
+	}
+	// Few observations are still fed as five.
+	if got, err := genLinearHistogram([]float64{0, 2}, 1).P2Quantile(0.5); err != nil || got != 1 {
+		t.Errorf("expected 1, got %v (%v)", got, err)
+	}
+
+	if _, err := h.P2Quantile(1.5); err == nil {
+		t.Error("expected error for invalid quantile")
+	}
+	if _, err := (&SampleHistogram{}).P2Quantile(0.5); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestP2Estimator(t *testing.T) {
+	// Feeding the numbers 1 to 10001 in a shuffled order.
+	e := newP2Estimator(0.9)
+	for i := 0; i < 10001; i++ {
+		e.add(float64((i*7919)%10001 + 1))
+	}
+	if got := e.quantile(); !almostEqual(got, 9001, 50) {
+		t.Errorf("expected about 9001, got %v", got)
+	}
+
+	e = newP2Estimator(0.5)
+	for _, x := range []float64{3, 1, 2} {
+		e.add(x)
+	}
+	if got := e.quantile(); got != 2 {
+		t.Errorf("expected 2, got %v", got)
+	}
+}
+
+func TestSampleHistogramPopulatedExtent(t *testing.T) {
+	tests := []struct {
+		hist        *SampleHistogram
+		first, last int
+		ok          bool
+	}{
+		{hist: genLinearHistogram([]float64{0, 1, 2, 3, 4, 5}, 0, 1, 0, 2, 0), first: 1, last: 3, ok: true},
+		{hist: genLinearHistogram([]float64{0, 1, 2}, 0, 3), first: 1, last: 1, ok: true},
+		{hist: genLinearHistogram([]float64{0, 1, 2}, 1, 3), first: 0, last: 1, ok: true},
+		{hist: &SampleHistogram{Buckets: HistogramBuckets{nil, {Count: 1}, nil}}, first: 1, last: 1, ok: true},
+		{hist: genLinearHistogram([]float64{0, 1, 2}, 0, 0)},
+		{hist: &SampleHistogram{}},
+	}
+	for i, test := range tests {
+		first, last, ok := test.hist.PopulatedExtent()
+		if first != test.first || last != test.last || ok != test.ok {
+			t.Errorf("%d: expected %d, %d (%v), got %d, %d (%v)", i, test.first, test.last, test.ok, first, last, ok)
+		}
+	}
+}
+
+func TestCombineHistograms(t *testing.T) {
+	edges := []float64{0, 1, 2}
+	hists := []*SampleHistogram{
+		genLinearHistogram(edges, 1, 5),
+		nil,
+		genLinearHistogram(edges, 3, 2),
+	}
+	max := func(counts []FloatString) FloatString {
+		m := counts[0]
+		for _, c := range counts[1:] {
+			if c > m {
+				m = c
+			}
+		}
+		return m
+	}
+	got, err := CombineHistograms(hists, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := genLinearHistogram(edges, 3, 5); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Summing is equivalent to Add.
+	sum := func(counts []FloatString) FloatString {
+		var s FloatString
+		for _, c := range counts {
+			s += c
+		}
+		return s
+	}
+	got, err = CombineHistograms(hists, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, _ := hists[0].Add(hists[2])
+	if !reflect.DeepEqual(got, added) {
+		t.Errorf("expected %v, got %v", added, got)
+	}
+
+	// Different schemas are rebucketed onto the union of their bounds.
+	got, err = CombineHistograms([]*SampleHistogram{
+		genLinearHistogram([]float64{0, 2}, 4),
+		genLinearHistogram(edges, 1, 1),
+	}, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := genLinearHistogram(edges, 3, 3); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Overflow buckets are combined with each other only.
+	inf := math.Inf(1)
+	got, err = CombineHistograms([]*SampleHistogram{
+		genLinearHistogram([]float64{0, 10, inf}, 1, 3),
+		genLinearHistogram([]float64{0, 5, 10, inf}, 1, 1, 2),
+		genLinearHistogram([]float64{0, 10}, 4),
+	}, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := genLinearHistogram([]float64{0, 5, 10, inf}, 3.5, 3.5, 5); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := CombineHistograms(nil, sum); err == nil {
+		t.Error("expected error for no histograms")
+	}
+	if _, err := CombineHistograms([]*SampleHistogram{nil}, sum); err == nil {
+		t.Error("expected error for only nil histograms")
+	}
+	if _, err := CombineHistograms(hists, nil); err == nil {
+		t.Error("expected error for nil reducer")
+	}
+}
+
+func TestSampleHistogramBoxPlot(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4, 8}, 0, 10, 20, 10)
+	min, q1, median, q3, max, err := h.BoxPlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []FloatString{min, q1, median, q3, max}
+	expected := []FloatString{1, 2, 3, 4, 8}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	for i, q := range []float64{0.25, 0.5, 0.75} {
+		if v, _ := h.Quantile(q); v != got[i+1] {
+			t.Errorf("expected %v to match Quantile(%v) %v", got[i+1], q, v)
+		}
+	}
+
+	if _, _, _, _, _, err := genLinearHistogram([]float64{0, 1}, 0).BoxPlot(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestHistogramBucketExactCount(t *testing.T) {
+	above, _ := new(big.Int).SetString("9007199254740994", 10)
+	tests := []struct {
+		count    float64
+		expected *big.Int
+		ok       bool
+	}{
+		{count: 0, expected: big.NewInt(0), ok: true},
+		{count: 42, expected: big.NewInt(42), ok: true},
+		{count: -3, expected: big.NewInt(-3), ok: true},
+		{count: 1<<53 - 1, expected: big.NewInt(1<<53 - 1), ok: true},
+		// 2^53+1 is not representable and rounds to 2^53 or 2^53+2.
+		{count: 1 << 53, expected: big.NewInt(1 << 53), ok: false},
+		{count: 1<<53 + 2, expected: above, ok: false},
+		{count: 2.5, expected: big.NewInt(3), ok: false},
+		{count: math.Inf(1), expected: nil, ok: false},
+		{count: math.NaN(), expected: nil, ok: false},
+	}
+	for _, test := range tests {
+		got, ok := (&HistogramBucket{Count: FloatString(test.count)}).ExactCount()
+		if ok != test.ok || (got == nil) != (test.expected == nil) || (got != nil && got.Cmp(test.expected) != 0) {
+			t.Errorf("%v: expected %v (%v), got %v (%v)", test.count, test.expected, test.ok, got, ok)
+		}
+	}
+
+	// CountExact holds counts beyond 2^53 exactly as long as it rounds to
+	// Count.
+	exact, _ := new(big.Int).SetString("9007199254740993", 10)
+	b := &HistogramBucket{Count: 1 << 53, CountExact: exact}
+	got, ok := b.ExactCount()
+	if !ok || got.Cmp(exact) != 0 {
+		t.Errorf("expected %v (true), got %v (%v)", exact, got, ok)
+	}
+	got.SetInt64(0)
+	if b.CountExact.Cmp(exact) != 0 {
+		t.Error("expected CountExact to remain unchanged")
+	}
+	b.Count *= 2
+	if got, ok := b.ExactCount(); ok || got.Cmp(new(big.Int).Lsh(big.NewInt(1), 54)) != 0 {
+		t.Errorf("expected 2^54 (false) for stale CountExact, got %v (%v)", got, ok)
+	}
+
+	// Derived histograms add up exact counts exactly and drop them when
+	// rewriting counts otherwise.
+	h := &SampleHistogram{Count: 1<<53 + 2, Buckets: HistogramBuckets{
+		{Lower: 1, Upper: 2, Count: 1 << 53, CountExact: exact},
+		{Lower: 1, Upper: 2, Count: 1},
+	}}
+	sum := new(big.Int).Add(exact, big.NewInt(1))
+	for name, got := range map[string]*SampleHistogram{
+		"Dedup":      h.Dedup(),
+		"SnapToBase": h.SnapToBase(2),
+	} {
+		if len(got.Buckets) != 1 {
+			t.Fatalf("%s: expected 1 bucket, got %v", name, got.Buckets)
+		}
+		if c, ok := got.Buckets[0].ExactCount(); !ok || c.Cmp(sum) != 0 {
+			t.Errorf("%s: expected exact count %v, got %v (%v)", name, sum, c, ok)
+		}
+	}
+	for name, got := range map[string]*SampleHistogram{
+		"Project":   h.Project(2),
+		"MaskBelow": h.MaskBelow(1 << 54),
+	} {
+		if got.Buckets[0].CountExact != nil {
+			t.Errorf("%s: expected CountExact to be dropped, got %v", name, got.Buckets[0].CountExact)
+		}
+	}
+	if h.Buckets[0].CountExact != exact {
+		t.Error("expected input to remain unchanged")
+	}
+}
+
+func TestSampleHistogramSmoothedDensity(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4, 8}, 10, 40, 30, 20)
+	xs, ys := h.SmoothedDensity(200, 0.5)
+	if len(xs) != 200 || len(ys) != 200 {
+		t.Fatalf("expected 200 points, got %d and %d", len(xs), len(ys))
+	}
+	if xs[0] != -1 || xs[len(xs)-1] != 7.5 {
+		t.Errorf("expected range [-1,7.5], got [%v,%v]", xs[0], xs[len(xs)-1])
+	}
+	// The area below the curve is close to the total count.
+	var area float64
+	for i := 1; i < len(xs); i++ {
+		area += float64(xs[i]-xs[i-1]) * float64(ys[i]+ys[i-1]) / 2
+	}
+	if !almostEqual(area, 100, 0.5) {
+		t.Errorf("expected area of about 100, got %v", area)
+	}
+	for i, y := range ys {
+		if y < 0 {
+			t.Errorf("point %d: expected non-negative density, got %v", i, y)
+		}
+	}
+
+	// A single bucket yields a symmetric bell curve peaking at its midpoint.
+	xs, ys = genLinearHistogram([]float64{0, 2}, 10).SmoothedDensity(3, 1)
+	if xs[1] != 1 || !almostEqual(float64(ys[1]), 10/math.Sqrt(2*math.Pi), 1e-9) || ys[0] != ys[2] {
+		t.Errorf("unexpected curve %v, %v", xs, ys)
+	}
+
+	for _, args := range []struct {
+		points    int
+		bandwidth float64
+	}{{1, 1}, {10, 0}, {10, -1}, {10, math.NaN()}} {
+		if xs, ys := h.SmoothedDensity(args.points, args.bandwidth); xs != nil || ys != nil {
+			t.Errorf("%v: expected nil, got %v, %v", args, xs, ys)
+		}
+	}
+	if xs, ys := (&SampleHistogram{}).SmoothedDensity(10, 1); xs != nil || ys != nil {
+		t.Errorf("expected nil for empty histogram, got %v, %v", xs, ys)
+	}
+}
+
+func TestSampleHistogramDetectInternalReset(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 3}, 1, 2, 3)
+	if i, ok := h.DetectInternalReset(); ok {
+		t.Errorf("expected consistent histogram, got reset at %d", i)
+	}
+
+	h.Count = 2.5
+	if i, ok := h.DetectInternalReset(); !ok || i != 1 {
+		t.Errorf("expected reset at 1, got %d (%v)", i, ok)
+	}
+
+	h = &SampleHistogram{Count: 1, Buckets: HistogramBuckets{nil, {Count: 2}}}
+	if i, ok := h.DetectInternalReset(); !ok || i != 1 {
+		t.Errorf("expected reset at 1, got %d (%v)", i, ok)
+	}
+	if _, ok := (&SampleHistogram{}).DetectInternalReset(); ok {
+		t.Error("expected empty histogram to be consistent")
+	}
+}
+
+func TestSampleHistogramBuildQuantileTable(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4, 8}, 10, 40, 30, 20)
+	table := h.BuildQuantileTable(101)
+	// Quantiles at the resolution of the table and within buckets are
+	// exact, as the interpolation is linear within buckets, too.
+	for _, q := range []float64{0, 0.05, 0.3, 0.5, 0.77, 0.99, 1} {
+		expected, _ := h.Quantile(q)
+		if got := table.Lookup(q); !almostEqual(float64(got), float64(expected), 1e-9) {
+			t.Errorf("%v: expected %v, got %v", q, expected, got)
+		}
+	}
+	// Quantiles between table entries in different buckets are
+	// approximations: halfway between 0 and the median 2 instead of 1.375.
+	coarse := h.BuildQuantileTable(3)
+	if got := coarse.Lookup(0.25); got != 1 {
+		t.Errorf("expected 1, got %v", got)
+	}
+
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		if got := table.Lookup(q); !math.IsNaN(float64(got)) {
+			t.Errorf("%v: expected NaN, got %v", q, got)
+		}
+	}
+	if table := h.BuildQuantileTable(1); table != nil {
+		t.Error("expected nil table for resolution 1")
+	}
+	if table := (&SampleHistogram{}).BuildQuantileTable(10); table != nil {
+		t.Error("expected nil table for empty histogram")
+	}
+	if got := (*QuantileTable)(nil).Lookup(0.5); !math.IsNaN(float64(got)) {
+		t.Errorf("expected NaN for nil table, got %v", got)
+	}
+}
+
+func benchmarkQuantileHistogram() *SampleHistogram {
+	h := &SampleHistogram{}
+	for i := 0; i < 160; i++ {
+		h.Buckets = append(h.Buckets, &HistogramBucket{
+			Lower: FloatString(math.Pow(2, float64(i)/8)),
+			Upper: FloatString(math.Pow(2, float64(i+1)/8)),
+			Count: FloatString(i % 17),
+		})
+		h.Count += FloatString(i % 17)
+	}
+	return h
+}
+
+// BenchmarkSampleHistogramQuantileRepeated looks up 100 quantiles with
+// Quantile, to be compared with BenchmarkQuantileTableLookup.
+func BenchmarkSampleHistogramQuantileRepeated(b *testing.B) {
+	h := benchmarkQuantileHistogram()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for q := 0; q < 100; q++ {
+			if _, err := h.Quantile(float64(q) / 100); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkQuantileTableLookup builds a table and looks up the same 100
+// quantiles as BenchmarkSampleHistogramQuantileRepeated.
+func BenchmarkQuantileTableLookup(b *testing.B) {
+	h := benchmarkQuantileHistogram()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table := h.BuildQuantileTable(1001)
+		for q := 0; q < 100; q++ {
+			table.Lookup(float64(q) / 100)
+		}
+	}
+}
+
+func TestSampleHistogramProbExceeds(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 40, 50)
+	tests := []struct {
+		x        FloatString
+		expected float64
+	}{
+		{x: -1, expected: 1},
+		{x: 0, expected: 1},
+		{x: 1, expected: 0.9},
+		{x: 3, expected: 0.25},
+		{x: 4, expected: 0},
+		{x: 100, expected: 0},
+	}
+	for _, test := range tests {
+		got := h.ProbExceeds(test.x)
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%v: expected %v, got %v", test.x, test.expected, got)
+		}
+		if !almostEqual(float64(got+h.CDF(test.x)), 1, 1e-9) {
+			t.Errorf("%v: expected complement of CDF, got %v", test.x, got)
+		}
+	}
+	if got := (&SampleHistogram{}).ProbExceeds(1); got != 0 {
+		t.Errorf("expected 0 for empty histogram, got %v", got)
+	}
+
+	// Observations of the overflow bucket exceed its finite bound.
+	withInf := genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3)
+	if got := withInf.ProbExceeds(10); got != 0.75 {
+		t.Errorf("expected 0.75, got %v", got)
+	}
+}
+
+func TestSampleHistogramSurvivalCurve(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 0, 40, 60)
+	xs, ys := h.SurvivalCurve(7)
+	expectedXs := []FloatString{1, 1.5, 2, 2.5, 3, 3.5, 4}
+	expectedYs := []FloatString{1, 0.8, 0.6, 0.45, 0.3, 0.15, 0}
+	if len(xs) != len(expectedXs) || len(ys) != len(expectedYs) {
+		t.Fatalf("expected %d points, got %d and %d", len(expectedXs), len(xs), len(ys))
+	}
+	for i := range xs {
+		if !almostEqual(float64(xs[i]), float64(expectedXs[i]), 1e-9) || !almostEqual(float64(ys[i]), float64(expectedYs[i]), 1e-9) {
+			t.Errorf("point %d: expected (%v,%v), got (%v,%v)", i, expectedXs[i], expectedYs[i], xs[i], ys[i])
+		}
+		if i > 0 && ys[i] > ys[i-1] {
+			t.Errorf("point %d: expected non-increasing values, got %v after %v", i, ys[i], ys[i-1])
+		}
+	}
+
+	// The overflow bucket contributes its finite bound, above which its
+	// observations remain.
+	h.Buckets = append(h.Buckets, &HistogramBucket{Lower: 4, Upper: FloatString(math.Inf(1)), Count: 10})
+	xs, ys = h.SurvivalCurve(2)
+	if xs[1] != 4 || !almostEqual(float64(ys[1]), 10.0/110, 1e-12) {
+		t.Errorf("expected curve to end at (4,%v), got (%v,%v)", 10.0/110, xs[1], ys[1])
+	}
+
+	if xs, ys := h.SurvivalCurve(1); xs != nil || ys != nil {
+		t.Errorf("expected nil for a single point, got %v, %v", xs, ys)
+	}
+	if xs, ys := (&SampleHistogram{}).SurvivalCurve(5); xs != nil || ys != nil {
+		t.Errorf("expected nil for empty histogram, got %v, %v", xs, ys)
+	}
+}
+
+func TestQuantileAgreement(t *testing.T) {
+	original := genLinearHistogram([]float64{0, 1, 2, 3, 4}, 10, 20, 30, 40)
+	// The downsampled histogram is exact at the median but coarser above.
+	downsampled := genLinearHistogram([]float64{0, 2, 4}, 30, 70)
+
+	tests := []struct {
+		qs       []float64
+		expected float64
+	}{
+		{qs: []float64{0.3}, expected: 0},
+		{qs: []float64{0.5}, expected: (2 + 2.0/3 - (2 + 40.0/70)) / (2 + 2.0/3)},
+		{qs: []float64{0.3, 0.5, 0.99}, expected: (2 + 2.0/3 - (2 + 40.0/70)) / (2 + 2.0/3)},
+		{qs: []float64{0.99}, expected: (3.975 - (2 + 138.0/70)) / 3.975},
+	}
+	for _, test := range tests {
+		got, err := QuantileAgreement(original, downsampled, test.qs)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.qs, err)
+		}
+		if !almostEqual(got, test.expected, 1e-9) {
+			t.Errorf("%v: expected %v, got %v", test.qs, test.expected, got)
+		}
+	}
+	if got, _ := QuantileAgreement(original, original, []float64{0, 0.5, 1}); got != 0 {
+		t.Errorf("expected 0 for identical histograms, got %v", got)
+	}
+
+	if _, err := QuantileAgreement(original, nil, []float64{0.5}); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+	if _, err := QuantileAgreement(original, downsampled, nil); err == nil {
+		t.Error("expected error for no quantiles")
+	}
+	if _, err := QuantileAgreement(original, downsampled, []float64{0.5, 2}); err == nil {
+		t.Error("expected error for invalid quantile")
+	}
+	if _, err := QuantileAgreement(original, &SampleHistogram{}, []float64{0.5}); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramHarmonicMean(t *testing.T) {
+	tests := []struct {
+		histogram *SampleHistogram
+		expected  float64
+	}{
+		{
+			histogram: genLinearHistogram([]float64{0, 2, 4}, 1, 1),
+			expected:  2 / (1.0/1 + 1.0/3),
+		},
+		{
+			// Empty buckets do not count, whatever their midpoint.
+			histogram: genLinearHistogram([]float64{-2, 0, 2, 6}, 0, 3, 1),
+			expected:  4 / (3.0/1 + 1.0/4),
+		},
+		{
+			histogram: &SampleHistogram{Buckets: HistogramBuckets{
+				{Lower: 10, Upper: FloatString(math.Inf(1)), Count: 2},
+			}},
+			expected: 10,
+		},
+	}
+	for i, test := range tests {
+		got, err := test.histogram.HarmonicMean()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !almostEqual(float64(got), test.expected, 1e-12) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	if _, err := genLinearHistogram([]float64{-2, 0, 2}, 1, 1).HarmonicMean(); err == nil {
+		t.Error("expected error for negative midpoint")
+	}
+	if _, err := (&SampleHistogram{}).HarmonicMean(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramGeometricMean(t *testing.T) {
+	tests := []struct {
+		histogram *SampleHistogram
+		expected  float64
+	}{
+		{
+			histogram: genLinearHistogram([]float64{0, 2, 6}, 1, 1),
+			expected:  2,
+		},
+		{
+			histogram: genLinearHistogram([]float64{-2, 0, 2, 6}, 0, 3, 1),
+			expected:  math.Pow(4, 0.25),
+		},
+		{
+			histogram: genLinearHistogram([]float64{10, 1000}, 5),
+			expected:  505,
+		},
+	}
+	for i, test := range tests {
+		got, err := test.histogram.GeometricMean()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !almostEqual(float64(got), test.expected, 1e-12) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	if _, err := genLinearHistogram([]float64{-1, 1, 2}, 1, 1).GeometricMean(); err == nil {
+		t.Error("expected error for zero midpoint")
+	}
+	if _, err := (&SampleHistogram{}).GeometricMean(); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramEqualCountEdges(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 20, 10)
+	tests := []struct {
+		n        int
+		expected []FloatString
+	}{
+		{n: 1, expected: []FloatString{0, 4}},
+		{n: 2, expected: []FloatString{0, 1.5, 4}},
+		{n: 4, expected: []FloatString{0, 1, 1.5, 2, 4}},
+		{n: 5, expected: []FloatString{0, 0.8, 1.3, 1.7, 2.4, 4}},
+	}
+	for _, test := range tests {
+		got, err := h.EqualCountEdges(test.n)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", test.n, err)
+		}
+		if len(got) != len(test.expected) {
+			t.Fatalf("%d: expected %v, got %v", test.n, test.expected, got)
+		}
+		for i := range got {
+			if !almostEqual(float64(got[i]), float64(test.expected[i]), 1e-12) {
+				t.Errorf("%d: expected %v, got %v", test.n, test.expected, got)
+				break
+			}
+		}
+	}
+
+	if _, err := h.EqualCountEdges(0); err == nil {
+		t.Error("expected error for zero groups")
+	}
+	if _, err := (&SampleHistogram{}).EqualCountEdges(2); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramBucketZScores(t *testing.T) {
+	baseline := genLinearHistogram([]float64{0, 1, 2, 4}, 100, 25, 0)
+	current := genLinearHistogram([]float64{0, 2, 4}, 180, 10)
+
+	got, err := current.BucketZScores(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		"(0,1]": (90 - 100) / 10.0,
+		"(1,2]": (90 - 25) / 5.0,
+		"(2,4]": math.Inf(1),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	withInf := genLinearHistogram([]float64{0, 5, 10, math.Inf(1)}, 1, 2, 3)
+	for _, h := range []*SampleHistogram{baseline, withInf} {
+		got, err = h.BucketZScores(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(h.Buckets) {
+			t.Errorf("expected %d scores, got %v", len(h.Buckets), got)
+		}
+		for k, z := range got {
+			if z != 0 {
+				t.Errorf("%s: expected 0 against itself, got %v", k, z)
+			}
+		}
+	}
+
+	if _, err := current.BucketZScores(nil); err == nil {
+		t.Error("expected error for nil baseline")
+	}
+}
+
+func TestSampleHistogramLogQuantile(t *testing.T) {
+	h := genLinearHistogram([]float64{-1, 0, 1, 100, 10000}, 10, 10, 20, 10)
+	tests := []struct {
+		q        float64
+		expected float64
+	}{
+		{q: 0, expected: -1},
+		{q: 0.1, expected: -0.5},
+		{q: 0.3, expected: 0.5},
+		{q: 0.4, expected: 1},
+		{q: 0.6, expected: 10},
+		{q: 0.7, expected: 31.622776601683793},
+		{q: 0.9, expected: 1000},
+		{q: 1, expected: 10000},
+	}
+	for _, test := range tests {
+		got, err := h.LogQuantile(test.q)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.q, err)
+		}
+		if !almostEqual(float64(got), test.expected, 1e-9) {
+			t.Errorf("%v: expected %v, got %v", test.q, test.expected, got)
+		}
+	}
+
+	// The +Inf bucket yields its lower bound, like with Quantile.
+	inf := &SampleHistogram{Buckets: HistogramBuckets{{Lower: 10, Upper: FloatString(math.Inf(1)), Count: 1}}}
+	if got, _ := inf.LogQuantile(0.5); got != 10 {
+		t.Errorf("expected 10, got %v", got)
+	}
+
+	if _, err := h.LogQuantile(1.5); err == nil {
+		t.Error("expected error for invalid quantile")
+	}
+	if _, err := (&SampleHistogram{}).LogQuantile(0.5); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramDetectQuantization(t *testing.T) {
+	edges := []float64{0, 1, 2, 3, 4, 5, 6, 7, 8}
+	tests := []struct {
+		name       string
+		histogram  *SampleHistogram
+		detected   bool
+		confidence float64
+	}{
+		{
+			name:       "sawtooth",
+			histogram:  genLinearHistogram(edges, 10, 0, 12, 0, 9, 0, 11, 0),
+			detected:   true,
+			confidence: 1,
+		},
+		{
+			name:       "flat",
+			histogram:  genLinearHistogram(edges, 5, 5, 5, 5, 5, 5, 5, 5),
+			confidence: 0,
+		},
+		{
+			name:       "peak",
+			histogram:  genLinearHistogram(edges, 0, 1, 2, 10, 2, 1, 0, 0),
+			confidence: 1.0 / 3 * 15 / 27,
+		},
+		{
+			name:       "noisy",
+			histogram:  genLinearHistogram(edges, 10, 11, 10, 11, 10, 11, 10, 11),
+			confidence: 1 / 21.0,
+		},
+		{
+			name:      "too few buckets",
+			histogram: genLinearHistogram(edges, 0, 0, 10, 0, 10, 0, 0, 0),
+		},
+		{
+			name:      "empty",
+			histogram: &SampleHistogram{},
+		},
+	}
+	for _, test := range tests {
+		detected, confidence := test.histogram.DetectQuantization()
+		if detected != test.detected || !almostEqual(confidence, test.confidence, 1e-12) {
+			t.Errorf("%s: expected %v (%v), got %v (%v)", test.name, test.detected, test.confidence, detected, confidence)
+		}
+	}
+}
+
+func TestSampleHistogramEstimatedSum(t *testing.T) {
+	tests := []struct {
+		histogram *SampleHistogram
+		expected  FloatString
+	}{
+		{histogram: &SampleHistogram{}, expected: 0},
+		{histogram: genLinearHistogram([]float64{0, 2, 6}, 3, 1), expected: 3*1 + 1*4},
+		{
+			histogram: &SampleHistogram{Sum: 100, Buckets: HistogramBuckets{
+				{Lower: FloatString(math.Inf(-1)), Upper: -1, Count: 2},
+				nil,
+				{Lower: -1, Upper: 1, Count: 5},
+				{Lower: 10, Upper: FloatString(math.Inf(1)), Count: 3},
+			}},
+			expected: 2*-1 + 0 + 3*10,
+		},
+	}
+	for i, test := range tests {
+		if got := test.histogram.EstimatedSum(); got != test.expected {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestSampleHistogramPeakDensityValue(t *testing.T) {
+	// The wide bucket holds the most observations, the narrow one is densest.
+	// Unlike ModeValue, the midpoint is returned regardless of the
+	// neighbours.
+	h := genLinearHistogram([]float64{0, 1, 1.5, 10}, 4, 3, 20)
+	if got, ok := h.PeakDensityValue(); !ok || got != 1.25 {
+		t.Errorf("expected 1.25, got %v (%v)", got, ok)
+	}
+	if got, _ := h.ModeValue(); got == 1.25 {
+		t.Errorf("expected ModeValue to differ from the midpoint, got %v", got)
+	}
+
+	// Buckets with equal bounds are densest, those with an infinite bound
+	// only count if nothing else is populated.
+	h = &SampleHistogram{Buckets: HistogramBuckets{
+		{Lower: 0, Upper: 1, Count: 1000},
+		{Boundaries: 3, Lower: 5, Upper: 5, Count: 1},
+		{Lower: 5, Upper: FloatString(math.Inf(1)), Count: 5000},
+	}}
+	if got, ok := h.PeakDensityValue(); !ok || got != 5 {
+		t.Errorf("expected 5, got %v (%v)", got, ok)
+	}
+	h.Buckets[0].Count, h.Buckets[1].Count = 0, 0
+	if got, ok := h.PeakDensityValue(); !ok || got != 5 {
+		t.Errorf("expected 5 for overflow bucket, got %v (%v)", got, ok)
+	}
+	if _, ok := (&SampleHistogram{}).PeakDensityValue(); ok {
+		t.Error("expected no value for empty histogram")
+	}
+}
+
+func TestSampleHistogramConditionalMeanAbove(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 1, 2, 4}, 10, 20, 10)
+	tests := []struct {
+		threshold FloatString
+		expected  FloatString
+	}{
+		{threshold: -1, expected: (10*0.5 + 20*1.5 + 10*3) / 40.0},
+		{threshold: 2, expected: 3},
+		// Half of the (1,2] bucket counts, located at 1.75.
+		{threshold: 1.5, expected: (10*1.75 + 10*3) / 20.0},
+		{threshold: 3.5, expected: 3.75},
+	}
+	for _, test := range tests {
+		got, err := h.ConditionalMeanAbove(test.threshold)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.threshold, err)
+		}
+		if got != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.threshold, test.expected, got)
+		}
+	}
+
+	withInf := &SampleHistogram{Buckets: HistogramBuckets{
+		{Lower: 0, Upper: 10, Count: 5},
+		{Lower: 10, Upper: FloatString(math.Inf(1)), Count: 5},
+	}}
+	if got, _ := withInf.ConditionalMeanAbove(5); got != (2.5*7.5+5*10)/7.5 {
+		t.Errorf("expected %v, got %v", (2.5*7.5+5*10)/7.5, got)
+	}
+
+	// The observations of an overflow bucket exceed its finite bound.
+	overflow := genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3)
+	for _, test := range []struct {
+		threshold, expected FloatString
+	}{
+		{threshold: 10, expected: 10},
+		{threshold: 5, expected: (0.5*7.5 + 3*10) / 3.5},
+	} {
+		got, err := overflow.ConditionalMeanAbove(test.threshold)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.threshold, err)
+		}
+		if got != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.threshold, test.expected, got)
+		}
+	}
+
+	// Unless it includes its finite bound, like ProbExceeds assumes.
+	for _, boundaries := range []int32{1, 3} {
+		overflow.Buckets[1].Boundaries = boundaries
+		if got, err := overflow.ConditionalMeanAbove(10); err == nil {
+			t.Errorf("boundaries %d: expected error, got %v", boundaries, got)
+		}
+		if got := overflow.ProbExceeds(10); got != 0 {
+			t.Errorf("boundaries %d: expected ProbExceeds 0, got %v", boundaries, got)
+		}
+	}
+
+	if _, err := h.ConditionalMeanAbove(4); err == nil {
+		t.Error("expected error for threshold above all observations")
+	}
+	if _, err := (&SampleHistogram{}).ConditionalMeanAbove(0); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramEquivalentTo(t *testing.T) {
+	h := genLinearHistogram([]float64{0, 2, 4, 8}, 4, 2, 8)
+	tests := []struct {
+		name     string
+		other    *SampleHistogram
+		epsilon  float64
+		expected bool
+	}{
+		{name: "same", other: h, expected: true},
+		{name: "split", other: genLinearHistogram([]float64{0, 1, 2, 4, 6, 8}, 2, 2, 2, 4, 4), expected: true},
+		{name: "merged", other: genLinearHistogram([]float64{0, 4, 8}, 6, 8), expected: false},
+		{name: "uneven split", other: genLinearHistogram([]float64{0, 1, 2, 4, 8}, 3, 1, 2, 8), expected: false},
+		{name: "within epsilon", other: genLinearHistogram([]float64{0, 1, 2, 4, 8}, 2.05, 1.95, 2, 8), epsilon: 0.1, expected: true},
+		{name: "shifted", other: genLinearHistogram([]float64{1, 3, 5, 9}, 4, 2, 8), epsilon: 0.1, expected: false},
+		{name: "nil", other: nil, expected: false},
+	}
+	for _, test := range tests {
+		if got := h.EquivalentTo(test.other, test.epsilon); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+		if test.other != nil {
+			if got := test.other.EquivalentTo(h, test.epsilon); got != test.expected {
+				t.Errorf("%s reversed: expected %v, got %v", test.name, test.expected, got)
+			}
+		}
+	}
+
+	// Observations of an overflow bucket are not equivalent to those below
+	// its finite bound.
+	inf := math.Inf(1)
+	withInf := genLinearHistogram([]float64{0, 10, inf}, 1, 3)
+	if withInf.EquivalentTo(genLinearHistogram([]float64{0, 10}, 4), 1e-9) {
+		t.Errorf("expected %v not to be equivalent to its overflow moved below 10", withInf)
+	}
+	if !withInf.EquivalentTo(genLinearHistogram([]float64{0, 5, 10, inf}, 0.5, 0.5, 3), 1e-9) {
+		t.Errorf("expected %v to be equivalent to its split", withInf)
+	}
+
+	// Rebucketing onto finer buckets preserves the distribution.
+	aligned, err := h.AlignTo(genLinearHistogram([]float64{0, 0.5, 2, 3, 4, 8}, 0, 0, 0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.EquivalentTo(aligned, 1e-12) {
+		t.Errorf("expected %v to be equivalent to %v", aligned, h)
+	}
+}
+
+func TestSampleHistogramOutlierFences(t *testing.T) {
+	tests := []struct {
+		histogram    *SampleHistogram
+		k            float64
+		lower, upper FloatString
+	}{
+		// Q1 = 11, Q3 = 13.
+		{histogram: genLinearHistogram([]float64{10, 12, 14}, 5, 5), k: 1.5, lower: 8, upper: 16},
+		{histogram: genLinearHistogram([]float64{10, 12, 14}, 5, 5), k: 0, lower: 11, upper: 13},
+		// Q1 = 1, Q3 = 3, so that the lower fence is raised to the minimum.
+		{histogram: genLinearHistogram([]float64{0, 2, 4}, 5, 5), k: 1.5, lower: 0, upper: 6},
+		// Negative fences are only raised if they lie below the minimum.
+		{histogram: genLinearHistogram([]float64{-20, -12, -4}, 5, 5), k: 1, lower: -20, upper: 0},
+		{histogram: genLinearHistogram([]float64{-20, -12, -4}, 5, 5), k: 0.5, lower: -20, upper: -4},
+		{histogram: genLinearHistogram([]float64{-20, -12, -4}, 5, 5), k: 0.25, lower: -18, upper: -6},
+	}
+	for i, test := range tests {
+		lower, upper, err := test.histogram.OutlierFences(test.k)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if lower != test.lower || upper != test.upper {
+			t.Errorf("%d: expected [%v, %v], got [%v, %v]", i, test.lower, test.upper, lower, upper)
+		}
+	}
+
+	h := genLinearHistogram([]float64{0, 1}, 1)
+	if _, _, err := h.OutlierFences(-1); err == nil {
+		t.Error("expected error for negative fence factor")
+	}
+	if _, _, err := (&SampleHistogram{}).OutlierFences(1.5); err == nil {
+		t.Error("expected error for empty histogram")
+	}
+}
+
+func TestSampleHistogramEmptyBucketFraction(t *testing.T) {
+	tests := []struct {
+		histogram *SampleHistogram
+		expected  float64
+	}{
+		{histogram: &SampleHistogram{}, expected: 0},
+		{histogram: genLinearHistogram([]float64{0, 1, 2}, 1, 2), expected: 0},
+		{histogram: genLinearHistogram([]float64{0, 1, 2, 3, 4}, 0, 2, 0, 0), expected: 0.75},
+		{histogram: &SampleHistogram{Buckets: HistogramBuckets{nil, {Lower: 0, Upper: 1}, nil}}, expected: 1},
+	}
+	for i, test := range tests {
+		if got := test.histogram.EmptyBucketFraction(); got != test.expected {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestBlendHistograms(t *testing.T) {
+	a := genLinearHistogram([]float64{0, 1, 2}, 10, 20)
+	a.Sum = 35
+	b := genLinearHistogram([]float64{0, 2, 4}, 40, 60)
+	b.Sum = 250
+
+	tests := []struct {
+		a, b     *SampleHistogram
+		wa, wb   float64
+		expected *SampleHistogram
+	}{
+		{
+			a: a, b: a, wa: 0.5, wb: 2,
+			expected: &SampleHistogram{Count: 75, Sum: 87.5, Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1, Count: 25},
+				{Lower: 1, Upper: 2, Count: 50},
+			}},
+		},
+		{
+			a: a, b: b, wa: 0.8, wb: 0.2,
+			expected: &SampleHistogram{Count: 44, Sum: 78, Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1, Count: 8 + 4},
+				{Lower: 1, Upper: 2, Count: 16 + 4},
+				{Lower: 2, Upper: 4, Count: 12},
+			}},
+		},
+		{
+			a: a, b: b, wa: 0, wb: 1,
+			expected: &SampleHistogram{Count: 100, Sum: 250, Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1, Count: 20},
+				{Lower: 1, Upper: 2, Count: 20},
+				{Lower: 2, Upper: 4, Count: 60},
+			}},
+		},
+	}
+	for i, test := range tests {
+		got, err := BlendHistograms(test.a, test.wa, test.b, test.wb)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+	if a.Count != 30 || a.Buckets[0].Count != 10 {
+		t.Errorf("input histogram was modified: %v", a)
+	}
+
+	// Overflow buckets are blended with each other only.
+	inf := math.Inf(1)
+	c := genLinearHistogram([]float64{0, 5, 10, inf}, 1, 2, 3)
+	d := genLinearHistogram([]float64{0, 10, inf}, 1, 1)
+	for _, test := range []struct {
+		wc, wd   float64
+		expected *SampleHistogram
+	}{
+		{wc: 1, wd: 0, expected: c},
+		{wc: 0.5, wd: 0.5, expected: genLinearHistogram([]float64{0, 5, 10, inf}, 0.75, 1.25, 2)},
+	} {
+		got, err := BlendHistograms(c, test.wc, d, test.wd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("%v, %v: expected %v, got %v", test.wc, test.wd, test.expected, got)
+		}
+	}
+
+	if _, err := BlendHistograms(a, 1, nil, 1); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+	if _, err := BlendHistograms(a, -1, b, 1); err == nil {
+		t.Error("expected error for negative weight")
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// HistogramSeriesToMatrix rebuckets every histogram of the series onto the
+// intervals between the given edges. It returns the timestamps of the pairs
+// together with a matrix holding one row of bucket counts per timestamp.
+func HistogramSeriesToMatrix(pairs []SampleHistogramPair, edges []FloatString) ([]Time, [][]FloatString, error) {
+	fedges, err := checkEdges(edges)
+	if err != nil {
+		return nil, nil, err
+	}
+	times := make([]Time, len(pairs))
+	rows := make([][]FloatString, len(pairs))
+	for i, p := range pairs {
+		if p.Histogram == nil {
+			return nil, nil, fmt.Errorf("histogram at %s is nil", p.Timestamp)
+		}
+		counts := p.Histogram.rebucketCounts(fedges)
+		row := make([]FloatString, len(counts))
+		for j, c := range counts {
+			row[j] = FloatString(c)
+		}
+		times[i] = p.Timestamp
+		rows[i] = row
+	}
+	return times, rows, nil
+}
+
+// ValidateCumulativeSeries checks that a series of cumulative histograms
+// only ever grows. The series is de-cumulated into deltas between
+// consecutive pairs, which must not be negative beyond the given tolerance
+// for the total count nor for any bucket. Additionally, the bucket deltas of
+// every step must add up to its total count delta within the tolerance. The
+// returned error names the timestamp of the first inconsistent pair.
+func ValidateCumulativeSeries(pairs []SampleHistogramPair, tolerance float64) error {
+	for i, p := range pairs {
+		if p.Histogram == nil {
+			return fmt.Errorf("histogram at %s is nil", p.Timestamp)
+		}
+		if i == 0 {
+			continue
+		}
+		prev, cur := pairs[i-1].Histogram, p.Histogram
+		if !p.Timestamp.After(pairs[i-1].Timestamp) {
+			return fmt.Errorf("inconsistent histogram at %s: timestamps not increasing", p.Timestamp)
+		}
+		if !cur.SameSchema(prev) {
+			return fmt.Errorf("inconsistent histogram at %s: bucket schema changed", p.Timestamp)
+		}
+		delta := float64(cur.Count - prev.Count)
+		if delta < -tolerance {
+			return fmt.Errorf("inconsistent histogram at %s: count decreased by %v", p.Timestamp, -delta)
+		}
+		var bucketDelta float64
+		for j, b := range cur.Buckets {
+			if b == nil {
+				continue
+			}
+			d := float64(b.Count - prev.Buckets[j].Count)
+			if d < -tolerance {
+				return fmt.Errorf("inconsistent histogram at %s: count of bucket %d decreased by %v", p.Timestamp, j, -d)
+			}
+			bucketDelta += d
+		}
+		if math.Abs(bucketDelta-delta) > tolerance {
+			return fmt.Errorf("inconsistent histogram at %s: bucket deltas sum to %v but count grew by %v", p.Timestamp, bucketDelta, delta)
+		}
+	}
+	return nil
+}
+
+// InterpolateHistogram estimates the histogram at the timestamp at, which
+// must lie between the timestamps of a and b, by linearly interpolating the
+// count of every bucket as well as the total count and sum. Buckets present
+// in only one of the histograms are interpolated from an implicit count of 0
+// in the other one.
+func InterpolateHistogram(a, b SampleHistogramPair, at Time) (*SampleHistogramPair, error) {
+	if a.Histogram == nil || b.Histogram == nil {
+		return nil, fmt.Errorf("histogram is nil")
+	}
+	if at.Before(a.Timestamp) || at.After(b.Timestamp) {
+		return nil, fmt.Errorf("timestamp %s outside of [%s,%s]", at, a.Timestamp, b.Timestamp)
+	}
+	var f float64
+	if b.Timestamp != a.Timestamp {
+		f = float64(at-a.Timestamp) / float64(b.Timestamp-a.Timestamp)
+	}
+	lerp := func(x, y FloatString) FloatString {
+		return x + FloatString(f)*(y-x)
+	}
+
+	h := &SampleHistogram{
+		Count: lerp(a.Histogram.Count, b.Histogram.Count),
+		Sum:   lerp(a.Histogram.Sum, b.Histogram.Sum),
+	}
+	index := map[bucketKey]*HistogramBucket{}
+	for _, bucket := range a.Histogram.Buckets {
+		if bucket == nil {
+			continue
+		}
+		nb := &HistogramBucket{
+			Boundaries: bucket.Boundaries,
+			Lower:      bucket.Lower,
+			Upper:      bucket.Upper,
+			Count:      lerp(bucket.Count, 0),
+		}
+		index[bucket.key()] = nb
+		h.Buckets = append(h.Buckets, nb)
+	}
+	for _, bucket := range b.Histogram.Buckets {
+		if bucket == nil {
+			continue
+		}
+		if nb, ok := index[bucket.key()]; ok {
+			nb.Count += FloatString(f) * bucket.Count
+			continue
+		}
+		h.Buckets = append(h.Buckets, &HistogramBucket{
+			Boundaries: bucket.Boundaries,
+			Lower:      bucket.Lower,
+			Upper:      bucket.Upper,
+			Count:      lerp(0, bucket.Count),
+		})
+	}
+	h.Buckets = h.sortedBuckets()
+	return &SampleHistogramPair{Timestamp: at, Histogram: h}, nil
+}
+
+// WeightedMeanTimestamp returns the average timestamp of the series, with
+// every pair weighted by the total count of its histogram. Pairs without a
+// histogram are skipped.
+func WeightedMeanTimestamp(pairs []SampleHistogramPair) (Time, error) {
+	if len(pairs) == 0 {
+		return 0, fmt.Errorf("series is empty")
+	}
+	var weighted, total float64
+	for _, p := range pairs {
+		if p.Histogram == nil {
+			continue
+		}
+		weighted += float64(p.Timestamp) * float64(p.Histogram.Count)
+		total += float64(p.Histogram.Count)
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("total count of series is zero")
+	}
+	return Time(math.Round(weighted / total)), nil
+}
+
+// HistogramSeriesQuantile returns the q-quantile (0 <= q <= 1) of every
+// histogram of the series as a scalar series. Pairs without a histogram are
+// skipped, while empty histograms yield NaN, like histogram_quantile does in
+// PromQL.
+func HistogramSeriesQuantile(pairs []SampleHistogramPair, q float64) ([]SamplePair, error) {
+	if !(q >= 0 && q <= 1) {
+		return nil, fmt.Errorf("quantile %v must be in [0,1]", q)
+	}
+	res := make([]SamplePair, 0, len(pairs))
+	for _, p := range pairs {
+		if p.Histogram == nil {
+			continue
+		}
+		v := SampleValue(math.NaN())
+		if p.Histogram.bucketTotal() > 0 {
+			quantile, err := p.Histogram.Quantile(q)
+			if err != nil {
+				return nil, fmt.Errorf("quantile at %s: %w", p.Timestamp, err)
+			}
+			v = SampleValue(quantile)
+		}
+		res = append(res, SamplePair{Timestamp: p.Timestamp, Value: v})
+	}
+	return res, nil
+}
+
+// AggregateHistogramsByTime adds up the histograms of all series of the
+// matrix that share a timestamp. Pairs without a histogram are skipped. The
+// histograms of a timestamp must share the same schema.
+func (m Matrix) AggregateHistogramsByTime() (map[Time]*SampleHistogram, error) {
+	res := map[Time]*SampleHistogram{}
+	for _, ss := range m {
+		if ss == nil {
+			continue
+		}
+		for _, p := range ss.Histograms {
+			if p.Histogram == nil {
+				continue
+			}
+			sum, ok := res[p.Timestamp]
+			if !ok {
+				res[p.Timestamp] = p.Histogram.copy()
+				continue
+			}
+			sum, err := sum.Add(p.Histogram)
+			if err != nil {
+				return nil, fmt.Errorf("histogram of %s at %s: %w", ss.Metric, p.Timestamp, err)
+			}
+			res[p.Timestamp] = sum
+		}
+	}
+	return res, nil
+}
+
+// HistogramSeries is a series of histograms sorted by timestamp, with at
+// most one pair per timestamp.
+type HistogramSeries []SampleHistogramPair
+
+// Upsert adds the histogram of pair to the one already in the series at the
+// same timestamp, or inserts pair at its sorted position if there is none.
+// Histograms added up must share the same schema. Pairs without a histogram
+// only create an empty entry for their timestamp.
+func (hs *HistogramSeries) Upsert(pair SampleHistogramPair) error {
+	s := *hs
+	i := sort.Search(len(s), func(i int) bool { return !s[i].Timestamp.Before(pair.Timestamp) })
+	if i < len(s) && s[i].Timestamp.Equal(pair.Timestamp) {
+		if pair.Histogram == nil {
+			return nil
+		}
+		if s[i].Histogram == nil {
+			s[i].Histogram = pair.Histogram
+			return nil
+		}
+		sum, err := s[i].Histogram.Add(pair.Histogram)
+		if err != nil {
+			return fmt.Errorf("histogram at %s: %w", pair.Timestamp, err)
+		}
+		s[i].Histogram = sum
+		return nil
+	}
+	s = append(s, SampleHistogramPair{})
+	copy(s[i+1:], s[i:])
+	s[i] = pair
+	*hs = s
+	return nil
+}
+
+// RollupHistogramSeries downsamples the series by adding up the histograms
+// of all pairs within consecutive windows of the given duration. Windows are
+// aligned to multiples of the duration since the epoch and include their
+// end but not their start. Every window holding at least one histogram
+// yields a pair timestamped at its end. The pairs must be sorted by
+// timestamp, pairs without a histogram are skipped, and the histograms of a
+// window must share the same schema.
+func RollupHistogramSeries(pairs []SampleHistogramPair, window time.Duration) ([]SampleHistogramPair, error) {
+	w := int64(window / time.Millisecond)
+	if w <= 0 {
+		return nil, fmt.Errorf("window %s must be at least 1ms", window)
+	}
+	var res []SampleHistogramPair
+	for i, p := range pairs {
+		if i > 0 && p.Timestamp.Before(pairs[i-1].Timestamp) {
+			return nil, fmt.Errorf("timestamps not sorted at %s", p.Timestamp)
+		}
+		if p.Histogram == nil {
+			continue
+		}
+		// The end of the window (end-w, end] holding the timestamp.
+		end := Time(-floorDiv(-int64(p.Timestamp), w) * w)
+		if n := len(res); n > 0 && res[n-1].Timestamp == end {
+			sum, err := res[n-1].Histogram.Add(p.Histogram)
+			if err != nil {
+				return nil, fmt.Errorf("histogram at %s: %w", p.Timestamp, err)
+			}
+			res[n-1].Histogram = sum
+			continue
+		}
+		res = append(res, SampleHistogramPair{Timestamp: end, Histogram: p.Histogram.copy()})
+	}
+	return res, nil
+}
+
+// floorDiv returns a/b rounded towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// DetectSchemaChanges returns the indices of the pairs whose histogram has a
+// different schema than the histogram of the previous pair, in ascending
+// order. Pairs without a histogram are skipped, so that a change is
+// detected against the last histogram before them. The returned indices
+// split the series into segments of consistent schema.
+func DetectSchemaChanges(pairs []SampleHistogramPair) []int {
+	var (
+		changes []int
+		prev    *SampleHistogram
+	)
+	for i, p := range pairs {
+		if p.Histogram == nil {
+			continue
+		}
+		if prev != nil && !p.Histogram.SameSchema(prev) {
+			changes = append(changes, i)
+		}
+		prev = p.Histogram
+	}
+	return changes
+}
+
+// At returns the latest pair of the series at or before t, found by binary
+// search. It returns false if all pairs are later than t.
+func (hs HistogramSeries) At(t Time) (*SampleHistogramPair, bool) {
+	i := sort.Search(len(hs), func(i int) bool { return hs[i].Timestamp.After(t) })
+	if i == 0 {
+		return nil, false
+	}
+	return &hs[i-1], true
+}
+
+// HistogramRing holds the latest pairs of a series up to a fixed capacity.
+// It is not safe for concurrent use.
+type HistogramRing struct {
+	pairs []SampleHistogramPair
+	start int // Index of the oldest pair.
+	n     int
+}
+
+// NewHistogramRing returns an empty ring holding at most capacity pairs. It
+// panics if capacity is not positive.
+func NewHistogramRing(capacity int) *HistogramRing {
+	if capacity < 1 {
+		panic(fmt.Sprintf("histogram ring capacity %d must be positive", capacity))
+	}
+	return &HistogramRing{pairs: make([]SampleHistogramPair, capacity)}
+}
+
+// Push adds the pair to the ring, evicting the oldest pair if the ring is
+// full. Pairs arriving out of order are moved to their position by
+// timestamp, and a pair older than all pairs of a full ring is dropped.
+func (r *HistogramRing) Push(pair SampleHistogramPair) {
+	capacity := len(r.pairs)
+	if r.n == capacity {
+		if pair.Timestamp.Before(r.pairs[r.start].Timestamp) {
+			return
+		}
+		r.start = (r.start + 1) % capacity
+		r.n--
+	}
+	// Shift later pairs towards the end to make room for the new one.
+	i := r.n
+	for ; i > 0; i-- {
+		prev := &r.pairs[(r.start+i-1)%capacity]
+		if !prev.Timestamp.After(pair.Timestamp) {
+			break
+		}
+		r.pairs[(r.start+i)%capacity] = *prev
+	}
+	r.pairs[(r.start+i)%capacity] = pair
+	r.n++
+}
+
+// Snapshot returns a copy of the pairs in the ring, sorted by timestamp.
+func (r *HistogramRing) Snapshot() []SampleHistogramPair {
+	res := make([]SampleHistogramPair, r.n)
+	for i := range res {
+		res[i] = r.pairs[(r.start+i)%len(r.pairs)]
+	}
+	return res
+}
+
+// MergeHistogramSeries interleaves the two series by timestamp, adding up
+// the histograms of pairs at the same timestamp, which must share the same
+// schema. Pairs without a histogram only create an empty entry for their
+// timestamp, like with Upsert. Additionally, it returns the timestamps of
+// the merged pairs that follow a gap of more than maxGap since the previous
+// pair, where the merged series lacks data.
+func MergeHistogramSeries(a, b HistogramSeries, maxGap time.Duration) (HistogramSeries, []Time, error) {
+	if maxGap <= 0 {
+		return nil, nil, fmt.Errorf("maximum gap %v must be positive", maxGap)
+	}
+	merged := make(HistogramSeries, 0, len(a)+len(b))
+	var gaps []Time
+	for len(a) > 0 || len(b) > 0 {
+		var p SampleHistogramPair
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].Timestamp.Before(b[0].Timestamp)):
+			p, a = a[0], a[1:]
+		case len(a) == 0 || b[0].Timestamp.Before(a[0].Timestamp):
+			p, b = b[0], b[1:]
+		default:
+			p = a[0]
+			switch {
+			case p.Histogram == nil:
+				p.Histogram = b[0].Histogram
+			case b[0].Histogram != nil:
+				sum, err := p.Histogram.Add(b[0].Histogram)
+				if err != nil {
+					return nil, nil, fmt.Errorf("histogram at %s: %w", p.Timestamp, err)
+				}
+				p.Histogram = sum
+			}
+			a, b = a[1:], b[1:]
+		}
+		if n := len(merged); n > 0 && p.Timestamp.Sub(merged[n-1].Timestamp) > maxGap {
+			gaps = append(gaps, p.Timestamp)
+		}
+		merged = append(merged, p)
+	}
+	return merged, gaps, nil
+}
@@ -0,0 +1,561 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistogramSeriesToMatrix(t *testing.T) {
+	pairs := []SampleHistogramPair{
+		{Timestamp: 1000, Histogram: genLinearHistogram([]float64{0, 1, 2}, 2, 4)},
+		{Timestamp: 2000, Histogram: genLinearHistogram([]float64{0, 2, 4}, 4, 8)},
+	}
+
+	times, rows, err := HistogramSeriesToMatrix(pairs, []FloatString{0, 2, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Time{1000, 2000}; !reflect.DeepEqual(times, expected) {
+		t.Errorf("expected timestamps %v, got %v", expected, times)
+	}
+	if expected := [][]FloatString{{6, 0}, {4, 8}}; !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+
+	_, rows, err = HistogramSeriesToMatrix(pairs, []FloatString{0, 0.5, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]FloatString{{1, 5}, {1, 7}}; !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+
+	// Observations of the overflow bucket lie above its finite bound.
+	inf := FloatString(math.Inf(1))
+	withInf := []SampleHistogramPair{{Timestamp: 1000, Histogram: genLinearHistogram([]float64{0, 10, math.Inf(1)}, 1, 3)}}
+	for _, test := range []struct {
+		edges    []FloatString
+		expected [][]FloatString
+	}{
+		{edges: []FloatString{0, 10, inf}, expected: [][]FloatString{{1, 3}}},
+		{edges: []FloatString{0, 5, 10}, expected: [][]FloatString{{0.5, 0.5}}},
+	} {
+		_, rows, err = HistogramSeriesToMatrix(withInf, test.edges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows, test.expected) {
+			t.Errorf("%v: expected rows %v, got %v", test.edges, test.expected, rows)
+		}
+	}
+
+	for _, edges := range [][]FloatString{nil, {1}, {1, 1}, {2, 1}} {
+		if _, _, err := HistogramSeriesToMatrix(pairs, edges); err == nil {
+			t.Errorf("expected error for edges %v", edges)
+		}
+	}
+	if _, _, err := HistogramSeriesToMatrix([]SampleHistogramPair{{Timestamp: 1}}, []FloatString{0, 1}); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+}
+
+func TestValidateCumulativeSeries(t *testing.T) {
+	edges := []float64{0, 1, 2}
+	tests := []struct {
+		name  string
+		pairs []SampleHistogramPair
+		err   string
+	}{
+		{
+			name: "consistent",
+			pairs: []SampleHistogramPair{
+				{Timestamp: 1000, Histogram: genLinearHistogram(edges, 1, 2)},
+				{Timestamp: 2000, Histogram: genLinearHistogram(edges, 3, 2)},
+				{Timestamp: 3000, Histogram: genLinearHistogram(edges, 3, 5)},
+			},
+		},
+		{
+			name: "count reset",
+			pairs: []SampleHistogramPair{
+				{Timestamp: 1000, Histogram: genLinearHistogram(edges, 1, 2)},
+				{Timestamp: 2000, Histogram: genLinearHistogram(edges, 0, 1)},
+			},
+			err: "inconsistent histogram at 2: count decreased by 2",
+		},
+		{
+			name: "bucket decrease",
+			pairs: []SampleHistogramPair{
+				{Timestamp: 1000, Histogram: genLinearHistogram(edges, 1, 2)},
+				{Timestamp: 2000, Histogram: genLinearHistogram(edges, 2, 3)},
+				{Timestamp: 3000, Histogram: genLinearHistogram(edges, 4, 2)},
+			},
+			err: "inconsistent histogram at 3: count of bucket 1 decreased by 1",
+		},
+		{
+			name: "count mismatch",
+			pairs: []SampleHistogramPair{
+				{Timestamp: 1000, Histogram: genLinearHistogram(edges, 1, 2)},
+				{Timestamp: 2000, Histogram: &SampleHistogram{Count: 5, Buckets: genLinearHistogram(edges, 2, 2).Buckets}},
+			},
+			err: "inconsistent histogram at 2: bucket deltas sum to 1 but count grew by 2",
+		},
+		{
+			name: "schema change",
+			pairs: []SampleHistogramPair{
+				{Timestamp: 1000, Histogram: genLinearHistogram(edges, 1, 2)},
+				{Timestamp: 2000, Histogram: genLinearHistogram([]float64{0, 2}, 3)},
+			},
+			err: "inconsistent histogram at 2: bucket schema changed",
+		},
+	}
+
+	for _, test := range tests {
+		err := ValidateCumulativeSeries(test.pairs, 1e-9)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	// Small deviations are accepted within the tolerance.
+	pairs := []SampleHistogramPair{
+		{Timestamp: 1000, Histogram: genLinearHistogram(edges, 1, 2)},
+		{Timestamp: 2000, Histogram: genLinearHistogram(edges, 0.99, 2.5)},
+	}
+	if err := ValidateCumulativeSeries(pairs, 0.1); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestInterpolateHistogram(t *testing.T) {
+	a := SampleHistogramPair{
+		Timestamp: 1000,
+		Histogram: &SampleHistogram{
+			Count: 4,
+			Sum:   10,
+			Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1, Count: 2},
+				{Lower: 1, Upper: 2, Count: 2},
+			},
+		},
+	}
+	b := SampleHistogramPair{
+		Timestamp: 3000,
+		Histogram: &SampleHistogram{
+			Count: 8,
+			Sum:   30,
+			Buckets: HistogramBuckets{
+				{Lower: 1, Upper: 2, Count: 6},
+				{Lower: 2, Upper: 4, Count: 2},
+			},
+		},
+	}
+
+	got, err := InterpolateHistogram(a, b, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SampleHistogramPair{
+		Timestamp: 1500,
+		Histogram: &SampleHistogram{
+			Count: 5,
+			Sum:   15,
+			Buckets: HistogramBuckets{
+				{Lower: 0, Upper: 1, Count: 1.5},
+				{Lower: 1, Upper: 2, Count: 3},
+				{Lower: 2, Upper: 4, Count: 0.5},
+			},
+		},
+	}
+	if !got.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got, err = InterpolateHistogram(a, b, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Histogram.Count != 8 || got.Histogram.Buckets[0].Count != 0 {
+		t.Errorf("expected histogram equal to the end point, got %v", got)
+	}
+
+	for _, at := range []Time{999, 3001} {
+		if _, err := InterpolateHistogram(a, b, at); err == nil {
+			t.Errorf("expected error for timestamp %s", at)
+		}
+	}
+	if _, err := InterpolateHistogram(a, SampleHistogramPair{Timestamp: 3000}, 2000); err == nil {
+		t.Error("expected error for nil histogram")
+	}
+}
+
+func TestWeightedMeanTimestamp(t *testing.T) {
+	pairs := []SampleHistogramPair{
+		{Timestamp: 1000, Histogram: genLinearHistogram([]float64{0, 1}, 1)},
+		{Timestamp: 2000, Histogram: genLinearHistogram([]float64{0, 1}, 0)},
+		{Timestamp: 3000},
+		{Timestamp: 5000, Histogram: genLinearHistogram([]float64{0, 1}, 3)},
+	}
+	got, err := WeightedMeanTimestamp(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 4000 {
+		t.Errorf("expected 4000, got %v", int64(got))
+	}
+
+	if _, err := WeightedMeanTimestamp(nil); err == nil {
+		t.Error("expected error for empty series")
+	}
+	if _, err := WeightedMeanTimestamp(pairs[1:3]); err == nil {
+		t.Error("expected error for series with zero count")
+	}
+}
+
+func TestHistogramSeriesQuantile(t *testing.T) {
+	pairs := []SampleHistogramPair{
+		{Timestamp: 1000, Histogram: genLinearHistogram([]float64{0, 10}, 10)},
+		{Timestamp: 2000},
+		{Timestamp: 3000, Histogram: genLinearHistogram([]float64{0, 10, 20}, 0, 0)},
+		{Timestamp: 4000, Histogram: genLinearHistogram([]float64{0, 10, 20}, 5, 5)},
+	}
+	got, err := HistogramSeriesQuantile(pairs, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SamplePair{
+		{Timestamp: 1000, Value: 9},
+		{Timestamp: 3000, Value: SampleValue(math.NaN())},
+		{Timestamp: 4000, Value: 18},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i, e := range expected {
+		if !got[i].Equal(&e) {
+			t.Errorf("pair %d: expected %v, got %v", i, e, got[i])
+		}
+	}
+
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := HistogramSeriesQuantile(pairs, q); err == nil {
+			t.Errorf("expected error for quantile %v", q)
+		}
+	}
+}
+
+func TestMatrixAggregateHistogramsByTime(t *testing.T) {
+	edges := []float64{0, 1, 2}
+	m := Matrix{
+		{
+			Metric: Metric{"instance": "a"},
+			Histograms: []SampleHistogramPair{
+				{Timestamp: 1000, Histogram: genLinearHistogram(edges, 1, 2)},
+				{Timestamp: 2000, Histogram: genLinearHistogram(edges, 3, 4)},
+			},
+		},
+		{
+			Metric: Metric{"instance": "b"},
+			Values: []SamplePair{{Timestamp: 1000, Value: 1}},
+		},
+		{
+			Metric: Metric{"instance": "c"},
+			Histograms: []SampleHistogramPair{
+				{Timestamp: 1000},
+				{Timestamp: 2000, Histogram: genLinearHistogram(edges, 10, 20)},
+				{Timestamp: 3000, Histogram: genLinearHistogram(edges, 5, 5)},
+			},
+		},
+	}
+	got, err := m.AggregateHistogramsByTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[Time]*SampleHistogram{
+		1000: genLinearHistogram(edges, 1, 2),
+		2000: genLinearHistogram(edges, 13, 24),
+		3000: genLinearHistogram(edges, 5, 5),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if c := m[0].Histograms[0].Histogram.Count; c != 3 {
+		t.Errorf("expected input to remain unchanged, got count %v", c)
+	}
+
+	m = append(m, &SampleStream{
+		Metric:     Metric{"instance": "d"},
+		Histograms: []SampleHistogramPair{{Timestamp: 2000, Histogram: genLinearHistogram([]float64{0, 5}, 1)}},
+	})
+	if _, err := m.AggregateHistogramsByTime(); err == nil {
+		t.Error("expected error for incompatible schemas")
+	}
+}
+
+func TestHistogramSeriesUpsert(t *testing.T) {
+	edges := []float64{0, 1, 2}
+	var hs HistogramSeries
+	for _, p := range []SampleHistogramPair{
+		{Timestamp: 2000, Histogram: genLinearHistogram(edges, 1, 1)},
+		{Timestamp: 4000, Histogram: genLinearHistogram(edges, 2, 2)},
+		{Timestamp: 1000},
+		{Timestamp: 3000, Histogram: genLinearHistogram(edges, 3, 3)},
+		// Late-arriving samples are folded into existing entries.
+		{Timestamp: 2000, Histogram: genLinearHistogram(edges, 5, 0)},
+		{Timestamp: 1000, Histogram: genLinearHistogram(edges, 0, 4)},
+		{Timestamp: 4000},
+	} {
+		if err := hs.Upsert(p); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	expected := HistogramSeries{
+		{Timestamp: 1000, Histogram: genLinearHistogram(edges, 0, 4)},
+		{Timestamp: 2000, Histogram: genLinearHistogram(edges, 6, 1)},
+		{Timestamp: 3000, Histogram: genLinearHistogram(edges, 3, 3)},
+		{Timestamp: 4000, Histogram: genLinearHistogram(edges, 2, 2)},
+	}
+	if !reflect.DeepEqual(hs, expected) {
+		t.Errorf("expected %v, got %v", expected, hs)
+	}
+
+	err := hs.Upsert(SampleHistogramPair{Timestamp: 3000, Histogram: genLinearHistogram([]float64{0, 5}, 1)})
+	if err == nil {
+		t.Error("expected error for incompatible schemas")
+	}
+	if !reflect.DeepEqual(hs, expected) {
+		t.Errorf("expected series to remain unchanged on error, got %v", hs)
+	}
+}
+
+func TestRollupHistogramSeries(t *testing.T) {
+	edges := []float64{0, 1, 2}
+	pairs := []SampleHistogramPair{
+		{Timestamp: 15000, Histogram: genLinearHistogram(edges, 1, 0)},
+		{Timestamp: 30000, Histogram: genLinearHistogram(edges, 2, 1)},
+		{Timestamp: 45000},
+		{Timestamp: 60001, Histogram: genLinearHistogram(edges, 0, 3)},
+		{Timestamp: 180000, Histogram: genLinearHistogram(edges, 4, 4)},
+	}
+	got, err := RollupHistogramSeries(pairs, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SampleHistogramPair{
+		{Timestamp: 60000, Histogram: genLinearHistogram(edges, 3, 1)},
+		{Timestamp: 120000, Histogram: genLinearHistogram(edges, 0, 3)},
+		{Timestamp: 180000, Histogram: genLinearHistogram(edges, 4, 4)},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if pairs[0].Histogram.Count != 1 {
+		t.Error("expected input to remain unchanged")
+	}
+
+	// Windows are aligned to the epoch for negative timestamps, too.
+	got, err = RollupHistogramSeries([]SampleHistogramPair{
+		{Timestamp: -1500, Histogram: genLinearHistogram(edges, 1, 1)},
+		{Timestamp: -1000, Histogram: genLinearHistogram(edges, 1, 1)},
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Timestamp != -1000 || got[0].Histogram.Count != 4 {
+		t.Errorf("unexpected rollup %v", got)
+	}
+
+	if _, err := RollupHistogramSeries(pairs, 0); err == nil {
+		t.Error("expected error for zero window")
+	}
+	if _, err := RollupHistogramSeries([]SampleHistogramPair{pairs[1], pairs[0]}, time.Minute); err == nil {
+		t.Error("expected error for unsorted series")
+	}
+	mixed := []SampleHistogramPair{pairs[0], {Timestamp: 20000, Histogram: genLinearHistogram([]float64{0, 5}, 1)}}
+	if _, err := RollupHistogramSeries(mixed, time.Minute); err == nil {
+		t.Error("expected error for incompatible schemas")
+	}
+}
+
+func TestDetectSchemaChanges(t *testing.T) {
+	a := []float64{0, 1, 2}
+	b := []float64{0, 2, 4}
+	pairs := []SampleHistogramPair{
+		{Timestamp: 1000, Histogram: genLinearHistogram(a, 1, 1)},
+		{Timestamp: 2000, Histogram: genLinearHistogram(a, 2, 2)},
+		{Timestamp: 3000, Histogram: genLinearHistogram(b, 2, 2)},
+		{Timestamp: 4000},
+		{Timestamp: 5000, Histogram: genLinearHistogram(b, 3, 3)},
+		{Timestamp: 6000},
+		{Timestamp: 7000, Histogram: genLinearHistogram(a, 3, 3)},
+	}
+	if got, expected := DetectSchemaChanges(pairs), []int{2, 6}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got := DetectSchemaChanges(pairs[:2]); got != nil {
+		t.Errorf("expected no changes, got %v", got)
+	}
+	if got := DetectSchemaChanges(nil); got != nil {
+		t.Errorf("expected no changes for empty series, got %v", got)
+	}
+}
+
+func TestHistogramSeriesAt(t *testing.T) {
+	hs := HistogramSeries{
+		{Timestamp: 1000, Histogram: genLinearHistogram([]float64{0, 1}, 1)},
+		{Timestamp: 2000, Histogram: genLinearHistogram([]float64{0, 1}, 2)},
+		{Timestamp: 4000, Histogram: genLinearHistogram([]float64{0, 1}, 4)},
+	}
+	tests := []struct {
+		t        Time
+		expected Time
+		ok       bool
+	}{
+		{t: 500},
+		{t: 1000, expected: 1000, ok: true},
+		{t: 1999, expected: 1000, ok: true},
+		{t: 3000, expected: 2000, ok: true},
+		{t: 4000, expected: 4000, ok: true},
+		{t: 9000, expected: 4000, ok: true},
+	}
+	for _, test := range tests {
+		p, ok := hs.At(test.t)
+		if ok != test.ok || (ok && p.Timestamp != test.expected) {
+			t.Errorf("%v: expected %v (%v), got %v (%v)", test.t, test.expected, test.ok, p, ok)
+		}
+	}
+	if _, ok := HistogramSeries(nil).At(1000); ok {
+		t.Error("expected no pair in empty series")
+	}
+}
+
+func TestHistogramRing(t *testing.T) {
+	timestamps := func(pairs []SampleHistogramPair) []Time {
+		res := []Time{}
+		for _, p := range pairs {
+			res = append(res, p.Timestamp)
+		}
+		return res
+	}
+	tests := []struct {
+		capacity int
+		pushed   []Time
+		expected []Time
+	}{
+		{capacity: 3, pushed: nil, expected: []Time{}},
+		{capacity: 3, pushed: []Time{1, 2}, expected: []Time{1, 2}},
+		{capacity: 3, pushed: []Time{1, 2, 3, 4, 5, 6, 7}, expected: []Time{5, 6, 7}},
+		{capacity: 1, pushed: []Time{1, 2, 3}, expected: []Time{3}},
+		// Late pairs are sorted in, or dropped if older than everything.
+		{capacity: 4, pushed: []Time{1, 3, 2, 5, 4, 6}, expected: []Time{3, 4, 5, 6}},
+		{capacity: 3, pushed: []Time{5, 6, 7, 8, 4}, expected: []Time{6, 7, 8}},
+		{capacity: 3, pushed: []Time{5, 6, 7, 8, 6}, expected: []Time{6, 7, 8}},
+	}
+	for _, test := range tests {
+		r := NewHistogramRing(test.capacity)
+		for _, ts := range test.pushed {
+			r.Push(SampleHistogramPair{Timestamp: ts, Histogram: genLinearHistogram([]float64{0, 1}, float64(ts))})
+		}
+		snapshot := r.Snapshot()
+		if got := timestamps(snapshot); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.pushed, test.expected, got)
+		}
+		for _, p := range snapshot {
+			if p.Histogram.Count != FloatString(p.Timestamp) {
+				t.Errorf("%v: pair %v holds the wrong histogram %v", test.pushed, p.Timestamp, p.Histogram)
+			}
+		}
+	}
+
+	// Snapshots are not affected by later pushes.
+	r := NewHistogramRing(2)
+	r.Push(SampleHistogramPair{Timestamp: 1})
+	snapshot := r.Snapshot()
+	r.Push(SampleHistogramPair{Timestamp: 2})
+	r.Push(SampleHistogramPair{Timestamp: 3})
+	if got := timestamps(snapshot); !reflect.DeepEqual(got, []Time{1}) {
+		t.Errorf("expected snapshot [1], got %v", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for zero capacity")
+		}
+	}()
+	NewHistogramRing(0)
+}
+
+func TestMergeHistogramSeries(t *testing.T) {
+	h := func(c float64) *SampleHistogram { return genLinearHistogram([]float64{0, 1}, c) }
+	a := HistogramSeries{
+		{Timestamp: 1000, Histogram: h(1)},
+		{Timestamp: 2000, Histogram: h(2)},
+		{Timestamp: 3000},
+		{Timestamp: 9000, Histogram: h(9)},
+	}
+	b := HistogramSeries{
+		{Timestamp: 2000, Histogram: h(20)},
+		{Timestamp: 2500, Histogram: h(25)},
+		{Timestamp: 3000, Histogram: h(30)},
+		{Timestamp: 12000, Histogram: h(120)},
+	}
+	merged, gaps, err := MergeHistogramSeries(a, b, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := HistogramSeries{
+		{Timestamp: 1000, Histogram: h(1)},
+		{Timestamp: 2000, Histogram: h(22)},
+		{Timestamp: 2500, Histogram: h(25)},
+		{Timestamp: 3000, Histogram: h(30)},
+		{Timestamp: 9000, Histogram: h(9)},
+		{Timestamp: 12000, Histogram: h(120)},
+	}
+	if len(merged) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, merged)
+	}
+	for i := range expected {
+		if !merged[i].Equal(&expected[i]) {
+			t.Errorf("pair %d: expected %v, got %v", i, expected[i], merged[i])
+		}
+	}
+	if expected := []Time{9000, 12000}; !reflect.DeepEqual(gaps, expected) {
+		t.Errorf("expected gaps %v, got %v", expected, gaps)
+	}
+	if a[1].Histogram.Count != 2 {
+		t.Errorf("input series was modified: %v", a)
+	}
+
+	merged, gaps, err = MergeHistogramSeries(nil, b[:2], time.Second)
+	if err != nil || len(merged) != 2 || gaps != nil {
+		t.Errorf("expected b unchanged without gaps, got %v, %v, %v", merged, gaps, err)
+	}
+
+	other := HistogramSeries{{Timestamp: 2000, Histogram: genLinearHistogram([]float64{0, 2}, 1)}}
+	if _, _, err := MergeHistogramSeries(a, other, time.Second); err == nil {
+		t.Error("expected error for incompatible schemas")
+	}
+	if _, _, err := MergeHistogramSeries(a, b, 0); err == nil {
+		t.Error("expected error for non-positive maximum gap")
+	}
+}
@@ -15,6 +15,7 @@ package model
 
 import (
 	"encoding/json"
+	"math"
 	"reflect"
 	"regexp"
 	"testing"
@@ -755,3 +756,652 @@ func BenchmarkJSONMarshallingSampleHistogramPairMatrix(b *testing.B) {
 		}
 	}
 }
+
+func TestSampleHistogramPairValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		pair SampleHistogramPair
+		err  string
+	}{
+		{
+			name: "valid",
+			pair: SampleHistogramPair{Timestamp: 1234567, Histogram: genSampleHistogram()},
+		},
+		{
+			name: "nil histogram",
+			pair: SampleHistogramPair{Timestamp: 1},
+			err:  "histogram is nil",
+		},
+		{
+			name: "negative timestamp",
+			pair: SampleHistogramPair{Timestamp: -1, Histogram: genSampleHistogram()},
+			err:  "negative timestamp -0.001",
+		},
+		{
+			name: "negative count",
+			pair: SampleHistogramPair{Histogram: &SampleHistogram{Count: -1}},
+			err:  "invalid histogram: invalid count -1",
+		},
+		{
+			name: "nil bucket",
+			pair: SampleHistogramPair{Histogram: &SampleHistogram{Count: 1, Buckets: HistogramBuckets{nil}}},
+			err:  "invalid histogram: bucket 0 is nil",
+		},
+		{
+			name: "inverted bounds",
+			pair: SampleHistogramPair{Histogram: &SampleHistogram{
+				Count: 2,
+				Buckets: HistogramBuckets{
+					{Lower: 0, Upper: 1, Count: 1},
+					{Lower: 3, Upper: 2, Count: 1},
+				},
+			}},
+			err: "invalid histogram: invalid bucket 1: lower bound 3 is greater than upper bound 2",
+		},
+		{
+			name: "unknown boundaries",
+			pair: SampleHistogramPair{Histogram: &SampleHistogram{
+				Count:   1,
+				Buckets: HistogramBuckets{{Boundaries: 4, Lower: 0, Upper: 1, Count: 1}},
+			}},
+			err: "invalid histogram: invalid bucket 0: invalid boundaries 4",
+		},
+		{
+			name: "negative bucket count",
+			pair: SampleHistogramPair{Histogram: &SampleHistogram{
+				Count:   1,
+				Buckets: HistogramBuckets{{Lower: 0, Upper: 1, Count: -1}},
+			}},
+			err: "invalid histogram: invalid bucket 0: invalid count -1",
+		},
+		{
+			name: "buckets exceed count",
+			pair: SampleHistogramPair{Histogram: &SampleHistogram{
+				Count:   1,
+				Buckets: HistogramBuckets{{Lower: 0, Upper: 1, Count: 2}},
+			}},
+			err: "invalid histogram: bucket counts sum to 2 which exceeds count 1",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.pair.Validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected error %q, got none", test.name, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %q", test.name, test.err, err)
+		}
+	}
+}
+
+func TestSampleHistogramPrettyString(t *testing.T) {
+	h := &SampleHistogram{
+		Count: 3,
+		Sum:   4.5,
+		Buckets: HistogramBuckets{
+			{Boundaries: 1, Lower: -2, Upper: -1, Count: 1},
+			{Boundaries: 3, Lower: -0.001, Upper: 0.001, Count: 0},
+			{Boundaries: 0, Lower: 1, Upper: 2, Count: 2},
+		},
+	}
+	expected := `Count: 3
+Sum: 4.5
+Buckets:
+  [-2,-1):1
+  [-0.001,0.001]:0
+  (1,2]:2
+`
+	if got := h.PrettyString(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestSampleHistogramComputeSumWhenMissing(t *testing.T) {
+	defer func(v bool) { ComputeSumFromMidpointsWhenMissing = v }(ComputeSumFromMidpointsWhenMissing)
+
+	tests := []struct {
+		plain   string
+		compute bool
+		sum     FloatString
+	}{
+		{
+			plain: `{"count":"3","buckets":[[0,"0","2","1"],[0,"2","4","2"]]}`,
+			sum:   0,
+		},
+		{
+			plain:   `{"count":"3","buckets":[[0,"0","2","1"],[0,"2","4","2"]]}`,
+			compute: true,
+			sum:     7,
+		},
+		{
+			plain:   `{"count":"3","sum":"0","buckets":[[0,"0","2","1"],[0,"2","4","2"]]}`,
+			compute: true,
+			sum:     0,
+		},
+		{
+			plain:   `{"count":"3","sum":"6.5","buckets":[[0,"0","2","1"],[0,"2","4","2"]]}`,
+			compute: true,
+			sum:     6.5,
+		},
+	}
+
+	for i, test := range tests {
+		ComputeSumFromMidpointsWhenMissing = test.compute
+		var h SampleHistogram
+		if err := json.Unmarshal([]byte(test.plain), &h); err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if h.Sum != test.sum {
+			t.Errorf("%d: expected sum %v, got %v", i, test.sum, h.Sum)
+		}
+		if h.Count != 3 || len(h.Buckets) != 2 {
+			t.Errorf("%d: unexpected histogram %v", i, h)
+		}
+	}
+}
+
+func TestSampleHistogramMarshalJSON(t *testing.T) {
+	plain := `{
+		"count":"6",
+		"sum":"3897",
+		"buckets":[
+			[1,"-4870.992343051145","-4466.7196729968955","1"],
+			[1,"-861.0779292198035","-789.6119426088657","1"],
+			[1,"-558.3399591246119","-512","1"],
+			[0,"2048","2233.3598364984477","1"],
+			[0,"2896.3093757400984","3158.4477704354626","1"],
+			[0,"4466.7196729968955","4870.992343051145","1"]
+		]
+	}`
+
+	h := genSampleHistogram()
+	b, err := h.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trimmed := noWhitespace.ReplaceAllString(plain, "")
+	if string(b) != trimmed {
+		t.Errorf("encoding error: expected %q, got %q", trimmed, b)
+	}
+
+	var decoded SampleHistogram
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(h) {
+		t.Errorf("decoding error: expected %v, got %v", h, decoded)
+	}
+}
+
+func TestHistogramBucketExactCountJSON(t *testing.T) {
+	// 2^53+1 is not representable as a float64 and survives a round trip
+	// only through CountExact.
+	in := `[0,"1","2","9007199254740993"]`
+	var b HistogramBucket
+	if err := json.Unmarshal([]byte(in), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Count != 1<<53 {
+		t.Errorf("expected count 2^53, got %v", b.Count)
+	}
+	if got, ok := b.ExactCount(); !ok || got.String() != "9007199254740993" {
+		t.Errorf("expected exact count 9007199254740993, got %v (%v)", got, ok)
+	}
+	out, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("expected %s, got %s", in, out)
+	}
+
+	// Counts within the range of exact float64 integers leave CountExact
+	// unset.
+	if err := json.Unmarshal([]byte(`[0,"1","2","42"]`), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.CountExact != nil {
+		t.Errorf("expected no exact count, got %v", b.CountExact)
+	}
+
+	// The exact count survives decoding whole histograms, which parse
+	// canonical buckets on a fast path.
+	data := `{"count":"9007199254740994","sum":"1","buckets":[[0,"0","1","9007199254740993"],[0,"1","2","1"]]}`
+	var h SampleHistogram
+	if err := json.Unmarshal([]byte(data), &h); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := h.Buckets[0].ExactCount(); !ok || got.String() != "9007199254740993" {
+		t.Errorf("expected exact count 9007199254740993, got %v (%v)", got, ok)
+	}
+	if h.Buckets[1].CountExact != nil {
+		t.Errorf("expected no exact count, got %v", h.Buckets[1].CountExact)
+	}
+	out, err = json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != data {
+		t.Errorf("expected %s, got %s", data, out)
+	}
+
+	v, err := LazyHistogram([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := v.Bucket(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = json.Marshal(lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[0,"0","1","9007199254740993"]`; string(out) != expected {
+		t.Errorf("expected %s, got %s", expected, out)
+	}
+}
+
+func TestHistogramBucketString(t *testing.T) {
+	inf := FloatString(math.Inf(1))
+	tests := []struct {
+		bucket   HistogramBucket
+		expected string
+	}{
+		{bucket: HistogramBucket{Boundaries: 0, Lower: 1, Upper: 2, Count: 3}, expected: "(1,2]:3"},
+		{bucket: HistogramBucket{Boundaries: 1, Lower: 1, Upper: 2, Count: 3}, expected: "[1,2):3"},
+		{bucket: HistogramBucket{Boundaries: 2, Lower: 1, Upper: 2, Count: 3}, expected: "(1,2):3"},
+		{bucket: HistogramBucket{Boundaries: 3, Lower: 1, Upper: 2, Count: 3}, expected: "[1,2]:3"},
+		{bucket: HistogramBucket{Boundaries: 3, Lower: 0, Upper: inf, Count: 3}, expected: "[0,+Inf):3"},
+		{bucket: HistogramBucket{Boundaries: 0, Lower: 0, Upper: inf, Count: 3}, expected: "(0,+Inf):3"},
+		{bucket: HistogramBucket{Boundaries: 3, Lower: -inf, Upper: 1, Count: 3}, expected: "(-Inf,1]:3"},
+		{bucket: HistogramBucket{Boundaries: 1, Lower: -inf, Upper: 1, Count: 3}, expected: "(-Inf,1):3"},
+		{bucket: HistogramBucket{Boundaries: 3, Lower: -inf, Upper: inf, Count: 3}, expected: "(-Inf,+Inf):3"},
+	}
+	for _, test := range tests {
+		if got := test.bucket.String(); got != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, got)
+		}
+	}
+}
+
+func TestUnmarshalHistogramStrict(t *testing.T) {
+	plain := `{
+		"count":"2",
+		"sum":"3",
+		"schema":3,
+		"buckets":[[0,"1","2","2"]],
+		"custom_values":["1"]
+	}`
+	h, unknown, err := UnmarshalHistogramStrict([]byte(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SampleHistogram{
+		Count:   2,
+		Sum:     3,
+		Buckets: HistogramBuckets{{Lower: 1, Upper: 2, Count: 2}},
+	}
+	if !h.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, h)
+	}
+	if expected := []string{"custom_values", "schema"}; !reflect.DeepEqual(unknown, expected) {
+		t.Errorf("expected unknown fields %v, got %v", expected, unknown)
+	}
+
+	_, unknown, err = UnmarshalHistogramStrict([]byte(`{"count":"0","sum":"0","buckets":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 0 {
+		t.Errorf("expected no unknown fields, got %v", unknown)
+	}
+
+	if _, _, err := UnmarshalHistogramStrict([]byte(`[]`)); err == nil {
+		t.Error("expected error for non-object input")
+	}
+}
+
+func TestSampleHistogramIsEmptyIsZero(t *testing.T) {
+	tests := []struct {
+		h       *SampleHistogram
+		empty   bool
+		zero    bool
+		encoded string
+	}{
+		{
+			h:       &SampleHistogram{},
+			empty:   true,
+			encoded: `[1,{"count":"0","sum":"0","buckets":[]}]`,
+		},
+		{
+			h:       &SampleHistogram{Buckets: HistogramBuckets{}},
+			empty:   true,
+			encoded: `[1,{"count":"0","sum":"0","buckets":[]}]`,
+		},
+		{
+			h:       genLinearHistogram([]float64{0, 1, 2}, 0, 0),
+			zero:    true,
+			encoded: `[1,{"count":"0","sum":"0","buckets":[[0,"0","1","0"],[0,"1","2","0"]]}]`,
+		},
+		{
+			h:       genLinearHistogram([]float64{0, 1, 2}, 0, 1),
+			encoded: `[1,{"count":"1","sum":"0","buckets":[[0,"0","1","0"],[0,"1","2","1"]]}]`,
+		},
+	}
+	for i, test := range tests {
+		if got := test.h.IsEmpty(); got != test.empty {
+			t.Errorf("%d: expected IsEmpty %v, got %v", i, test.empty, got)
+		}
+		if got := test.h.IsZero(); got != test.zero {
+			t.Errorf("%d: expected IsZero %v, got %v", i, test.zero, got)
+		}
+
+		b, err := json.Marshal(SampleHistogramPair{Timestamp: 1000, Histogram: test.h})
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if string(b) != test.encoded {
+			t.Errorf("%d: expected %s, got %s", i, test.encoded, b)
+		}
+		var sp SampleHistogramPair
+		if err := json.Unmarshal(b, &sp); err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if sp.Histogram.IsEmpty() != test.empty || sp.Histogram.IsZero() != test.zero {
+			t.Errorf("%d: decoded histogram %v does not round-trip", i, sp.Histogram)
+		}
+	}
+}
+
+func TestSampleHistogramUnmarshalBuckets(t *testing.T) {
+	tests := []struct {
+		plain    string
+		expected HistogramBuckets
+	}{
+		{plain: `{"buckets":null}`, expected: nil},
+		{plain: `{"buckets":[]}`, expected: HistogramBuckets{}},
+		{plain: `{"buckets":[ ]}`, expected: HistogramBuckets{}},
+		{
+			plain:    `{"buckets":[ [0,"0","1","2"] , null, [3, "1" ,"2","4"] ]}`,
+			expected: HistogramBuckets{{Lower: 0, Upper: 1, Count: 2}, nil, {Boundaries: 3, Lower: 1, Upper: 2, Count: 4}},
+		},
+	}
+	for _, test := range tests {
+		var h SampleHistogram
+		if err := json.Unmarshal([]byte(test.plain), &h); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.plain, err)
+			continue
+		}
+		if !reflect.DeepEqual(h.Buckets, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.plain, test.expected, h.Buckets)
+		}
+	}
+
+	for _, plain := range []string{
+		`{"buckets":{}}`,
+		`{"buckets":"[]"}`,
+		`{"buckets":[[0,"0","1"]]}`,
+		`{"buckets":[[0,"0","1","2"],[0,"1","2",3]]}`,
+	} {
+		var h SampleHistogram
+		if err := json.Unmarshal([]byte(plain), &h); err == nil {
+			t.Errorf("expected error when decoding %s", plain)
+		}
+	}
+}
+
+// genLargeSampleHistogramJSON returns the JSON encoding of a histogram with
+// n buckets.
+func genLargeSampleHistogramJSON(n int) []byte {
+	h := &SampleHistogram{}
+	for i := 0; i < n; i++ {
+		h.Buckets = append(h.Buckets, &HistogramBucket{
+			Lower: FloatString(math.Pow(2, float64(i)/8)),
+			Upper: FloatString(math.Pow(2, float64(i+1)/8)),
+			Count: FloatString(i),
+		})
+		h.Count += FloatString(i)
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func BenchmarkSampleHistogramUnmarshalJSON(b *testing.B) {
+	data := genLargeSampleHistogramJSON(256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var h SampleHistogram
+		if err := json.Unmarshal(data, &h); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSampleHistogramUnmarshalJSONGeneric decodes the same data as
+// BenchmarkSampleHistogramUnmarshalJSON without the preallocating decoder,
+// for comparison.
+func BenchmarkSampleHistogramUnmarshalJSONGeneric(b *testing.B) {
+	data := genLargeSampleHistogramJSON(256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var h struct {
+			Count   FloatString      `json:"count"`
+			Sum     FloatString      `json:"sum"`
+			Buckets HistogramBuckets `json:"buckets"`
+		}
+		if err := json.Unmarshal(data, &h); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSampleHistogramLEObjectBuckets(t *testing.T) {
+	defer func(v bool) { AcceptLEObjectBuckets = v }(AcceptLEObjectBuckets)
+	plain := `{"count":"20","sum":"4","buckets":{"0.5":"12","+Inf":"20","0.1":"5"}}`
+
+	AcceptLEObjectBuckets = false
+	var h SampleHistogram
+	if err := json.Unmarshal([]byte(plain), &h); err == nil {
+		t.Errorf("expected error when decoding object buckets while disabled")
+	}
+
+	AcceptLEObjectBuckets = true
+	h = SampleHistogram{}
+	if err := json.Unmarshal([]byte(plain), &h); err != nil {
+		t.Fatal(err)
+	}
+	expected := &SampleHistogram{
+		Count: 20,
+		Sum:   4,
+		Buckets: HistogramBuckets{
+			{Lower: 0, Upper: 0.1, Count: 5},
+			{Lower: 0.1, Upper: 0.5, Count: 7},
+			{Lower: 0.5, Upper: FloatString(math.Inf(1)), Count: 8},
+		},
+	}
+	if !h.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, h)
+	}
+
+	// Re-encoding yields the regular array form, which still decodes.
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded SampleHistogram
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, decoded)
+	}
+
+	h = SampleHistogram{}
+	if err := json.Unmarshal([]byte(`{"buckets":{"-1":"1","1":"3"}}`), &h); err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsInf(float64(h.Buckets[0].Lower), -1) {
+		t.Errorf("expected lowest bucket to start at -Inf for a negative bound, got %v", h.Buckets[0])
+	}
+
+	for _, plain := range []string{
+		`{"buckets":{"fast":"1"}}`,
+		`{"buckets":{"1":"5","2":"3"}}`,
+		`{"buckets":{"1":5}}`,
+	} {
+		if err := json.Unmarshal([]byte(plain), &h); err == nil {
+			t.Errorf("expected error when decoding %s", plain)
+		}
+	}
+}
+
+func TestSampleHistogramJSONDeterministic(t *testing.T) {
+	h := &SampleHistogram{
+		Count: 3,
+		Sum:   2.5,
+		// Buckets are encoded in their stored order, even if unsorted.
+		Buckets: HistogramBuckets{
+			{Boundaries: 0, Lower: 1, Upper: 2, Count: 1},
+			{Boundaries: 3, Lower: -1, Upper: 1, Count: 2},
+		},
+	}
+	expected := `{"count":"3","sum":"2.5","buckets":[[0,"1","2","1"],[3,"-1","1","2"]]}`
+
+	for i := 0; i < 10; i++ {
+		for _, v := range []interface{}{h, *h} {
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != expected {
+				t.Fatalf("expected %s, got %s", expected, b)
+			}
+		}
+	}
+
+	b, err := json.Marshal(SampleHistogramPair{Timestamp: 1500, Histogram: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedPair := `[1.5,` + expected + `]`; string(b) != expectedPair {
+		t.Errorf("expected %s, got %s", expectedPair, b)
+	}
+
+	b, err = json.Marshal(&SampleHistogram{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedEmpty := `{"count":"0","sum":"0","buckets":[]}`; string(b) != expectedEmpty {
+		t.Errorf("expected %s, got %s", expectedEmpty, b)
+	}
+}
+
+func TestCompactHistogramBucket(t *testing.T) {
+	tests := []struct {
+		bucket HistogramBucket
+		// Relative error to expect after a round trip.
+		epsilon float64
+	}{
+		{bucket: HistogramBucket{Boundaries: 3, Lower: -1, Upper: 0.5, Count: 12}},
+		{bucket: HistogramBucket{Boundaries: 0, Lower: 1024, Upper: FloatString(math.Inf(1)), Count: 1 << 20}},
+		{bucket: HistogramBucket{Boundaries: 1, Lower: 0.1, Upper: 0.2, Count: 3.3}, epsilon: 1e-7},
+		{bucket: HistogramBucket{Boundaries: 2, Lower: 4466.7196729968955, Upper: 4870.992343051145, Count: 1<<24 + 1}, epsilon: 1e-7},
+	}
+	for _, test := range tests {
+		got := test.bucket.Compact().Expand()
+		if got.Boundaries != test.bucket.Boundaries {
+			t.Errorf("%v: expected boundaries %d, got %d", test.bucket, test.bucket.Boundaries, got.Boundaries)
+		}
+		for _, v := range [][2]FloatString{
+			{test.bucket.Lower, got.Lower},
+			{test.bucket.Upper, got.Upper},
+			{test.bucket.Count, got.Count},
+		} {
+			expected, actual := float64(v[0]), float64(v[1])
+			if test.epsilon == 0 && expected != actual {
+				t.Errorf("%v: expected exact %v, got %v", test.bucket, expected, actual)
+			}
+			if test.epsilon > 0 && math.Abs(actual-expected) > test.epsilon*math.Abs(expected) {
+				t.Errorf("%v: expected %v within %v, got %v", test.bucket, expected, test.epsilon, actual)
+			}
+		}
+	}
+}
+
+func TestSampleHistogramClampNegativeCountsOnDecode(t *testing.T) {
+	defer func(v bool) { ClampNegativeCountsOnDecode = v }(ClampNegativeCountsOnDecode)
+
+	tests := []struct {
+		plain    string
+		clamp    bool
+		expected SampleHistogram
+	}{
+		{
+			plain: `{"count":"2","sum":"-1","buckets":[[0,"0","1","3"],[0,"1","2","-1e-9"]]}`,
+			expected: SampleHistogram{
+				Count: 2,
+				Sum:   -1,
+				Buckets: HistogramBuckets{
+					{Lower: 0, Upper: 1, Count: 3},
+					{Lower: 1, Upper: 2, Count: -1e-9},
+				},
+			},
+		},
+		{
+			plain: `{"count":"2","sum":"-1","buckets":[[0,"0","1","3"],[0,"1","2","-1e-9"]]}`,
+			clamp: true,
+			expected: SampleHistogram{
+				Count: 3,
+				Sum:   0,
+				Buckets: HistogramBuckets{
+					{Lower: 0, Upper: 1, Count: 3},
+					{Lower: 1, Upper: 2, Count: 0},
+				},
+			},
+		},
+		{
+			plain:    `{"count":"-4","sum":"2","buckets":[]}`,
+			clamp:    true,
+			expected: SampleHistogram{Count: 0, Sum: 2, Buckets: HistogramBuckets{}},
+		},
+		{
+			// Valid counts are left alone.
+			plain: `{"count":"5","sum":"2","buckets":[[0,"0","1","3"]]}`,
+			clamp: true,
+			expected: SampleHistogram{
+				Count:   5,
+				Sum:     2,
+				Buckets: HistogramBuckets{{Lower: 0, Upper: 1, Count: 3}},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		ClampNegativeCountsOnDecode = test.clamp
+		var h SampleHistogram
+		if err := json.Unmarshal([]byte(test.plain), &h); err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !h.Equal(&test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, h)
+		}
+	}
+}
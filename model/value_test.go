@@ -145,6 +145,44 @@ func TestEqualSamples(t *testing.T) {
 			},
 			want: false,
 		},
+		"histogram and scalar": {
+			in1: &Sample{
+				Metric:    Metric{"foo": "bar"},
+				Timestamp: 0,
+				Histogram: genSampleHistogram(),
+			},
+			in2: &Sample{
+				Metric:    Metric{"foo": "bar"},
+				Timestamp: 0,
+				Value:     1,
+			},
+			want: false,
+		},
+		"scalar and histogram": {
+			in1: &Sample{
+				Metric:    Metric{"foo": "bar"},
+				Timestamp: 0,
+				Value:     1,
+			},
+			in2: &Sample{
+				Metric:    Metric{"foo": "bar"},
+				Timestamp: 0,
+				Histogram: genSampleHistogram(),
+			},
+			want: false,
+		},
+		"zero scalar and empty histogram": {
+			in1: &Sample{
+				Metric:    Metric{"foo": "bar"},
+				Timestamp: 0,
+			},
+			in2: &Sample{
+				Metric:    Metric{"foo": "bar"},
+				Timestamp: 0,
+				Histogram: &SampleHistogram{},
+			},
+			want: false,
+		},
 	}
 
 	for name, test := range tests {